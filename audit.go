@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// these are the keys of the audit annotations we set on admission responses; the API server
+	// prefixes them with the webhook's name when recording them in its audit log
+	serviceAccountAuditAnnotationKey       = "service-account"
+	credSpecsAuditAnnotationKey            = "credential-specs"
+	authorizationReasonsAuditAnnotationKey = "authorization-reasons"
+	enforcementModeAuditAnnotationKey      = "enforcement-mode"
+	unenforcedViolationsAuditAnnotationKey = "unenforced-violations"
+
+	// denialEventReason is the reason of the events we emit on denials
+	denialEventReason = "GMSAAdmissionDenied"
+)
+
+// auditedCredSpecs is the JSON value of the credSpecsAuditAnnotationKey audit annotation.
+type auditedCredSpecs struct {
+	Pod        string            `json:"pod,omitempty"`
+	Containers map[string]string `json:"containers,omitempty"`
+}
+
+// authorizeCredSpecUse checks whether the pod's service account is authorized to `use` the
+// given cred spec, and records the outcome for auditing purposes.
+func (webhook *webhook) authorizeCredSpecUse(admissionCtx *admissionContext, pod *corev1.Pod, credSpecName string) (bool, string) {
+	span := webhook.tracer.startSpan("isAuthorizedToUseCredSpec", admissionCtx.span, spanKindClient)
+	span.setAttribute("gmsa.credspec.name", credSpecName)
+	serviceAccountName := podServiceAccountName(pod)
+	span.setAttribute("k8s.serviceaccount.name", serviceAccountName)
+	authorized, reason := webhook.client.isAuthorizedToUseCredSpec(serviceAccountName, admissionCtx.namespace, credSpecName)
+	span.setAttribute("gmsa.authorized", authorized)
+	span.finish()
+
+	if admissionCtx.authorizationReasons == nil {
+		admissionCtx.authorizationReasons = make(map[string]string)
+	}
+	admissionCtx.authorizationReasons[credSpecName] = reason
+
+	return authorized, reason
+}
+
+// auditAnnotations returns the audit annotations describing which GMSAs the pod uses, if any,
+// and which violations were not enforced, if any.
+func (admissionCtx *admissionContext) auditAnnotations() map[string]string {
+	pod := admissionCtx.pod
+	if pod == nil {
+		return nil
+	}
+
+	var annotations map[string]string
+	if len(admissionCtx.unenforcedViolations) != 0 {
+		annotations = map[string]string{
+			enforcementModeAuditAnnotationKey: string(admissionCtx.enforcementMode),
+		}
+		addJSONAuditAnnotation(annotations, unenforcedViolationsAuditAnnotationKey, admissionCtx.unenforcedViolations)
+	}
+
+	if len(requestedCredSpecNames(pod)) == 0 {
+		return annotations
+	}
+
+	credSpecs := auditedCredSpecs{Pod: pod.Annotations[gMSAPodSpecNameAnnotationKey]}
+	for _, container := range pod.Spec.Containers {
+		if credSpecName := pod.Annotations[container.Name+gMSAContainerSpecNameAnnotationKeySuffix]; credSpecName != "" {
+			if credSpecs.Containers == nil {
+				credSpecs.Containers = make(map[string]string)
+			}
+			credSpecs.Containers[container.Name] = credSpecName
+		}
+	}
+
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[serviceAccountAuditAnnotationKey] = podServiceAccountName(pod)
+	addJSONAuditAnnotation(annotations, credSpecsAuditAnnotationKey, credSpecs)
+	if len(admissionCtx.authorizationReasons) != 0 {
+		addJSONAuditAnnotation(annotations, authorizationReasonsAuditAnnotationKey, admissionCtx.authorizationReasons)
+	}
+
+	return annotations
+}
+
+func addJSONAuditAnnotation(annotations map[string]string, key string, value interface{}) {
+	valueBytes, err := json.Marshal(value)
+	if err != nil {
+		logrus.Errorf("unable to marshall audit annotation %s: %v", key, err)
+		return
+	}
+	annotations[key] = string(valueBytes)
+}
+
+// recordDenialEvent emits a warning event on the workload owning a pod that just got denied,
+// if events are enabled, and the request is not a dry run.
+func (webhook *webhook) recordDenialEvent(admissionCtx *admissionContext, admissionErr *podAdmissionError) {
+	if !webhook.config.denialEvents || admissionCtx.dryRun || admissionErr.pod == nil {
+		return
+	}
+
+	owner := metav1.GetControllerOf(admissionErr.pod)
+	if owner == nil {
+		// nowhere to attach the event to, since the pod itself won't exist; the client creating
+		// a bare pod gets the denial message directly anyway
+		return
+	}
+
+	object := &corev1.ObjectReference{
+		APIVersion: owner.APIVersion,
+		Kind:       owner.Kind,
+		Name:       owner.Name,
+		Namespace:  admissionCtx.namespace,
+		UID:        owner.UID,
+	}
+	webhook.client.recordEvent(object, corev1.EventTypeWarning, denialEventReason, admissionErr.Error())
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// controller is a minimal work queue-based controller: informers' event handlers enqueue the
+// keys of the objects that changed, and workers call `reconcile` on each key, retrying with
+// exponential backoff on errors. Since informers periodically re-list all the objects they
+// watch, every object also gets reconciled again on each resync.
+type controller struct {
+	name      string
+	workers   int
+	queue     workqueue.RateLimitingInterface
+	reconcile func(key string) error
+}
+
+// runnableController is implemented by all controllers, see runControllers.
+type runnableController interface {
+	run(stopCh <-chan struct{})
+}
+
+func newController(name string, workers int, reconcile func(key string) error) *controller {
+	return &controller{
+		name:      name,
+		workers:   workers,
+		queue:     workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), name),
+		reconcile: reconcile,
+	}
+}
+
+// eventHandler returns an informer event handler that enqueues the keys of all the objects it's
+// notified about.
+func (c *controller) eventHandler() cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueue,
+		UpdateFunc: func(_, newObj interface{}) {
+			c.enqueue(newObj)
+		},
+		DeleteFunc: c.enqueue,
+	}
+}
+
+func (c *controller) enqueue(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		logrus.Errorf("%s controller: unable to compute key for %v: %v", c.name, obj, err)
+		return
+	}
+	c.queue.Add(key)
+}
+
+// run is a blocking call that processes the queue until `stopCh` gets closed.
+func (c *controller) run(stopCh <-chan struct{}) {
+	defer utilruntime.HandleCrash()
+	defer c.queue.ShutDown()
+
+	logrus.Infof("starting %s controller", c.name)
+	for i := 0; i < c.workers; i++ {
+		go wait.Until(c.work, time.Second, stopCh)
+	}
+
+	<-stopCh
+	logrus.Infof("stopping %s controller", c.name)
+}
+
+func (c *controller) work() {
+	for c.processNextKey() {
+	}
+}
+
+// processNextKey returns false iff the queue has been shut down.
+func (c *controller) processNextKey() bool {
+	item, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(item)
+
+	key := item.(string)
+	if err := c.reconcile(key); err != nil {
+		reconciliationsCounter.WithLabelValues(c.name, "error").Inc()
+		logrus.Errorf("%s controller: unable to reconcile %s (attempt %d): %v", c.name, key, c.queue.NumRequeues(item)+1, err)
+		c.queue.AddRateLimited(item)
+		return true
+	}
+
+	reconciliationsCounter.WithLabelValues(c.name, "success").Inc()
+	c.queue.Forget(item)
+	return true
+}
+
+// splitKey splits a key computed by `enqueue` into a namespace and a name.
+func splitKey(key string) (string, string, error) {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid key %q: %v", key, err)
+	}
+	return namespace, name, nil
+}
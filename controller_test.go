@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// fakeControllerClient is an in-memory implementation of the client interfaces of the controllers
+// watching pods: credSpecUsageClientInterface, reauthorizationClientInterface and
+// driftClientInterface. Pods are keyed by namespace/name.
+type fakeControllerClient struct {
+	pods      map[string]*corev1.Pod
+	credSpecs map[string]*fakeCredSpec
+	// authorized lists the cred specs service accounts are authorized to use, keyed by
+	// namespace/service account name
+	authorized map[string][]string
+	// templates are the pod templates of workloads, keyed by namespace/kind/name
+	templates map[string]*corev1.PodTemplateSpec
+
+	authzErr   error
+	evictErr   error
+	restartErr error
+
+	// updates counts the updates to cred specs' statuses
+	updates int
+	evicted []string
+	events  []string
+}
+
+// fakeCredSpec is a cred spec, as far as controllers are concerned.
+type fakeCredSpec struct {
+	contents    string
+	annotations map[string]string
+	// usage and stale are the status fields maintained by the usage and drift controllers
+	usage *credSpecUsage
+	stale *credSpecUsage
+}
+
+func newFakeControllerClient(pods ...*corev1.Pod) *fakeControllerClient {
+	client := &fakeControllerClient{
+		pods:       make(map[string]*corev1.Pod),
+		credSpecs:  make(map[string]*fakeCredSpec),
+		authorized: make(map[string][]string),
+		templates:  make(map[string]*corev1.PodTemplateSpec),
+	}
+	for _, pod := range pods {
+		client.pods[pod.Namespace+"/"+pod.Name] = pod
+	}
+	return client
+}
+
+func (*fakeControllerClient) watchGMSACredSpecs(handler cache.ResourceEventHandler) {}
+
+func (*fakeControllerClient) watchGMSAPods(handler cache.ResourceEventHandler) error {
+	return nil
+}
+
+func (client *fakeControllerClient) listGMSAPods() ([]*corev1.Pod, error) {
+	keys := make([]string, 0, len(client.pods))
+	for key := range client.pods {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pods := make([]*corev1.Pod, len(keys))
+	for i, key := range keys {
+		pods[i] = client.pods[key]
+	}
+	return pods, nil
+}
+
+func (client *fakeControllerClient) listPodsUsingCredSpec(credSpecName string) ([]*corev1.Pod, error) {
+	allPods, _ := client.listGMSAPods()
+	var pods []*corev1.Pod
+	for _, pod := range allPods {
+		if containsString(requestedCredSpecNames(pod), credSpecName) {
+			pods = append(pods, pod)
+		}
+	}
+	return pods, nil
+}
+
+func (client *fakeControllerClient) retrieveCachedPod(namespace, name string) (*corev1.Pod, error) {
+	return client.pods[namespace+"/"+name], nil
+}
+
+func (client *fakeControllerClient) retrieveCachedCredSpecContents(credSpecName string) (string, map[string]string, bool, error) {
+	if credSpec, exists := client.credSpecs[credSpecName]; exists {
+		return credSpec.contents, credSpec.annotations, true, nil
+	}
+	return "", nil, false, nil
+}
+
+func (client *fakeControllerClient) retrieveCredSpecUsage(credSpecName string) (*credSpecUsage, bool, error) {
+	if credSpec, exists := client.credSpecs[credSpecName]; exists {
+		return credSpec.usage, true, nil
+	}
+	return nil, false, nil
+}
+
+func (client *fakeControllerClient) updateCredSpecUsage(credSpecName string, usage *credSpecUsage) error {
+	client.updates++
+	client.credSpecs[credSpecName].usage = usage
+	return nil
+}
+
+func (client *fakeControllerClient) retrieveCredSpecStalePods(credSpecName string) (*credSpecUsage, bool, error) {
+	if credSpec, exists := client.credSpecs[credSpecName]; exists {
+		return credSpec.stale, true, nil
+	}
+	return nil, false, nil
+}
+
+func (client *fakeControllerClient) updateCredSpecStalePods(credSpecName string, stale *credSpecUsage) error {
+	client.updates++
+	client.credSpecs[credSpecName].stale = stale
+	return nil
+}
+
+func (client *fakeControllerClient) checkCredSpecUseAuthorization(serviceAccountName, namespace, credSpecName string) (bool, string, error) {
+	if client.authzErr != nil {
+		return false, "", client.authzErr
+	}
+	return containsString(client.authorized[namespace+"/"+serviceAccountName], credSpecName), "no RBAC policy matched", nil
+}
+
+func (client *fakeControllerClient) evictPod(pod *corev1.Pod) error {
+	if client.evictErr != nil {
+		return client.evictErr
+	}
+	client.evicted = append(client.evicted, pod.Namespace+"/"+pod.Name)
+	delete(client.pods, pod.Namespace+"/"+pod.Name)
+	return nil
+}
+
+func (client *fakeControllerClient) restartWorkload(namespace, kind, name, credSpecName, revision string) (bool, error) {
+	if client.restartErr != nil {
+		return false, client.restartErr
+	}
+	template, present := client.templates[namespace+"/"+kind+"/"+name]
+	if !present {
+		return false, nil
+	}
+	return markTemplateRestarted(template, credSpecName, revision, time.Now()), nil
+}
+
+func (client *fakeControllerClient) recordEvent(object *corev1.ObjectReference, eventType, reason, message string) {
+	client.events = append(client.events, fmt.Sprintf("%s %s %s %s/%s: %s", eventType, reason, object.Kind, object.Namespace, object.Name, message))
+}
+
+// newPodUsingCredSpec returns a running pod using the given cred spec, with the given contents
+// if not empty, and owned by the given workload if not nil; pods owned by replica sets get the
+// label that the deployment controller sets on them.
+func newPodUsingCredSpec(namespace, name, credSpecName, contents string, owner *metav1.OwnerReference) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   namespace,
+			Labels:      map[string]string{},
+			Annotations: map[string]string{gMSAPodSpecNameAnnotationKey: credSpecName},
+		},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+	if contents != "" {
+		pod.Annotations[gMSAPodSpecContentsAnnotationKey] = contents
+	}
+	if owner != nil {
+		isController := true
+		owner.Controller = &isController
+		pod.OwnerReferences = []metav1.OwnerReference{*owner}
+
+		if owner.Kind == "ReplicaSet" {
+			pod.Labels["pod-template-hash"] = owner.Name[strings.LastIndex(owner.Name, "-")+1:]
+		}
+	}
+	return pod
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxReportedJSONDiffPaths caps how many differing paths get reported in denial messages.
+const maxReportedJSONDiffPaths = 10
+
+// Cred spec contents are JSON documents, that can get re-serialized on their way to us, e.g. by
+// other webhooks round-tripping annotations; so they need to be compared semantically rather
+// than as raw strings.
+
+// decodeJSON decodes a JSON document, keeping numbers as they were written.
+func decodeJSON(raw string) (interface{}, error) {
+	decoder := json.NewDecoder(strings.NewReader(raw))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("trailing data after JSON document")
+	}
+	return value, nil
+}
+
+// canonicalJSON returns the canonical form of a JSON document: no insignificant whitespace,
+// objects' keys sorted, and numbers written the same way as long as they're equal, consistently
+// with credSpecContentsEqual. Documents that are not valid JSON are returned unchanged.
+func canonicalJSON(raw string) string {
+	value, err := decodeJSON(raw)
+	if err != nil {
+		return raw
+	}
+
+	buffer := &bytes.Buffer{}
+	encoder := json.NewEncoder(buffer)
+	// cred specs can contain e.g. "&" characters, that don't need escaping here
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(canonicalJSONNumbers(value)); err != nil {
+		return raw
+	}
+	return strings.TrimSuffix(buffer.String(), "\n")
+}
+
+// canonicalJSONNumbers rewrites in place all the numbers contained in a decoded JSON value to
+// their shortest representation, e.g. "1.0" and "1e0" both become "1".
+func canonicalJSONNumbers(value interface{}) interface{} {
+	switch typedValue := value.(type) {
+	case map[string]interface{}:
+		for key, child := range typedValue {
+			typedValue[key] = canonicalJSONNumbers(child)
+		}
+	case []interface{}:
+		for i, child := range typedValue {
+			typedValue[i] = canonicalJSONNumbers(child)
+		}
+	case json.Number:
+		float, err := strconv.ParseFloat(string(typedValue), 64)
+		if err != nil {
+			// out of range, keep it as is
+			return typedValue
+		}
+		if float == 0 {
+			// -0 equals 0
+			float = 0
+		}
+		return json.Number(strconv.FormatFloat(float, 'g', -1, 64))
+	}
+	return value
+}
+
+// credSpecContentsEqual returns true iff both cred spec contents are semantically equal JSON
+// documents; if they're not, it also returns the paths at which they differ, if they're both
+// valid JSON.
+func credSpecContentsEqual(actual, expected string) (bool, []string) {
+	if actual == expected {
+		return true, nil
+	}
+
+	actualValue, err := decodeJSON(actual)
+	if err != nil {
+		return false, nil
+	}
+	expectedValue, err := decodeJSON(expected)
+	if err != nil {
+		return false, nil
+	}
+
+	paths := diffJSONValues("$", actualValue, expectedValue, nil)
+	return len(paths) == 0, paths
+}
+
+// diffJSONValues appends the paths at which both decoded JSON values differ to paths.
+func diffJSONValues(path string, actual, expected interface{}, paths []string) []string {
+	switch expectedValue := expected.(type) {
+	case map[string]interface{}:
+		actualValue, ok := actual.(map[string]interface{})
+		if !ok {
+			return append(paths, path)
+		}
+
+		keys := make(map[string]string, len(expectedValue)+len(actualValue))
+		for key := range expectedValue {
+			keys[key] = ""
+		}
+		for key := range actualValue {
+			keys[key] = ""
+		}
+		for _, key := range sortedKeys(keys) {
+			actualChild, actualPresent := actualValue[key]
+			expectedChild, expectedPresent := expectedValue[key]
+			childPath := path + "." + key
+			if actualPresent != expectedPresent {
+				paths = append(paths, childPath)
+			} else {
+				paths = diffJSONValues(childPath, actualChild, expectedChild, paths)
+			}
+		}
+		return paths
+
+	case []interface{}:
+		actualValue, ok := actual.([]interface{})
+		if !ok {
+			return append(paths, path)
+		}
+
+		for i := 0; i < len(expectedValue) || i < len(actualValue); i++ {
+			childPath := fmt.Sprintf("%s[%d]", path, i)
+			if i >= len(expectedValue) || i >= len(actualValue) {
+				paths = append(paths, childPath)
+			} else {
+				paths = diffJSONValues(childPath, actualValue[i], expectedValue[i], paths)
+			}
+		}
+		return paths
+
+	case json.Number:
+		actualValue, ok := actual.(json.Number)
+		if !ok || !jsonNumbersEqual(actualValue, expectedValue) {
+			return append(paths, path)
+		}
+		return paths
+
+	default:
+		// strings, booleans, and nulls
+		if actual != expected {
+			return append(paths, path)
+		}
+		return paths
+	}
+}
+
+// jsonNumbersEqual compares numbers regardless of how they're written, e.g. "1.0" and "1e0".
+func jsonNumbersEqual(a, b json.Number) bool {
+	if a == b {
+		return true
+	}
+	aFloat, aErr := strconv.ParseFloat(string(a), 64)
+	bFloat, bErr := strconv.ParseFloat(string(b), 64)
+	return aErr == nil && bErr == nil && aFloat == bFloat
+}
+
+// formatJSONDiffPaths formats differing paths for denial messages.
+func formatJSONDiffPaths(paths []string) string {
+	sort.Strings(paths)
+	if len(paths) <= maxReportedJSONDiffPaths {
+		return strings.Join(paths, ", ")
+	}
+	return fmt.Sprintf("%s (and %d more)", strings.Join(paths[:maxReportedJSONDiffPaths], ", "), len(paths)-maxReportedJSONDiffPaths)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanonicalJSON(t *testing.T) {
+	assert.Equal(t, `{"a":[1,2.5,{"b":"&","c":null}],"d":true}`, canonicalJSON(" {\n\"d\": true, \"a\": [1, 2.50, {\"c\": null, \"b\": \"&\"}]}\n"))
+	// equal numbers are written the same way
+	assert.Equal(t, `[1,1,1,-1.5,0,1e+21]`, canonicalJSON(`[1, 1.0, 1e0, -15E-1, -0, 1000000000000000000000]`))
+	// not JSON
+	assert.Equal(t, "{not json", canonicalJSON("{not json"))
+}
+
+func TestCredSpecContentsEqual(t *testing.T) {
+	expected := `{"ActiveDirectoryConfig":{"GroupManagedServiceAccounts":[{"Name":"WebApp1","Scope":"CONTOSO"}]},"DomainJoinConfig":{"DnsName":"contoso.com","Sid":"S-1-5-21"},"CmsPlugins":["ActiveDirectory"],"Version":1}`
+
+	for name, testCase := range map[string]struct {
+		actual        string
+		expectedEqual bool
+		expectedPaths []string
+	}{
+		"identical": {
+			actual:        expected,
+			expectedEqual: true,
+		},
+		"re-serialized": {
+			actual: `{
+  "Version": 1.0,
+  "CmsPlugins": [ "ActiveDirectory" ],
+  "DomainJoinConfig": { "Sid": "S-1-5-21", "DnsName": "contoso.com" },
+  "ActiveDirectoryConfig": { "GroupManagedServiceAccounts": [ { "Scope": "CONTOSO", "Name": "WebApp1" } ] }
+}`,
+			expectedEqual: true,
+		},
+		"different values, and missing and extra members": {
+			actual:        `{"ActiveDirectoryConfig":{"GroupManagedServiceAccounts":[{"Name":"WebApp2","Scope":"CONTOSO"},{"Name":"WebApp3"}]},"DomainJoinConfig":{"DnsName":"contoso.com","Guid":"abc"},"CmsPlugins":"ActiveDirectory","Version":2}`,
+			expectedEqual: false,
+			expectedPaths: []string{"$.ActiveDirectoryConfig.GroupManagedServiceAccounts[0].Name", "$.ActiveDirectoryConfig.GroupManagedServiceAccounts[1]", "$.CmsPlugins", "$.DomainJoinConfig.Guid", "$.DomainJoinConfig.Sid", "$.Version"},
+		},
+		"not JSON": {
+			actual:        "{not json",
+			expectedEqual: false,
+		},
+		"trailing data": {
+			actual:        expected + "{}",
+			expectedEqual: false,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			equal, paths := credSpecContentsEqual(testCase.actual, expected)
+			assert.Equal(t, testCase.expectedEqual, equal)
+			assert.Equal(t, testCase.expectedPaths, paths)
+		})
+	}
+}
+
+func TestFormatJSONDiffPaths(t *testing.T) {
+	assert.Equal(t, "$.a, $.b", formatJSONDiffPaths([]string{"$.b", "$.a"}))
+
+	var paths []string
+	for i := 0; i < maxReportedJSONDiffPaths+3; i++ {
+		paths = append(paths, "$.a")
+	}
+	assert.Contains(t, formatJSONDiffPaths(paths), "(and 3 more)")
+}
@@ -0,0 +1,35 @@
+## RBAC rules needed by the GMSA cred spec usage controller, only deployed when it's enabled: they
+## let the webhook watch all the pods in the cluster
+
+---
+
+# create an RBAC role to allow tracking which pods use which cred specs, and reporting it in
+# cred specs' status
+kind: ClusterRole
+apiVersion: rbac.authorization.k8s.io/v1
+metadata:
+  name: gmsa-cred-spec-usage-tracker
+rules:
+- apiGroups: [""]
+  resources: ["pods"]
+  verbs: ["list", "watch"]
+- apiGroups: ["windows.k8s.io"]
+  resources: ["gmsacredentialspecs/status"]
+  verbs: ["update"]
+
+---
+
+# and bind it to the webhook's service account
+kind: ClusterRoleBinding
+apiVersion: rbac.authorization.k8s.io/v1
+metadata:
+  name: allow-gmsa-webhook-to-track-cred-spec-usage
+  namespace: ${NAMESPACE}
+subjects:
+- kind: ServiceAccount
+  name: ${DEPLOYMENT_NAME}
+  namespace: ${NAMESPACE}
+roleRef:
+  kind: ClusterRole
+  name: gmsa-cred-spec-usage-tracker
+  apiGroup: rbac.authorization.k8s.io
@@ -0,0 +1,38 @@
+## RBAC rules needed by the GMSA cred spec drift controller, only deployed when it's enabled: they
+## let the webhook update any deployment or stateful set
+
+---
+
+# create an RBAC role to allow reporting pods running with outdated contents of cred specs in
+# their status, and restarting their workloads when cred specs opt in to it
+kind: ClusterRole
+apiVersion: rbac.authorization.k8s.io/v1
+metadata:
+  name: gmsa-cred-spec-drift-detector
+rules:
+- apiGroups: [""]
+  resources: ["pods"]
+  verbs: ["list", "watch"]
+- apiGroups: ["windows.k8s.io"]
+  resources: ["gmsacredentialspecs/status"]
+  verbs: ["update"]
+- apiGroups: ["apps"]
+  resources: ["deployments", "statefulsets"]
+  verbs: ["get", "update"]
+
+---
+
+# and bind it to the webhook's service account
+kind: ClusterRoleBinding
+apiVersion: rbac.authorization.k8s.io/v1
+metadata:
+  name: allow-gmsa-webhook-to-detect-cred-spec-drift
+  namespace: ${NAMESPACE}
+subjects:
+- kind: ServiceAccount
+  name: ${DEPLOYMENT_NAME}
+  namespace: ${NAMESPACE}
+roleRef:
+  kind: ClusterRole
+  name: gmsa-cred-spec-drift-detector
+  apiGroup: rbac.authorization.k8s.io
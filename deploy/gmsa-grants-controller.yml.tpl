@@ -0,0 +1,41 @@
+## RBAC rules needed by the GMSA grants controller, only deployed when it's enabled: they let the
+## webhook grant any service account access to any cred spec
+
+---
+
+# create an RBAC role to allow reconciling the roles and role bindings of GMSA grants; creating
+# roles granting `use` access to cred specs requires having that access, hence the last rule
+kind: ClusterRole
+apiVersion: rbac.authorization.k8s.io/v1
+metadata:
+  name: gmsa-grants-reconciler
+rules:
+- apiGroups: ["windows.k8s.io"]
+  resources: ["gmsagrants"]
+  verbs: ["get", "list", "watch"]
+- apiGroups: ["windows.k8s.io"]
+  resources: ["gmsagrants/status"]
+  verbs: ["update"]
+- apiGroups: ["rbac.authorization.k8s.io"]
+  resources: ["roles", "rolebindings"]
+  verbs: ["get", "create", "update", "delete"]
+- apiGroups: ["windows.k8s.io"]
+  resources: ["gmsacredentialspecs"]
+  verbs: ["use"]
+
+---
+
+# and bind it to the webhook's service account
+kind: ClusterRoleBinding
+apiVersion: rbac.authorization.k8s.io/v1
+metadata:
+  name: allow-gmsa-webhook-to-reconcile-grants
+  namespace: ${NAMESPACE}
+subjects:
+- kind: ServiceAccount
+  name: ${DEPLOYMENT_NAME}
+  namespace: ${NAMESPACE}
+roleRef:
+  kind: ClusterRole
+  name: gmsa-grants-reconciler
+  apiGroup: rbac.authorization.k8s.io
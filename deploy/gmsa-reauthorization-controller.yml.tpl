@@ -0,0 +1,35 @@
+## RBAC rules needed by the GMSA reauthorization controller, only deployed when it's enabled: they
+## let the webhook evict any pod
+
+---
+
+# create an RBAC role to allow periodically re-checking that running pods are still authorized to
+# use their cred specs, and evicting them if they aren't
+kind: ClusterRole
+apiVersion: rbac.authorization.k8s.io/v1
+metadata:
+  name: gmsa-pod-reauthorizer
+rules:
+- apiGroups: [""]
+  resources: ["pods"]
+  verbs: ["list", "watch"]
+- apiGroups: [""]
+  resources: ["pods/eviction"]
+  verbs: ["create"]
+
+---
+
+# and bind it to the webhook's service account
+kind: ClusterRoleBinding
+apiVersion: rbac.authorization.k8s.io/v1
+metadata:
+  name: allow-gmsa-webhook-to-reauthorize-pods
+  namespace: ${NAMESPACE}
+subjects:
+- kind: ServiceAccount
+  name: ${DEPLOYMENT_NAME}
+  namespace: ${NAMESPACE}
+roleRef:
+  kind: ClusterRole
+  name: gmsa-pod-reauthorizer
+  apiGroup: rbac.authorization.k8s.io
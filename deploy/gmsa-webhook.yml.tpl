@@ -31,7 +31,8 @@ metadata:
 
 ---
 
-# create an RBAC role to allow reading GMSA cred specs
+# create an RBAC role to allow reading GMSA cred specs; they're watched so that GMSA policies can
+# select them by label without querying the API server on every admission request
 kind: ClusterRole
 apiVersion: rbac.authorization.k8s.io/v1
 metadata:
@@ -39,7 +40,7 @@ metadata:
 rules:
 - apiGroups: ["windows.k8s.io"]
   resources: ["gmsacredentialspecs"]
-  verbs: ["get"]
+  verbs: ["get", "list", "watch"]
 
 ---
 
@@ -60,6 +61,127 @@ roleRef:
 
 ---
 
+# create an RBAC role to allow reading namespaces and GMSA policies, to look up default cred specs
+kind: ClusterRole
+apiVersion: rbac.authorization.k8s.io/v1
+metadata:
+  name: gmsa-policy-reader
+rules:
+- apiGroups: [""]
+  resources: ["namespaces"]
+  verbs: ["get", "list", "watch"]
+- apiGroups: ["windows.k8s.io"]
+  resources: ["gmsapolicies"]
+  verbs: ["list", "watch"]
+
+---
+
+# and bind it to the webhook's service account
+kind: ClusterRoleBinding
+apiVersion: rbac.authorization.k8s.io/v1
+metadata:
+  name: allow-gmsa-webhook-to-read-policies
+  namespace: ${NAMESPACE}
+subjects:
+- kind: ServiceAccount
+  name: ${DEPLOYMENT_NAME}
+  namespace: ${NAMESPACE}
+roleRef:
+  kind: ClusterRole
+  name: gmsa-policy-reader
+  apiGroup: rbac.authorization.k8s.io
+
+---
+
+# create an RBAC role to allow watching service accounts, to look up the cred specs bound to them
+kind: ClusterRole
+apiVersion: rbac.authorization.k8s.io/v1
+metadata:
+  name: gmsa-service-account-reader
+rules:
+- apiGroups: [""]
+  resources: ["serviceaccounts"]
+  verbs: ["get", "list", "watch"]
+
+---
+
+# and bind it to the webhook's service account
+kind: ClusterRoleBinding
+apiVersion: rbac.authorization.k8s.io/v1
+metadata:
+  name: allow-gmsa-webhook-to-read-service-accounts
+  namespace: ${NAMESPACE}
+subjects:
+- kind: ServiceAccount
+  name: ${DEPLOYMENT_NAME}
+  namespace: ${NAMESPACE}
+roleRef:
+  kind: ClusterRole
+  name: gmsa-service-account-reader
+  apiGroup: rbac.authorization.k8s.io
+
+---
+
+# create an RBAC role to allow replicas to elect which one runs the controllers, using a config
+# map as a lock
+kind: Role
+apiVersion: rbac.authorization.k8s.io/v1
+metadata:
+  name: ${DEPLOYMENT_NAME}-leader-election
+  namespace: ${NAMESPACE}
+rules:
+- apiGroups: [""]
+  resources: ["configmaps"]
+  verbs: ["get", "create", "update"]
+
+---
+
+# and bind it to the webhook's service account
+kind: RoleBinding
+apiVersion: rbac.authorization.k8s.io/v1
+metadata:
+  name: ${DEPLOYMENT_NAME}-leader-election
+  namespace: ${NAMESPACE}
+subjects:
+- kind: ServiceAccount
+  name: ${DEPLOYMENT_NAME}
+  namespace: ${NAMESPACE}
+roleRef:
+  kind: Role
+  name: ${DEPLOYMENT_NAME}-leader-election
+  apiGroup: rbac.authorization.k8s.io
+
+---
+
+# create an RBAC role to allow emitting events on denials
+kind: ClusterRole
+apiVersion: rbac.authorization.k8s.io/v1
+metadata:
+  name: gmsa-webhook-event-recorder
+rules:
+- apiGroups: [""]
+  resources: ["events"]
+  verbs: ["create", "patch"]
+
+---
+
+# and bind it to the webhook's service account
+kind: ClusterRoleBinding
+apiVersion: rbac.authorization.k8s.io/v1
+metadata:
+  name: allow-gmsa-webhook-to-record-events
+  namespace: ${NAMESPACE}
+subjects:
+- kind: ServiceAccount
+  name: ${DEPLOYMENT_NAME}
+  namespace: ${NAMESPACE}
+roleRef:
+  kind: ClusterRole
+  name: gmsa-webhook-event-recorder
+  apiGroup: rbac.authorization.k8s.io
+
+---
+
 ## create an RBAC role to allow creating access reviews (ie checking authz)
 kind: ClusterRole
 apiVersion: rbac.authorization.k8s.io/v1
@@ -103,25 +225,132 @@ spec:
     metadata:
       labels:
         app: ${DEPLOYMENT_NAME}
+      annotations:
+        prometheus.io/scrape: "true"
+        prometheus.io/port: "8080"
+        ${POD_SECCOMP_ANNOTATION}
     spec:
       serviceAccountName: ${DEPLOYMENT_NAME}
+      securityContext:
+        runAsNonRoot: true
+        ${POD_SECCOMP_PROFILE}
       nodeSelector:
         beta.kubernetes.io/os: linux
       containers:
       - name: ${DEPLOYMENT_NAME}
         image: ${IMAGE_NAME}
         imagePullPolicy: IfNotPresent
+        securityContext:
+          allowPrivilegeEscalation: false
+          capabilities:
+            drop:
+            - ALL
         ports:
-        - containerPort: 443
+        - containerPort: 8443
+          name: https
+        - containerPort: 8080
+          name: ops
+        livenessProbe:
+          httpGet:
+            path: /healthz
+            port: ops
+        readinessProbe:
+          httpGet:
+            path: /readyz
+            port: ops
         volumeMounts:
           - name: tls
             mountPath: "/tls"
             readOnly: true
+          - name: signing-keys
+            mountPath: "/signing-keys"
+            readOnly: true
         env:
+          - name: HTTPS_PORT
+            value: "8443"
           - name: TLS_KEY
             value: /tls/key
           - name: TLS_CRT
             value: /tls/crt
+          # directory containing the keys used to sign injected cred spec contents; empty disables
+          # signing
+          - name: SIGNING_KEYS_DIR
+            value: /signing-keys
+          # comma-separated list of cipher suites to enable, e.g.
+          # "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384";
+          # defaults to ECDHE suites with AEAD ciphers; TLS 1.2 is always the minimum
+          - name: TLS_CIPHER_SUITES
+            value: ""
+          # set to the path of a CA bundle to only accept clients presenting a certificate signed
+          # by that CA; the API server then needs to be configured to authenticate to the webhook,
+          # see https://kubernetes.io/docs/reference/access-authn-authz/extensible-admission-controllers/#authenticate-apiservers
+          - name: TLS_CLIENT_CA
+            value: ""
+          # plain HTTP port serving /healthz, /readyz and /metrics; 0 disables it
+          - name: OPS_PORT
+            value: "8080"
+          # whether to also serve profiling data under /debug/pprof/ on the ops port
+          - name: PPROF
+            value: "false"
+          # one of "text" or "json"
+          - name: LOG_FORMAT
+            value: json
+          # set to an OTLP/HTTP endpoint, e.g. http://otel-collector.observability:4318,
+          # to export traces
+          - name: OTEL_EXPORTER_OTLP_ENDPOINT
+            value: ""
+          # one of "enforce", "warn" or "audit"; can be overridden per namespace
+          # with the windows.k8s.io/gmsa-enforcement-mode label
+          - name: ENFORCEMENT_MODE
+            value: enforce
+          # one of "none", "mutate" or "validate"; can be overridden per namespace
+          # with the windows.k8s.io/gmsa-windows-scheduling annotation
+          - name: WINDOWS_SCHEDULING_MODE
+            value: none
+          # whether to emit warning events on the workloads owning denied pods
+          - name: DENIAL_EVENTS
+            value: "true"
+          # warn when a cred spec gets used by that many namespaces; 0 disables these warnings
+          - name: SHARED_CRED_SPEC_WARNING_THRESHOLD
+            value: "10"
+          # whether to reconcile the roles and role bindings of GMSAGrant objects, disabled by
+          # default; the webhook only lets users grant access to the cred specs they can use
+          # themselves. The RBAC rules the controller needs are in gmsa-grants-controller.yml.tpl,
+          # and only get deployed when it's enabled
+          - name: GRANTS_CONTROLLER
+            value: "${GRANTS_CONTROLLER}"
+          # whether to report which pods use each cred spec in its status; this and the next
+          # controllers are disabled by default, since they watch all the pods in the cluster.
+          # The RBAC rules the controller needs are in gmsa-cred-spec-usage-controller.yml.tpl, and
+          # only get deployed when it's enabled
+          - name: CRED_SPEC_USAGE_CONTROLLER
+            value: "${CRED_SPEC_USAGE_CONTROLLER}"
+          # whether to periodically re-check that running pods are still authorized to use their
+          # cred specs, and how often; unauthorized pods get reported through events and metrics.
+          # The RBAC rules the controller needs are in gmsa-reauthorization-controller.yml.tpl, and
+          # only get deployed when it's enabled
+          - name: REAUTHORIZATION_CONTROLLER
+            value: "${REAUTHORIZATION_CONTROLLER}"
+          - name: REAUTHORIZATION_INTERVAL
+            value: 10m
+          # if non-zero, unauthorized pods get evicted once they've been for that long
+          - name: REAUTHORIZATION_EVICTION_GRACE_PERIOD
+            value: "0"
+          # whether to report pods running with outdated contents of their cred specs; cred specs
+          # annotated with windows.k8s.io/gmsa-restart-stale-workloads: "true" also get the
+          # deployments and stateful sets of such pods restarted. The RBAC rules the controller
+          # needs are in gmsa-drift-controller.yml.tpl, and only get deployed when it's enabled
+          - name: DRIFT_CONTROLLER
+            value: "${DRIFT_CONTROLLER}"
+          # controllers only run on the replica holding this lock
+          - name: LEADER_ELECTION
+            value: "true"
+          - name: LEADER_ELECTION_NAMESPACE
+            valueFrom:
+              fieldRef:
+                fieldPath: metadata.namespace
+          - name: LEADER_ELECTION_LOCK_NAME
+            value: ${DEPLOYMENT_NAME}-controllers
       volumes:
       - name: tls
         secret:
@@ -131,6 +360,12 @@ spec:
             path: key
           - key: tls_certificate
             path: crt
+      # the keys used to sign the cred spec contents injected into pods; that secret is not part
+      # of this manifest, so that re-applying it doesn't replace the keys, see the Makefile's
+      # add_signing_key target
+      - name: signing-keys
+        secret:
+          secretName: ${DEPLOYMENT_NAME}-signing-keys
 
 ---
 
@@ -142,7 +377,7 @@ metadata:
 spec:
   ports:
   - port: 443
-    targetPort: 443
+    targetPort: https
   selector:
     app: ${DEPLOYMENT_NAME}
 
@@ -160,6 +395,23 @@ spec:
     kind: GMSACredentialSpec
     plural: gmsacredentialspecs
   scope: Cluster
+  # the webhook reports which pods use each cred spec, and which of these run with outdated
+  # contents of it, in its status
+  subresources:
+    status: {}
+  additionalPrinterColumns:
+  - name: Pods
+    type: integer
+    JSONPath: .status.usage.podCount
+  - name: Namespaces
+    type: integer
+    JSONPath: .status.usage.namespaceCount
+  - name: Stale
+    type: integer
+    JSONPath: .status.stale.podCount
+  - name: Age
+    type: date
+    JSONPath: .metadata.creationTimestamp
   validation:
     openAPIV3Schema:
       properties:
@@ -169,6 +421,98 @@ spec:
 
 ---
 
+# declare the GMSA policy CRD, that lets cluster admins configure GMSA usage per namespace
+apiVersion: apiextensions.k8s.io/v1beta1
+kind: CustomResourceDefinition
+metadata:
+  name: gmsapolicies.windows.k8s.io
+spec:
+  group: windows.k8s.io
+  version: v1alpha1
+  names:
+    kind: GMSAPolicy
+    plural: gmsapolicies
+  scope: Namespaced
+  validation:
+    openAPIV3Schema:
+      properties:
+        spec:
+          properties:
+            podSelector:
+              description: Restricts which pods in the namespace the policy applies to; applies to all pods if absent
+              type: object
+            defaultCredSpecName:
+              description: Name of the GMSA cred spec to inject into Windows pods that don't request one
+              type: string
+            allowedCredSpecs:
+              description: If set, pods can only use the GMSA cred specs listed here or matching allowedCredSpecSelector
+              type: array
+              items:
+                type: string
+            allowedCredSpecSelector:
+              description: If set, pods can only use the GMSA cred specs matching this label selector or listed in allowedCredSpecs
+              type: object
+            deniedCredSpecs:
+              description: Pods cannot use the GMSA cred specs listed here
+              type: array
+              items:
+                type: string
+            deniedCredSpecSelector:
+              description: Pods cannot use the GMSA cred specs matching this label selector
+              type: object
+            requiredNodeSelector:
+              description: Node selector terms that pods using GMSAs must set
+              type: object
+            maxIdentitiesPerPod:
+              description: Maximum number of distinct GMSA cred specs a single pod can use
+              type: integer
+              minimum: 0
+
+---
+
+# declare the GMSA grant CRD, that grants service accounts access to cred specs; the webhook
+# reconciles a role and a role binding for each grant
+apiVersion: apiextensions.k8s.io/v1beta1
+kind: CustomResourceDefinition
+metadata:
+  name: gmsagrants.windows.k8s.io
+spec:
+  group: windows.k8s.io
+  version: v1alpha1
+  names:
+    kind: GMSAGrant
+    plural: gmsagrants
+  scope: Namespaced
+  subresources:
+    status: {}
+  validation:
+    openAPIV3Schema:
+      properties:
+        spec:
+          properties:
+            credSpecNames:
+              description: Names of the GMSA cred specs to grant `use` access to
+              type: array
+              items:
+                type: string
+            serviceAccountNames:
+              description: Names of the service accounts from the grant's namespace to grant access to
+              type: array
+              items:
+                type: string
+  additionalPrinterColumns:
+  - name: Ready
+    type: boolean
+    JSONPath: .status.ready
+  - name: Message
+    type: string
+    JSONPath: .status.message
+  - name: Age
+    type: date
+    JSONPath: .metadata.creationTimestamp
+
+---
+
 apiVersion: admissionregistration.k8s.io/v1beta1
 kind: ValidatingWebhookConfiguration
 metadata:
@@ -186,7 +530,26 @@ webhooks:
     apiGroups: [""]
     apiVersions: ["*"]
     resources: ["pods"]
+  # workloads' pod templates get the same checks as pods, so that invalid ones get reported
+  # when applying the workload rather than when its controller fails to create pods
+  - operations: ["CREATE", "UPDATE"]
+    apiGroups: ["apps", "extensions"]
+    apiVersions: ["*"]
+    resources: ["deployments", "statefulsets", "daemonsets"]
+  - operations: ["CREATE", "UPDATE"]
+    apiGroups: ["batch"]
+    apiVersions: ["*"]
+    resources: ["jobs", "cronjobs"]
+  # users can only grant access to the cred specs they have `use` access to themselves, since
+  # the grants controller can grant access to any cred spec; it ignores grants in the namespaces
+  # excluded below, since they don't get validated
+  - operations: ["CREATE", "UPDATE"]
+    apiGroups: ["windows.k8s.io"]
+    apiVersions: ["*"]
+    resources: ["gmsagrants"]
   failurePolicy: Fail
+  # the webhook's only side effects are the optional denial events, which it skips on dry runs
+  ${WEBHOOK_SIDE_EFFECTS}
   # don't run on ${NAMESPACE}
   namespaceSelector:
     matchExpressions:
@@ -214,6 +577,11 @@ webhooks:
     apiVersions: ["*"]
     resources: ["pods"]
   failurePolicy: Fail
+  # the webhook's only side effects are the optional denial events, which it skips on dry runs
+  ${WEBHOOK_SIDE_EFFECTS}
+  # mutating pods is idempotent, so we can safely be re-invoked e.g. after sidecar injectors
+  # have added containers with GMSA annotations
+  ${WEBHOOK_REINVOCATION_POLICY}
   # don't run on ${NAMESPACE}
   namespaceSelector:
     matchExpressions:
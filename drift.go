@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+const (
+	driftControllerName    = "gmsa-cred-spec-drift"
+	driftControllerWorkers = 2
+
+	// credSpecStalePodsStatusField is the field of cred specs' status that the drift controller
+	// maintains, in the same format as credSpecUsageStatusField.
+	credSpecStalePodsStatusField = "stale"
+
+	// restartStaleWorkloadsAnnotationKey is the cred spec annotation that, when set to "true",
+	// opts the cred spec in to having the deployments and stateful sets whose pods run with
+	// outdated contents of it restarted.
+	restartStaleWorkloadsAnnotationKey = "windows.k8s.io/gmsa-restart-stale-workloads"
+
+	// restartedAtAnnotationKey is the pod template annotation that `kubectl rollout restart`
+	// sets; we set it the same way, so that our restarts look just like manual ones.
+	restartedAtAnnotationKey = "kubectl.kubernetes.io/restartedAt"
+
+	// credSpecRevisionsAnnotationKey is the pod template annotation recording, for each cred spec
+	// a workload has been restarted for, the revision of that cred spec's contents it's been
+	// restarted for, so that each workload only gets restarted once per change; its value is
+	// a comma-separated list of `<cred spec name>=<revision>` pairs.
+	credSpecRevisionsAnnotationKey = "windows.k8s.io/gmsa-cred-spec-revisions"
+
+	// workloadRestartedEventReason is the reason of the events emitted about restarted workloads
+	workloadRestartedEventReason = "GMSACredSpecChanged"
+)
+
+// driftController detects pods running with outdated contents of the cred specs they use, as
+// happens when cred specs get edited after pods got admitted, since contents only get inlined
+// on admission. Such pods get reported in their cred specs' status and through metrics; and
+// for cred specs opted in with the restartStaleWorkloadsAnnotationKey annotation, the
+// deployments and stateful sets they belong to get a rollout restart.
+type driftController struct {
+	*controller
+	client driftClientInterface
+}
+
+func newDriftController(client driftClientInterface) (*driftController, error) {
+	driftController := &driftController{client: client}
+	driftController.controller = newController(driftControllerName, driftControllerWorkers, driftController.reconcile)
+
+	client.watchGMSACredSpecs(driftController.eventHandler())
+
+	if err := client.watchGMSAPods(driftController.podCredSpecsEventHandler(func(oldPod, newPod *corev1.Pod) bool {
+		return isPodActive(oldPod) != isPodActive(newPod) || !reflect.DeepEqual(oldPod.Annotations, newPod.Annotations)
+	})); err != nil {
+		return nil, err
+	}
+
+	return driftController, nil
+}
+
+// reconcile updates the stale pods of the cred spec with the given name, and restarts their
+// workloads if the cred spec opts in to it.
+func (dc *driftController) reconcile(credSpecName string) error {
+	contents, annotations, exists, err := dc.client.retrieveCachedCredSpecContents(credSpecName)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		stalePodsGauge.DeleteLabelValues(credSpecName)
+		return nil
+	}
+	if contents == "" {
+		// nothing to compare to, and such cred specs can't be used anyway
+		return nil
+	}
+
+	pods, err := dc.client.listPodsUsingCredSpec(credSpecName)
+	if err != nil {
+		return err
+	}
+
+	var stalePods []*corev1.Pod
+	for _, pod := range pods {
+		if isPodActive(pod) && hasStaleCredSpecContents(pod, credSpecName, contents) {
+			stalePods = append(stalePods, pod)
+		}
+	}
+	stalePodsGauge.WithLabelValues(credSpecName).Set(float64(len(stalePods)))
+
+	var errs []error
+	if restartStaleWorkloads(credSpecName, annotations) {
+		errs = dc.restartWorkloads(credSpecName, credSpecContentsRevision(contents), stalePods)
+	}
+
+	currentStale, exists, err := dc.client.retrieveCredSpecStalePods(credSpecName)
+	if err == nil && exists {
+		if stale := computeCredSpecUsage(stalePods); !reflect.DeepEqual(stale, currentStale) {
+			if stale.PodCount != 0 {
+				logrus.Infof("%d pods in %d namespaces run with outdated contents of cred spec %s", stale.PodCount, stale.NamespaceCount, credSpecName)
+			}
+			err = dc.client.updateCredSpecStalePods(credSpecName, stale)
+		}
+	}
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
+
+// restartWorkloads restarts the deployments and stateful sets the given pods belong to, if they
+// haven't already been for that revision of the cred spec.
+func (dc *driftController) restartWorkloads(credSpecName, revision string, stalePods []*corev1.Pod) []error {
+	restarted := make(map[corev1.ObjectReference]bool)
+	var errs []error
+	for _, pod := range stalePods {
+		kind, name := podWorkload(pod)
+		if kind != "Deployment" && kind != "StatefulSet" {
+			continue
+		}
+		workload := corev1.ObjectReference{
+			APIVersion: "apps/v1",
+			Kind:       kind,
+			Name:       name,
+			Namespace:  pod.Namespace,
+		}
+		if restarted[workload] {
+			continue
+		}
+		restarted[workload] = true
+
+		didRestart, err := dc.client.restartWorkload(pod.Namespace, kind, name, credSpecName, revision)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if didRestart {
+			logrus.Infof("restarted %s %s/%s, whose pods run with outdated contents of cred spec %s", kind, pod.Namespace, name, credSpecName)
+			restartedWorkloadsCounter.WithLabelValues(kind).Inc()
+			dc.client.recordEvent(&workload, corev1.EventTypeNormal, workloadRestartedEventReason,
+				fmt.Sprintf("restarted since its pods run with outdated contents of the %s gMSA cred spec", credSpecName))
+		}
+	}
+	return errs
+}
+
+// hasStaleCredSpecContents returns true iff the pod carries contents of the given cred spec that
+// differ from the given ones. Pods that use the cred spec without carrying its contents, e.g.
+// pods admitted while the webhook wasn't running, have no contents to be outdated.
+func hasStaleCredSpecContents(pod *corev1.Pod, credSpecName, contents string) bool {
+	stale := false
+	iterateOverGMSAAnnotationPairs(pod, func(nameKey, contentsKey string) {
+		if pod.Annotations[nameKey] != credSpecName {
+			return
+		}
+		if podContents, present := pod.Annotations[contentsKey]; present {
+			if equal, _ := credSpecContentsEqual(podContents, contents); !equal {
+				stale = true
+			}
+		}
+	})
+	return stale
+}
+
+// restartStaleWorkloads returns true iff the cred spec opts in to having stale workloads
+// restarted.
+func restartStaleWorkloads(credSpecName string, annotations map[string]string) bool {
+	value, present := annotations[restartStaleWorkloadsAnnotationKey]
+	if !present {
+		return false
+	}
+	restart, err := strconv.ParseBool(value)
+	if err != nil {
+		logrus.Warnf("invalid %s annotation on cred spec %s: %v", restartStaleWorkloadsAnnotationKey, credSpecName, err)
+		return false
+	}
+	return restart
+}
+
+// credSpecContentsRevision returns a short hash of cred spec contents, that only changes when
+// they change semantically.
+func credSpecContentsRevision(contents string) string {
+	hash := sha256.Sum256([]byte(canonicalJSON(contents)))
+	return hex.EncodeToString(hash[:8])
+}
+
+// markTemplateRestarted updates a workload's pod template so that it gets a rollout restart,
+// and records that it got restarted for that revision of the cred spec; it returns false, and
+// leaves the template untouched, if it's already been restarted for it.
+func markTemplateRestarted(template *corev1.PodTemplateSpec, credSpecName, revision string, now time.Time) bool {
+	revisions := make(map[string]string)
+	for _, pair := range strings.Split(template.Annotations[credSpecRevisionsAnnotationKey], ",") {
+		if parts := strings.SplitN(pair, "=", 2); len(parts) == 2 {
+			revisions[parts[0]] = parts[1]
+		}
+	}
+	if revisions[credSpecName] == revision {
+		return false
+	}
+	revisions[credSpecName] = revision
+
+	pairs := make([]string, 0, len(revisions))
+	for name, rev := range revisions {
+		pairs = append(pairs, name+"="+rev)
+	}
+	sort.Strings(pairs)
+
+	if template.Annotations == nil {
+		template.Annotations = make(map[string]string)
+	}
+	template.Annotations[credSpecRevisionsAnnotationKey] = strings.Join(pairs, ",")
+	template.Annotations[restartedAtAnnotationKey] = now.Format(time.RFC3339)
+	return true
+}
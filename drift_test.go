@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestHasStaleCredSpecContents(t *testing.T) {
+	pod := newPodUsingCredSpec("ns", "pod", "cred-spec", `{"a": 1, "b": 2}`, nil)
+	pod.Spec.Containers = []corev1.Container{{Name: "container"}}
+
+	assert.False(t, hasStaleCredSpecContents(pod, "cred-spec", `{"b":2,"a":1}`))
+	assert.True(t, hasStaleCredSpecContents(pod, "cred-spec", `{"a":1,"b":3}`))
+
+	t.Run("containers' contents are checked too", func(t *testing.T) {
+		pod.Annotations["container"+gMSAContainerSpecNameAnnotationKeySuffix] = "other-cred-spec"
+		pod.Annotations["container"+gMSAContainerSpecContentsAnnotationKeySuffix] = `{"c":3}`
+
+		assert.False(t, hasStaleCredSpecContents(pod, "other-cred-spec", `{"c":3}`))
+		assert.True(t, hasStaleCredSpecContents(pod, "other-cred-spec", `{"c":4}`))
+	})
+
+	t.Run("pods without contents are not stale", func(t *testing.T) {
+		assert.False(t, hasStaleCredSpecContents(newPodUsingCredSpec("ns", "pod", "cred-spec", "", nil), "cred-spec", `{"a":1}`))
+	})
+}
+
+func TestCredSpecContentsRevision(t *testing.T) {
+	revision := credSpecContentsRevision(`{"a":1,"b":[2.5]}`)
+	assert.Equal(t, revision, credSpecContentsRevision(`{"b": [2.50], "a": 1.0}`))
+	assert.NotEqual(t, revision, credSpecContentsRevision(`{"a":1,"b":[2.6]}`))
+}
+
+func TestMarkTemplateRestarted(t *testing.T) {
+	template := &corev1.PodTemplateSpec{}
+	now := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	require.True(t, markTemplateRestarted(template, "cred-spec-1", "rev-1", now))
+	assert.Equal(t, "cred-spec-1=rev-1", template.Annotations[credSpecRevisionsAnnotationKey])
+	assert.Equal(t, "2019-06-01T12:00:00Z", template.Annotations[restartedAtAnnotationKey])
+
+	// already restarted for that revision
+	assert.False(t, markTemplateRestarted(template, "cred-spec-1", "rev-1", now.Add(time.Hour)))
+	assert.Equal(t, "2019-06-01T12:00:00Z", template.Annotations[restartedAtAnnotationKey])
+
+	// other cred specs' revisions are kept
+	require.True(t, markTemplateRestarted(template, "cred-spec-0", "rev-0", now.Add(time.Hour)))
+	require.True(t, markTemplateRestarted(template, "cred-spec-1", "rev-2", now.Add(time.Hour)))
+	assert.Equal(t, "cred-spec-0=rev-0,cred-spec-1=rev-2", template.Annotations[credSpecRevisionsAnnotationKey])
+	assert.Equal(t, "2019-06-01T13:00:00Z", template.Annotations[restartedAtAnnotationKey])
+}
+
+func TestDriftControllerReportsStalePods(t *testing.T) {
+	client := newFakeControllerClient(
+		newPodUsingCredSpec("ns", "pod-0", "cred-spec", `{"a":1}`, nil),
+		newPodUsingCredSpec("ns", "pod-1", "cred-spec", `{"a":1}`, &metav1.OwnerReference{Kind: "StatefulSet", Name: "db"}),
+	)
+	client.credSpecs["cred-spec"] = &fakeCredSpec{contents: `{"a":1}`}
+
+	driftController, err := newDriftController(client)
+	require.Nil(t, err)
+
+	require.Nil(t, driftController.reconcile("cred-spec"))
+	assert.Equal(t, 1, client.updates)
+	assert.Equal(t, &credSpecUsage{}, client.credSpecs["cred-spec"].stale)
+
+	// editing the cred spec
+	client.credSpecs["cred-spec"].contents = `{"a":2}`
+	require.Nil(t, driftController.reconcile("cred-spec"))
+	assert.Equal(t, 2, client.updates)
+	assert.Equal(t, 2, client.credSpecs["cred-spec"].stale.PodCount)
+	assert.Equal(t, []credSpecWorkloadUsage{
+		{Namespace: "ns", Kind: "Pod", Name: "pod-0", PodCount: 1},
+		{Namespace: "ns", Kind: "StatefulSet", Name: "db", PodCount: 1},
+	}, client.credSpecs["cred-spec"].stale.Workloads)
+
+	// only changes get written, and nothing gets restarted without opting in
+	require.Nil(t, driftController.reconcile("cred-spec"))
+	assert.Equal(t, 2, client.updates)
+	assert.Empty(t, client.events)
+
+	// pods admitted after the change are not stale
+	client.pods["ns/pod-0"] = newPodUsingCredSpec("ns", "pod-0", "cred-spec", `{"a": 2}`, nil)
+	require.Nil(t, driftController.reconcile("cred-spec"))
+	assert.Equal(t, 1, client.credSpecs["cred-spec"].stale.PodCount)
+
+	// cred specs that don't exist don't get a status
+	require.Nil(t, driftController.reconcile("unknown"))
+	_, present := client.credSpecs["unknown"]
+	assert.False(t, present)
+}
+
+func TestDriftControllerRestartsStaleWorkloads(t *testing.T) {
+	deploymentTemplate := &corev1.PodTemplateSpec{}
+	client := newFakeControllerClient(
+		newPodUsingCredSpec("ns", "web-5d8f9c6b7-abcde", "cred-spec", `{"a":1}`, &metav1.OwnerReference{Kind: "ReplicaSet", Name: "web-5d8f9c6b7"}),
+		newPodUsingCredSpec("ns", "web-5d8f9c6b7-fghij", "cred-spec", `{"a":1}`, &metav1.OwnerReference{Kind: "ReplicaSet", Name: "web-5d8f9c6b7"}),
+		newPodUsingCredSpec("ns", "bare", "cred-spec", `{"a":1}`, nil),
+	)
+	client.credSpecs["cred-spec"] = &fakeCredSpec{
+		contents:    `{"a":2}`,
+		annotations: map[string]string{restartStaleWorkloadsAnnotationKey: "true"},
+	}
+	client.templates["ns/Deployment/web"] = deploymentTemplate
+
+	driftController, err := newDriftController(client)
+	require.Nil(t, err)
+
+	require.Nil(t, driftController.reconcile("cred-spec"))
+	assert.Equal(t, "cred-spec="+credSpecContentsRevision(`{"a":2}`), deploymentTemplate.Annotations[credSpecRevisionsAnnotationKey])
+	if assert.Equal(t, 1, len(client.events)) {
+		assert.Equal(t, "Normal GMSACredSpecChanged Deployment ns/web: restarted since its pods run with outdated contents of the cred-spec gMSA cred spec", client.events[0])
+	}
+
+	// the deployment only gets restarted once per change
+	require.Nil(t, driftController.reconcile("cred-spec"))
+	assert.Equal(t, 1, len(client.events))
+
+	client.credSpecs["cred-spec"].contents = `{"a":3}`
+	require.Nil(t, driftController.reconcile("cred-spec"))
+	assert.Equal(t, 2, len(client.events))
+
+	t.Run("the status still gets updated when restarts fail", func(t *testing.T) {
+		client.credSpecs["cred-spec"].contents = `{"a":4}`
+		client.credSpecs["cred-spec"].stale = nil
+		client.restartErr = fmt.Errorf("conflict")
+
+		assert.NotNil(t, driftController.reconcile("cred-spec"))
+		assert.Equal(t, 3, client.credSpecs["cred-spec"].stale.PodCount)
+	})
+}
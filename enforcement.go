@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// enforcementMode controls what happens to pods that violate GMSA rules.
+type enforcementMode string
+
+const (
+	// enforcementModeEnforce means such pods get denied.
+	enforcementModeEnforce enforcementMode = "enforce"
+	// enforcementModeWarn means such pods get admitted, and clients get warned about the violations.
+	enforcementModeWarn enforcementMode = "warn"
+	// enforcementModeAudit means such pods get admitted, and violations only get recorded in
+	// metrics, logs and audit annotations.
+	enforcementModeAudit enforcementMode = "audit"
+
+	// namespaceEnforcementModeLabelKey is the namespace label that can be used to override the
+	// webhook's global enforcement mode for a given namespace.
+	namespaceEnforcementModeLabelKey = "windows.k8s.io/gmsa-enforcement-mode"
+)
+
+// parseEnforcementMode parses a string into an enforcementMode.
+func parseEnforcementMode(raw string) (enforcementMode, error) {
+	switch mode := enforcementMode(strings.ToLower(raw)); mode {
+	case enforcementModeEnforce, enforcementModeWarn, enforcementModeAudit:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown enforcement mode %q, valid modes are: %s, %s, %s", raw, enforcementModeEnforce, enforcementModeWarn, enforcementModeAudit)
+	}
+}
+
+// enforcementModeFor returns the enforcement mode that applies to the given namespace.
+func (webhook *webhook) enforcementModeFor(namespace string) (enforcementMode, *podAdmissionError) {
+	ns, code, err := webhook.client.retrieveNamespace(namespace)
+	if err != nil {
+		return "", &podAdmissionError{error: err, code: code}
+	}
+
+	if rawMode, present := ns.Labels[namespaceEnforcementModeLabelKey]; present {
+		mode, err := parseEnforcementMode(rawMode)
+		if err != nil {
+			return "", &podAdmissionError{error: fmt.Errorf("invalid %s label on namespace %s: %v", namespaceEnforcementModeLabelKey, namespace, err), code: http.StatusInternalServerError}
+		}
+		return mode, nil
+	}
+
+	return webhook.config.enforcementMode, nil
+}
+
+// enforce returns the given error if it should result in a denial, given the enforcement
+// mode for the request's namespace; otherwise it records it and returns nil.
+func (webhook *webhook) enforce(admissionCtx *admissionContext, operation webhookOperation, err *podAdmissionError) *podAdmissionError {
+	if err == nil {
+		return nil
+	}
+
+	mode, modeErr := webhook.enforcementModeFor(admissionCtx.namespace)
+	if modeErr != nil {
+		// can't tell, let's err on the safe side
+		admissionCtx.logger.Errorf("unable to determine enforcement mode, defaulting to %s: %v", enforcementModeEnforce, modeErr)
+		return err
+	}
+	if mode == enforcementModeEnforce {
+		return err
+	}
+
+	admissionCtx.logger.Infof("would have refused to admit pod, but enforcement mode is %s: %v", mode, err)
+
+	admissionCtx.enforcementMode = mode
+	admissionCtx.unenforcedViolations = append(admissionCtx.unenforcedViolations, err.Error())
+	// the same violations get found again when validating the mutated pod, so only warn
+	// and count them once
+	if operation != validate {
+		return nil
+	}
+	if mode == enforcementModeWarn {
+		admissionCtx.addWarning("this pod would have been denied: %v", err)
+	}
+	unenforcedDenialsCounter.WithLabelValues(string(mode)).Inc()
+
+	return nil
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	// these 2 constants are the coordinates of the GMSA grant Custom Resource Definition;
+	// it lives in the same API group and version as the cred specs' CRD
+	grantCRDResourceName = "gmsagrants"
+	grantCRDKind         = "GMSAGrant"
+
+	// grantLabelKey is the label set on the roles and role bindings managed for grants, with the
+	// name of the grant they're managed for as value.
+	grantLabelKey = "windows.k8s.io/gmsa-grant"
+	// grantRBACNamePrefix is prepended to grants' names to get the names of the roles and role
+	// bindings managed for them.
+	grantRBACNamePrefix = "gmsa-grant-"
+
+	// webhookDisabledLabelKey and webhookDisabledLabelValue label the namespaces that the
+	// webhook's configurations exclude, including its own; see the deployment manifest.
+	webhookDisabledLabelKey   = "gmsa-webhook"
+	webhookDisabledLabelValue = "disabled"
+
+	grantsControllerName    = "gmsa-grants"
+	grantsControllerWorkers = 2
+)
+
+// gmsaGrant is a namespaced object that grants service accounts from its namespace `use` access
+// to a list of cred specs. The grants controller reconciles a role and a role binding for each
+// grant, that are owned by the grant so that k8s garbage-collects them if the controller doesn't
+// get to it first.
+type gmsaGrant struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   gmsaGrantSpec   `json:"spec"`
+	Status gmsaGrantStatus `json:"status,omitempty"`
+}
+
+type gmsaGrantSpec struct {
+	// CredSpecNames are the names of the cred specs to grant access to.
+	CredSpecNames []string `json:"credSpecNames,omitempty"`
+
+	// ServiceAccountNames are the names of the service accounts, from the grant's namespace,
+	// to grant access to.
+	ServiceAccountNames []string `json:"serviceAccountNames,omitempty"`
+}
+
+type gmsaGrantStatus struct {
+	// ObservedGeneration is the generation of the spec that the status applies to.
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Ready is true iff the role and role binding are up to date with the spec.
+	Ready bool `json:"ready"`
+	// Message explains why the grant isn't ready, if it isn't.
+	Message string `json:"message,omitempty"`
+
+	// RoleName and RoleBindingName are the names of the role and role binding managed for the
+	// grant; they're empty if the grant is empty.
+	RoleName        string `json:"roleName,omitempty"`
+	RoleBindingName string `json:"roleBindingName,omitempty"`
+
+	// MissingCredSpecs and MissingServiceAccounts list the cred specs and service accounts that
+	// don't exist (yet); they still get granted access, so that it's effective as soon as
+	// they get created.
+	MissingCredSpecs       []string `json:"missingCredSpecs,omitempty"`
+	MissingServiceAccounts []string `json:"missingServiceAccounts,omitempty"`
+}
+
+// unmarshallGMSAGrant unmarshalls a grant object from its raw JSON representation.
+func unmarshallGMSAGrant(object runtime.RawExtension) (*gmsaGrant, *podAdmissionError) {
+	grant := &gmsaGrant{}
+	if err := json.Unmarshal(object.Raw, grant); err != nil {
+		return nil, &podAdmissionError{error: fmt.Errorf("unable to unmarshall %s JSON object: %v", grantCRDKind, err), code: http.StatusBadRequest}
+	}
+	return grant, nil
+}
+
+// validateGrantRequest ensures that users creating or updating grants have `use` access to all
+// the cred specs they grant access to: the grants controller can grant access to any cred spec,
+// so it would otherwise let anyone allowed to create grants in a namespace use any GMSA there.
+// Namespaces' enforcement modes don't apply here, since this is about RBAC rather than pods.
+func (webhook *webhook) validateGrantRequest(admissionCtx *admissionContext, request *admissionv1beta1.AdmissionRequest) (*admissionv1beta1.AdmissionResponse, *podAdmissionError) {
+	if request.Operation != admissionv1beta1.Create && request.Operation != admissionv1beta1.Update {
+		return &admissionv1beta1.AdmissionResponse{Allowed: true}, nil
+	}
+
+	grant, err := unmarshallGMSAGrant(request.Object)
+	if err != nil {
+		return nil, err
+	}
+	if request.Operation == admissionv1beta1.Update {
+		oldGrant, err := unmarshallGMSAGrant(request.OldObject)
+		if err != nil {
+			return nil, err
+		}
+		if reflect.DeepEqual(grant.Spec, oldGrant.Spec) {
+			return &admissionv1beta1.AdmissionResponse{Allowed: true}, nil
+		}
+	}
+
+	violations := newPodViolations(nil)
+	for i, credSpecName := range grant.Spec.CredSpecNames {
+		if authorized, reason := webhook.client.isUserAuthorizedToUseCredSpec(request.UserInfo, admissionCtx.namespace, credSpecName); !authorized {
+			msg := fmt.Sprintf("user %s does not have `use` access to the %s gMSA cred spec, and so cannot grant it", request.UserInfo.Username, credSpecName)
+			if reason != "" {
+				msg += fmt.Sprintf(", reason : %s", reason)
+			}
+			violations.add(&podAdmissionError{error: fmt.Errorf(msg), code: http.StatusForbidden, field: fmt.Sprintf("spec.credSpecNames[%d]", i)})
+		}
+	}
+	if err := violations.aggregate(); err != nil {
+		// denied responses describe pods by default
+		admissionResponse := deniedAdmissionResponse(err)
+		admissionResponse.Result.Details.Kind = grantCRDKind
+		admissionResponse.Result.Details.Name = grant.Name
+		return admissionResponse, nil
+	}
+
+	return &admissionv1beta1.AdmissionResponse{Allowed: true}, nil
+}
+
+// grantsController reconciles the roles and role bindings of GMSA grants.
+type grantsController struct {
+	*controller
+	client grantsClientInterface
+}
+
+func newGrantsController(client grantsClientInterface) *grantsController {
+	grantsController := &grantsController{client: client}
+	grantsController.controller = newController(grantsControllerName, grantsControllerWorkers, grantsController.reconcile)
+	client.watchGMSAGrants(grantsController.eventHandler())
+	return grantsController
+}
+
+// reconcile reconciles the grant with the given key, and updates its status accordingly.
+func (gc *grantsController) reconcile(key string) error {
+	namespace, name, err := splitKey(key)
+	if err != nil {
+		// no point in retrying
+		logrus.Error(err)
+		return nil
+	}
+
+	grant, err := gc.client.retrieveGMSAGrant(namespace, name)
+	if err != nil {
+		return err
+	}
+	if grant == nil {
+		// the grant has been deleted; k8s' garbage collector would eventually delete its role and
+		// role binding, but there's no reason to keep granting access until then
+		return gc.deleteRBAC(namespace, name)
+	}
+
+	status, err := gc.reconcileRBAC(grant)
+	if err != nil {
+		status.Ready = false
+		status.Message = err.Error()
+	}
+
+	if !reflect.DeepEqual(status, grant.Status) {
+		grant.Status = status
+		if statusErr := gc.client.updateGMSAGrantStatus(grant); statusErr != nil && err == nil {
+			err = statusErr
+		}
+	}
+
+	return err
+}
+
+// reconcileRBAC creates, updates or deletes the grant's role and role binding, and returns the
+// grant's new status.
+func (gc *grantsController) reconcileRBAC(grant *gmsaGrant) (gmsaGrantStatus, error) {
+	status := gmsaGrantStatus{ObservedGeneration: grant.Generation}
+
+	// the webhook doesn't validate grants in the namespaces it's disabled for, so the users who
+	// created them might not have access to the cred specs they grant access to
+	namespace, _, err := gc.client.retrieveNamespace(grant.Namespace)
+	if err != nil {
+		return status, err
+	}
+	if namespace.Labels[webhookDisabledLabelKey] == webhookDisabledLabelValue {
+		status.Message = fmt.Sprintf("%s objects are not reconciled in namespaces labeled %s=%s, since the webhook does not validate them", grantCRDKind, webhookDisabledLabelKey, webhookDisabledLabelValue)
+		return status, gc.deleteRBAC(grant.Namespace, grant.Name)
+	}
+
+	credSpecNames := sortedUniqueStrings(grant.Spec.CredSpecNames)
+	for _, credSpecName := range credSpecNames {
+		if _, code, err := gc.client.retrieveCredSpecLabels(credSpecName); code == http.StatusNotFound {
+			status.MissingCredSpecs = append(status.MissingCredSpecs, credSpecName)
+		} else if err != nil {
+			return status, err
+		}
+	}
+
+	serviceAccountNames := sortedUniqueStrings(grant.Spec.ServiceAccountNames)
+	for _, serviceAccountName := range serviceAccountNames {
+		if _, code, err := gc.client.retrieveServiceAccount(grant.Namespace, serviceAccountName); code == http.StatusNotFound {
+			status.MissingServiceAccounts = append(status.MissingServiceAccounts, serviceAccountName)
+		} else if err != nil {
+			return status, err
+		}
+	}
+
+	// a role without resource names would grant access to all cred specs
+	if len(credSpecNames) == 0 || len(serviceAccountNames) == 0 {
+		status.Ready = true
+		return status, gc.deleteRBAC(grant.Namespace, grant.Name)
+	}
+
+	rbacName := grantRBACNamePrefix + grant.Name
+
+	role, err := gc.client.retrieveRole(grant.Namespace, rbacName)
+	if err != nil {
+		return status, err
+	}
+	if role != nil && role.Labels[grantLabelKey] != grant.Name {
+		return status, fmt.Errorf("role %s already exists, and is not managed by %s %s", rbacName, grantCRDKind, grant.Name)
+	}
+	rules := []rbacv1.PolicyRule{{
+		APIGroups:     []string{crdAPIGroup},
+		Resources:     []string{crdResourceName},
+		Verbs:         []string{"use"},
+		ResourceNames: credSpecNames,
+	}}
+	if role == nil {
+		role = &rbacv1.Role{ObjectMeta: grantRBACObjectMeta(grant, rbacName)}
+	}
+	if role.ResourceVersion == "" || !reflect.DeepEqual(role.Rules, rules) || !reflect.DeepEqual(role.OwnerReferences, grantOwnerReferences(grant)) {
+		role = role.DeepCopy()
+		role.Rules = rules
+		role.OwnerReferences = grantOwnerReferences(grant)
+		if err := gc.client.saveRole(role); err != nil {
+			return status, err
+		}
+		logrus.Infof("%s %s/%s: saved role with access to cred specs %v", grantCRDKind, grant.Namespace, grant.Name, credSpecNames)
+	}
+	status.RoleName = rbacName
+
+	roleBinding, err := gc.client.retrieveRoleBinding(grant.Namespace, rbacName)
+	if err != nil {
+		return status, err
+	}
+	if roleBinding != nil && roleBinding.Labels[grantLabelKey] != grant.Name {
+		return status, fmt.Errorf("role binding %s already exists, and is not managed by %s %s", rbacName, grantCRDKind, grant.Name)
+	}
+	subjects := make([]rbacv1.Subject, len(serviceAccountNames))
+	for i, serviceAccountName := range serviceAccountNames {
+		subjects[i] = rbacv1.Subject{
+			Kind:      rbacv1.ServiceAccountKind,
+			Name:      serviceAccountName,
+			Namespace: grant.Namespace,
+		}
+	}
+	if roleBinding == nil {
+		roleBinding = &rbacv1.RoleBinding{
+			ObjectMeta: grantRBACObjectMeta(grant, rbacName),
+			RoleRef: rbacv1.RoleRef{
+				APIGroup: rbacv1.GroupName,
+				Kind:     "Role",
+				Name:     rbacName,
+			},
+		}
+	}
+	if roleBinding.ResourceVersion == "" || !reflect.DeepEqual(roleBinding.Subjects, subjects) || !reflect.DeepEqual(roleBinding.OwnerReferences, grantOwnerReferences(grant)) {
+		roleBinding = roleBinding.DeepCopy()
+		roleBinding.Subjects = subjects
+		roleBinding.OwnerReferences = grantOwnerReferences(grant)
+		if err := gc.client.saveRoleBinding(roleBinding); err != nil {
+			return status, err
+		}
+		logrus.Infof("%s %s/%s: saved role binding for service accounts %v", grantCRDKind, grant.Namespace, grant.Name, serviceAccountNames)
+	}
+	status.RoleBindingName = rbacName
+
+	status.Ready = true
+	return status, nil
+}
+
+// deleteRBAC deletes the role and role binding managed for the given grant, if any.
+func (gc *grantsController) deleteRBAC(namespace, grantName string) error {
+	rbacName := grantRBACNamePrefix + grantName
+
+	roleBinding, err := gc.client.retrieveRoleBinding(namespace, rbacName)
+	if err != nil {
+		return err
+	}
+	if roleBinding != nil && roleBinding.Labels[grantLabelKey] == grantName {
+		if err := gc.client.deleteRoleBinding(namespace, rbacName); err != nil {
+			return err
+		}
+		logrus.Infof("%s %s/%s: deleted role binding", grantCRDKind, namespace, grantName)
+	}
+
+	role, err := gc.client.retrieveRole(namespace, rbacName)
+	if err != nil {
+		return err
+	}
+	if role != nil && role.Labels[grantLabelKey] == grantName {
+		if err := gc.client.deleteRole(namespace, rbacName); err != nil {
+			return err
+		}
+		logrus.Infof("%s %s/%s: deleted role", grantCRDKind, namespace, grantName)
+	}
+
+	return nil
+}
+
+func grantRBACObjectMeta(grant *gmsaGrant, name string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Name:      name,
+		Namespace: grant.Namespace,
+		Labels:    map[string]string{grantLabelKey: grant.Name},
+	}
+}
+
+func grantOwnerReferences(grant *gmsaGrant) []metav1.OwnerReference {
+	isController := true
+	return []metav1.OwnerReference{{
+		APIVersion: crdAPIGroup + "/" + crdAPIVersion,
+		Kind:       grantCRDKind,
+		Name:       grant.Name,
+		UID:        grant.UID,
+		Controller: &isController,
+	}}
+}
+
+func sortedUniqueStrings(slice []string) []string {
+	unique := make([]string, 0, len(slice))
+	for _, s := range slice {
+		if s != "" && !containsString(unique, s) {
+			unique = append(unique, s)
+		}
+	}
+	sort.Strings(unique)
+	return unique
+}
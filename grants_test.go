@@ -0,0 +1,320 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// fakeGrantsClient is an in-memory grantsClientInterface; objects are keyed by namespace/name.
+type fakeGrantsClient struct {
+	grants map[string]*gmsaGrant
+	// namespaceLabels are the labels of namespaces, keyed by name; all namespaces exist
+	namespaceLabels map[string]map[string]string
+	credSpecs       map[string]bool
+	serviceAccounts map[string]bool
+	roles           map[string]*rbacv1.Role
+	roleBindings    map[string]*rbacv1.RoleBinding
+
+	saves int
+}
+
+func newFakeGrantsClient() *fakeGrantsClient {
+	return &fakeGrantsClient{
+		grants:          make(map[string]*gmsaGrant),
+		namespaceLabels: make(map[string]map[string]string),
+		credSpecs:       make(map[string]bool),
+		serviceAccounts: make(map[string]bool),
+		roles:           make(map[string]*rbacv1.Role),
+		roleBindings:    make(map[string]*rbacv1.RoleBinding),
+	}
+}
+
+func (*fakeGrantsClient) watchGMSAGrants(handler cache.ResourceEventHandler) {}
+
+func (client *fakeGrantsClient) retrieveGMSAGrant(namespace, name string) (*gmsaGrant, error) {
+	if grant, present := client.grants[namespace+"/"+name]; present {
+		return deepCopyGrant(grant), nil
+	}
+	return nil, nil
+}
+
+func (client *fakeGrantsClient) updateGMSAGrantStatus(grant *gmsaGrant) error {
+	client.grants[grant.Namespace+"/"+grant.Name] = deepCopyGrant(grant)
+	return nil
+}
+
+func (client *fakeGrantsClient) retrieveNamespace(name string) (*corev1.Namespace, int, error) {
+	return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: client.namespaceLabels[name]}}, 0, nil
+}
+
+func (client *fakeGrantsClient) retrieveCredSpecLabels(credSpecName string) (map[string]string, int, error) {
+	if !client.credSpecs[credSpecName] {
+		return nil, http.StatusNotFound, fmt.Errorf("cred spec %s does not exist", credSpecName)
+	}
+	return nil, 0, nil
+}
+
+func (client *fakeGrantsClient) retrieveServiceAccount(namespace, name string) (*corev1.ServiceAccount, int, error) {
+	if !client.serviceAccounts[namespace+"/"+name] {
+		return nil, http.StatusNotFound, fmt.Errorf("service account %s/%s does not exist", namespace, name)
+	}
+	return &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace}}, 0, nil
+}
+
+func (client *fakeGrantsClient) retrieveRole(namespace, name string) (*rbacv1.Role, error) {
+	return client.roles[namespace+"/"+name], nil
+}
+
+func (client *fakeGrantsClient) saveRole(role *rbacv1.Role) error {
+	client.saves++
+	role = role.DeepCopy()
+	role.ResourceVersion = fmt.Sprintf("%d", client.saves)
+	client.roles[role.Namespace+"/"+role.Name] = role
+	return nil
+}
+
+func (client *fakeGrantsClient) deleteRole(namespace, name string) error {
+	delete(client.roles, namespace+"/"+name)
+	return nil
+}
+
+func (client *fakeGrantsClient) retrieveRoleBinding(namespace, name string) (*rbacv1.RoleBinding, error) {
+	return client.roleBindings[namespace+"/"+name], nil
+}
+
+func (client *fakeGrantsClient) saveRoleBinding(roleBinding *rbacv1.RoleBinding) error {
+	client.saves++
+	roleBinding = roleBinding.DeepCopy()
+	roleBinding.ResourceVersion = fmt.Sprintf("%d", client.saves)
+	client.roleBindings[roleBinding.Namespace+"/"+roleBinding.Name] = roleBinding
+	return nil
+}
+
+func (client *fakeGrantsClient) deleteRoleBinding(namespace, name string) error {
+	delete(client.roleBindings, namespace+"/"+name)
+	return nil
+}
+
+func deepCopyGrant(grant *gmsaGrant) *gmsaGrant {
+	grantCopy := *grant
+	grant.ObjectMeta.DeepCopyInto(&grantCopy.ObjectMeta)
+	grantCopy.Spec.CredSpecNames = append([]string(nil), grant.Spec.CredSpecNames...)
+	grantCopy.Spec.ServiceAccountNames = append([]string(nil), grant.Spec.ServiceAccountNames...)
+	grantCopy.Status.MissingCredSpecs = append([]string(nil), grant.Status.MissingCredSpecs...)
+	grantCopy.Status.MissingServiceAccounts = append([]string(nil), grant.Status.MissingServiceAccounts...)
+	return &grantCopy
+}
+
+func TestGrantsControllerReconcilesRBAC(t *testing.T) {
+	client := newFakeGrantsClient()
+	client.credSpecs["cred-spec-0"] = true
+	client.credSpecs["cred-spec-1"] = true
+	client.serviceAccounts["ns/sa-0"] = true
+	client.grants["ns/grant"] = &gmsaGrant{
+		ObjectMeta: metav1.ObjectMeta{Name: "grant", Namespace: "ns", UID: "grant-uid", Generation: 3},
+		Spec: gmsaGrantSpec{
+			CredSpecNames:       []string{"cred-spec-1", "cred-spec-0", "cred-spec-2", "cred-spec-1"},
+			ServiceAccountNames: []string{"sa-1", "sa-0"},
+		},
+	}
+
+	controller := newGrantsController(client)
+	require.Nil(t, controller.reconcile("ns/grant"))
+
+	role := client.roles["ns/gmsa-grant-grant"]
+	require.NotNil(t, role)
+	assert.Equal(t, "grant", role.Labels[grantLabelKey])
+	if assert.Equal(t, 1, len(role.OwnerReferences)) {
+		assert.Equal(t, grantCRDKind, role.OwnerReferences[0].Kind)
+		assert.Equal(t, "grant-uid", string(role.OwnerReferences[0].UID))
+	}
+	if assert.Equal(t, 1, len(role.Rules)) {
+		assert.Equal(t, []string{"use"}, role.Rules[0].Verbs)
+		assert.Equal(t, []string{crdResourceName}, role.Rules[0].Resources)
+		assert.Equal(t, []string{"cred-spec-0", "cred-spec-1", "cred-spec-2"}, role.Rules[0].ResourceNames)
+	}
+
+	roleBinding := client.roleBindings["ns/gmsa-grant-grant"]
+	require.NotNil(t, roleBinding)
+	assert.Equal(t, "gmsa-grant-grant", roleBinding.RoleRef.Name)
+	assert.Equal(t, []rbacv1.Subject{
+		{Kind: rbacv1.ServiceAccountKind, Name: "sa-0", Namespace: "ns"},
+		{Kind: rbacv1.ServiceAccountKind, Name: "sa-1", Namespace: "ns"},
+	}, roleBinding.Subjects)
+
+	assert.Equal(t, gmsaGrantStatus{
+		ObservedGeneration:     3,
+		Ready:                  true,
+		RoleName:               "gmsa-grant-grant",
+		RoleBindingName:        "gmsa-grant-grant",
+		MissingCredSpecs:       []string{"cred-spec-2"},
+		MissingServiceAccounts: []string{"sa-1"},
+	}, client.grants["ns/grant"].Status)
+
+	t.Run("reconciling again is a no-op", func(t *testing.T) {
+		saves := client.saves
+		require.Nil(t, controller.reconcile("ns/grant"))
+		assert.Equal(t, saves, client.saves)
+	})
+
+	t.Run("spec updates get reflected", func(t *testing.T) {
+		client.grants["ns/grant"].Spec.CredSpecNames = []string{"cred-spec-0"}
+		require.Nil(t, controller.reconcile("ns/grant"))
+		assert.Equal(t, []string{"cred-spec-0"}, client.roles["ns/gmsa-grant-grant"].Rules[0].ResourceNames)
+		assert.Nil(t, client.grants["ns/grant"].Status.MissingCredSpecs)
+	})
+
+	t.Run("emptying the grant deletes its RBAC", func(t *testing.T) {
+		client.grants["ns/grant"].Spec.ServiceAccountNames = nil
+		require.Nil(t, controller.reconcile("ns/grant"))
+		assert.Empty(t, client.roles)
+		assert.Empty(t, client.roleBindings)
+		assert.True(t, client.grants["ns/grant"].Status.Ready)
+		assert.Equal(t, "", client.grants["ns/grant"].Status.RoleName)
+	})
+
+	t.Run("deleting the grant deletes its RBAC", func(t *testing.T) {
+		client.grants["ns/grant"].Spec.ServiceAccountNames = []string{"sa-0"}
+		require.Nil(t, controller.reconcile("ns/grant"))
+		require.Equal(t, 1, len(client.roles))
+		require.Equal(t, 1, len(client.roleBindings))
+
+		delete(client.grants, "ns/grant")
+		require.Nil(t, controller.reconcile("ns/grant"))
+		assert.Empty(t, client.roles)
+		assert.Empty(t, client.roleBindings)
+	})
+}
+
+func TestGrantsControllerDoesNotTakeOverUnmanagedRBAC(t *testing.T) {
+	client := newFakeGrantsClient()
+	client.grants["ns/grant"] = &gmsaGrant{
+		ObjectMeta: metav1.ObjectMeta{Name: "grant", Namespace: "ns"},
+		Spec: gmsaGrantSpec{
+			CredSpecNames:       []string{"cred-spec-0"},
+			ServiceAccountNames: []string{"sa-0"},
+		},
+	}
+	unmanagedRole := &rbacv1.Role{ObjectMeta: metav1.ObjectMeta{Name: "gmsa-grant-grant", Namespace: "ns", ResourceVersion: "1"}}
+	client.roles["ns/gmsa-grant-grant"] = unmanagedRole
+
+	controller := newGrantsController(client)
+	err := controller.reconcile("ns/grant")
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "role gmsa-grant-grant already exists, and is not managed by GMSAGrant grant")
+	}
+
+	assert.Equal(t, unmanagedRole, client.roles["ns/gmsa-grant-grant"])
+	assert.Empty(t, client.roleBindings)
+
+	status := client.grants["ns/grant"].Status
+	assert.False(t, status.Ready)
+	assert.Contains(t, status.Message, "is not managed by GMSAGrant grant")
+
+	// nor delete it
+	delete(client.grants, "ns/grant")
+	require.Nil(t, controller.reconcile("ns/grant"))
+	assert.Equal(t, unmanagedRole, client.roles["ns/gmsa-grant-grant"])
+}
+
+func TestGrantsControllerIgnoresGrantsInNamespacesTheWebhookIsDisabledFor(t *testing.T) {
+	client := newFakeGrantsClient()
+	client.credSpecs["cred-spec-0"] = true
+	client.serviceAccounts["ns/sa-0"] = true
+	client.grants["ns/grant"] = &gmsaGrant{
+		ObjectMeta: metav1.ObjectMeta{Name: "grant", Namespace: "ns"},
+		Spec: gmsaGrantSpec{
+			CredSpecNames:       []string{"cred-spec-0"},
+			ServiceAccountNames: []string{"sa-0"},
+		},
+	}
+
+	controller := newGrantsController(client)
+	require.Nil(t, controller.reconcile("ns/grant"))
+	require.NotNil(t, client.roles["ns/gmsa-grant-grant"])
+	require.NotNil(t, client.roleBindings["ns/gmsa-grant-grant"])
+
+	// disabling the webhook for the namespace revokes the access granted there
+	client.namespaceLabels["ns"] = map[string]string{webhookDisabledLabelKey: webhookDisabledLabelValue}
+	require.Nil(t, controller.reconcile("ns/grant"))
+	assert.Empty(t, client.roles)
+	assert.Empty(t, client.roleBindings)
+
+	status := client.grants["ns/grant"].Status
+	assert.False(t, status.Ready)
+	assert.Equal(t, "GMSAGrant objects are not reconciled in namespaces labeled gmsa-webhook=disabled, since the webhook does not validate them", status.Message)
+}
+
+func TestValidateGrantRequest(t *testing.T) {
+	webhook := newWebhook(&fuzzKubeClient{}, &webhookConfig{enforcementMode: enforcementModeEnforce})
+	grantKind := metav1.GroupVersionKind{Group: crdAPIGroup, Version: crdAPIVersion, Kind: grantCRDKind}
+	// odd-length cred spec names are not authorized
+	newGrant := func(credSpecNames, serviceAccountNames []string) *gmsaGrant {
+		return &gmsaGrant{
+			ObjectMeta: metav1.ObjectMeta{Name: "grant"},
+			Spec:       gmsaGrantSpec{CredSpecNames: credSpecNames, ServiceAccountNames: serviceAccountNames},
+		}
+	}
+
+	for name, testCase := range map[string]struct {
+		operation     admissionv1beta1.Operation
+		grant         *gmsaGrant
+		oldGrant      *gmsaGrant
+		expectedField string
+	}{
+		"authorized grant": {
+			operation: admissionv1beta1.Create,
+			grant:     newGrant([]string{"ab", "abcd"}, []string{"sa"}),
+		},
+		"unauthorized grant": {
+			operation:     admissionv1beta1.Create,
+			grant:         newGrant([]string{"ab", "abc"}, []string{"sa"}),
+			expectedField: "spec.credSpecNames[1]",
+		},
+		"granting an unauthorized cred spec to more service accounts": {
+			operation:     admissionv1beta1.Update,
+			grant:         newGrant([]string{"abc"}, []string{"sa", "other-sa"}),
+			oldGrant:      newGrant([]string{"abc"}, []string{"sa"}),
+			expectedField: "spec.credSpecNames[0]",
+		},
+		"updates that don't change the spec are not re-checked": {
+			operation: admissionv1beta1.Update,
+			grant:     &gmsaGrant{ObjectMeta: metav1.ObjectMeta{Name: "grant", Labels: map[string]string{"a": "b"}}, Spec: gmsaGrantSpec{CredSpecNames: []string{"abc"}}},
+			oldGrant:  newGrant([]string{"abc"}, nil),
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var oldGrant interface{}
+			if testCase.oldGrant != nil {
+				oldGrant = testCase.oldGrant
+			}
+			request := newObjectAdmissionHTTPRequest(t, testCase.operation, grantKind, testCase.grant, oldGrant)
+
+			admissionResponse, _, httpErr := webhook.httpRequestToAdmissionResponse(request, validate)
+			require.Nil(t, httpErr)
+
+			if testCase.expectedField == "" {
+				assert.True(t, admissionResponse.Allowed)
+				return
+			}
+
+			require.False(t, admissionResponse.Allowed)
+			assert.Contains(t, admissionResponse.Result.Message, "does not have `use` access to the abc gMSA cred spec, and so cannot grant it")
+			require.NotNil(t, admissionResponse.Result.Details)
+			assert.Equal(t, grantCRDKind, admissionResponse.Result.Details.Kind)
+			assert.Equal(t, "grant", admissionResponse.Result.Details.Name)
+			if assert.Equal(t, 1, len(admissionResponse.Result.Details.Causes)) {
+				assert.Equal(t, testCase.expectedField, admissionResponse.Result.Details.Causes[0].Field)
+			}
+		})
+	}
+}
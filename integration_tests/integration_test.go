@@ -7,9 +7,11 @@ import (
 	"os"
 	"path"
 	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"gotest.tools/poll"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -69,21 +71,14 @@ func TestHappyPathWithSeveralContainers(t *testing.T) {
 func TestServiceAccountDoesNotHavePermissionsToUseCredSpec(t *testing.T) {
 	testName := "sa-does-not-have-permissions-to-use-cred-spec"
 	credSpecTemplates := []string{"credspec-0"}
-	templates := []string{"credspecs-users-rbac-role", "service-account", "simple-with-container-level-gmsa"}
+	templates := []string{"credspecs-users-rbac-role", "service-account"}
 
 	testConfig, tearDownFunc := integrationTestSetup(t, testName, credSpecTemplates, templates)
 	defer tearDownFunc()
 
-	replicaSet := waitForReplicaSetGen1(t, testConfig.Namespace, "app="+testName)
-	assert.Equal(t, int32(0), replicaSet.Status.Replicas)
-	if assert.Equal(t, 1, len(replicaSet.Status.Conditions)) {
-		condition := replicaSet.Status.Conditions[0]
-
-		assert.Equal(t, condition.Reason, "FailedCreate")
-
-		expectedSubstr := fmt.Sprintf("service account %s does not have `use` access to the %s gMSA cred spec", testConfig.ServiceAccountName, testConfig.CredSpecNames[0])
-		assert.Contains(t, condition.Message, expectedSubstr)
-	}
+	// the deployment itself gets denied
+	expectedSubstr := fmt.Sprintf("service account %s does not have `use` access to the %s gMSA cred spec", testConfig.ServiceAccountName, testConfig.CredSpecNames[0])
+	assertManifestDenied(t, renderTemplate(t, testConfig, "simple-with-container-level-gmsa"), expectedSubstr)
 }
 
 func TestCredSpecDoesNotExist(t *testing.T) {
@@ -106,40 +101,30 @@ func TestCredSpecDoesNotExist(t *testing.T) {
 
 func TestCannotPreSetGMSAPodLevelContentAnnotations(t *testing.T) {
 	testName := "cannot-pre-set-gmsa-pod-level-content-annotations"
-	credSpecTemplates := []string{"credspec-0"}
-	templates := []string{"all-credspecs-users-rbac-role", "service-account", "sa-rbac-binding", "simple-with-preset-gmsa-pod-level-content-annotation"}
+	// the preset contents are credspec-0's, which don't match the cred spec the pod requests
+	credSpecTemplates := []string{"credspec-1"}
+	templates := []string{"all-credspecs-users-rbac-role", "service-account", "sa-rbac-binding"}
 
 	testConfig, tearDownFunc := integrationTestSetup(t, testName, credSpecTemplates, templates)
 	defer tearDownFunc()
 
-	replicaSet := waitForReplicaSetGen1(t, testConfig.Namespace, "app="+testName)
-	assert.Equal(t, int32(0), replicaSet.Status.Replicas)
-	if assert.Equal(t, 1, len(replicaSet.Status.Conditions)) {
-		condition := replicaSet.Status.Conditions[0]
-
-		assert.Equal(t, condition.Reason, "FailedCreate")
-
-		assert.Contains(t, condition.Message, "cannot pre-set a pod's gMSA content annotation (annotation pod.alpha.windows.kubernetes.io/gmsa-credential-spec present)")
-	}
+	// the deployment itself gets denied
+	expectedSubstr := fmt.Sprintf("cred spec contained in annotation pod.alpha.windows.kubernetes.io/gmsa-credential-spec does not match the contents of GMSA %s", testConfig.CredSpecNames[0])
+	assertManifestDenied(t, renderTemplate(t, testConfig, "simple-with-preset-gmsa-pod-level-content-annotation"), expectedSubstr)
 }
 
 func TestCannotPreSetGMSAContainerLevelContentAnnotations(t *testing.T) {
 	testName := "cannot-pre-set-gmsa-container-level-content-annotations"
-	credSpecTemplates := []string{"credspec-0"}
-	templates := []string{"all-credspecs-users-rbac-role", "service-account", "sa-rbac-binding", "simple-with-preset-gmsa-container-level-content-annotation"}
+	// the preset contents are credspec-0's, which don't match the cred spec the pod requests
+	credSpecTemplates := []string{"credspec-1"}
+	templates := []string{"all-credspecs-users-rbac-role", "service-account", "sa-rbac-binding"}
 
 	testConfig, tearDownFunc := integrationTestSetup(t, testName, credSpecTemplates, templates)
 	defer tearDownFunc()
 
-	replicaSet := waitForReplicaSetGen1(t, testConfig.Namespace, "app="+testName)
-	assert.Equal(t, int32(0), replicaSet.Status.Replicas)
-	if assert.Equal(t, 1, len(replicaSet.Status.Conditions)) {
-		condition := replicaSet.Status.Conditions[0]
-
-		assert.Equal(t, condition.Reason, "FailedCreate")
-
-		assert.Contains(t, condition.Message, "cannot pre-set a pod's gMSA content annotation (annotation nginx.container.alpha.windows.kubernetes.io/gmsa-credential-spec present)")
-	}
+	// the deployment itself gets denied
+	expectedSubstr := fmt.Sprintf("cred spec contained in annotation nginx.container.alpha.windows.kubernetes.io/gmsa-credential-spec does not match the contents of GMSA %s", testConfig.CredSpecNames[0])
+	assertManifestDenied(t, renderTemplate(t, testConfig, "simple-with-preset-gmsa-container-level-content-annotation"), expectedSubstr)
 }
 
 func TestCannotUpdateExistingPodLevelGMSAAnnotations(t *testing.T) {
@@ -216,8 +201,284 @@ func TestCannotUpdateExistingContainerLevelGMSAAnnotations(t *testing.T) {
 	}
 }
 
+func TestDefaultCredSpecFromGMSAPolicy(t *testing.T) {
+	testName := "default-cred-spec-from-gmsa-policy"
+	credSpecTemplates := []string{"credspec-0"}
+	templates := []string{"credspecs-users-rbac-role", "service-account", "sa-rbac-binding", "gmsa-policy-with-default", "simple-windows-without-gmsa"}
+
+	testConfig, tearDownFunc := integrationTestSetup(t, testName, credSpecTemplates, templates)
+	defer tearDownFunc()
+
+	pod := waitForPodToComeUp(t, testConfig.Namespace, "app="+testName)
+
+	assert.Equal(t, testConfig.CredSpecNames[0], pod.Annotations["pod.alpha.windows.kubernetes.io/gmsa-credential-spec-name"])
+	assert.Equal(t, expectedCredSpec0, pod.Annotations["pod.alpha.windows.kubernetes.io/gmsa-credential-spec"])
+}
+
+func TestDefaultCredSpecFromNamespaceAnnotation(t *testing.T) {
+	testName := "default-cred-spec-from-namespace-annotation"
+	credSpecTemplates := []string{"credspec-0"}
+	templates := []string{"credspecs-users-rbac-role", "service-account", "sa-rbac-binding"}
+
+	testConfig, tearDownFunc := integrationTestSetup(t, testName, credSpecTemplates, templates)
+	defer tearDownFunc()
+
+	annotateNamespace(t, testConfig.Namespace, "windows.k8s.io/default-gmsa-credential-spec-name", testConfig.CredSpecNames[0])
+	applyManifestOrFail(t, renderTemplate(t, testConfig, "simple-windows-without-gmsa"))
+
+	pod := waitForPodToComeUp(t, testConfig.Namespace, "app="+testName)
+
+	assert.Equal(t, testConfig.CredSpecNames[0], pod.Annotations["pod.alpha.windows.kubernetes.io/gmsa-credential-spec-name"])
+	assert.Equal(t, expectedCredSpec0, pod.Annotations["pod.alpha.windows.kubernetes.io/gmsa-credential-spec"])
+}
+
+func TestDefaultCredSpecRequiresUseAccess(t *testing.T) {
+	testName := "default-cred-spec-requires-use-access"
+	credSpecTemplates := []string{"credspec-0"}
+	templates := []string{"credspecs-users-rbac-role", "service-account", "gmsa-policy-with-default", "simple-windows-without-gmsa"}
+
+	testConfig, tearDownFunc := integrationTestSetup(t, testName, credSpecTemplates, templates)
+	defer tearDownFunc()
+
+	replicaSet := waitForReplicaSetGen1(t, testConfig.Namespace, "app="+testName)
+	assert.Equal(t, int32(0), replicaSet.Status.Replicas)
+	if assert.Equal(t, 1, len(replicaSet.Status.Conditions)) {
+		condition := replicaSet.Status.Conditions[0]
+
+		assert.Equal(t, condition.Reason, "FailedCreate")
+
+		expectedSubstr := fmt.Sprintf("service account %s does not have `use` access to the %s gMSA cred spec (default from GMSAPolicy %s-policy)", testConfig.ServiceAccountName, testConfig.CredSpecNames[0], testName)
+		assert.Contains(t, condition.Message, expectedSubstr)
+	}
+}
+
+func TestCredSpecBoundToServiceAccount(t *testing.T) {
+	testName := "cred-spec-bound-to-service-account"
+	credSpecTemplates := []string{"credspec-0"}
+	templates := []string{"credspecs-users-rbac-role", "service-account-with-gmsa", "sa-rbac-binding", "simple-windows-without-gmsa"}
+
+	testConfig, tearDownFunc := integrationTestSetup(t, testName, credSpecTemplates, templates)
+	defer tearDownFunc()
+
+	pod := waitForPodToComeUp(t, testConfig.Namespace, "app="+testName)
+
+	assert.Equal(t, testConfig.CredSpecNames[0], pod.Annotations["pod.alpha.windows.kubernetes.io/gmsa-credential-spec-name"])
+	assert.Equal(t, expectedCredSpec0, pod.Annotations["pod.alpha.windows.kubernetes.io/gmsa-credential-spec"])
+}
+
+func TestCredSpecBoundToServiceAccountRequiresUseAccess(t *testing.T) {
+	testName := "cred-spec-bound-to-sa-requires-use-access"
+	credSpecTemplates := []string{"credspec-0"}
+	templates := []string{"credspecs-users-rbac-role", "service-account-with-gmsa", "simple-windows-without-gmsa"}
+
+	testConfig, tearDownFunc := integrationTestSetup(t, testName, credSpecTemplates, templates)
+	defer tearDownFunc()
+
+	replicaSet := waitForReplicaSetGen1(t, testConfig.Namespace, "app="+testName)
+	assert.Equal(t, int32(0), replicaSet.Status.Replicas)
+	if assert.Equal(t, 1, len(replicaSet.Status.Conditions)) {
+		condition := replicaSet.Status.Conditions[0]
+
+		assert.Equal(t, condition.Reason, "FailedCreate")
+
+		expectedSubstr := fmt.Sprintf("service account %s does not have `use` access to the %s gMSA cred spec (default from service account %s's windows.k8s.io/gmsa-credential-spec-name annotation)", testConfig.ServiceAccountName, testConfig.CredSpecNames[0], testConfig.ServiceAccountName)
+		assert.Contains(t, condition.Message, expectedSubstr)
+	}
+}
+
+func TestGMSAPolicyDeniesCredSpec(t *testing.T) {
+	testName := "gmsa-policy-denies-cred-spec"
+	credSpecTemplates := []string{"credspec-0"}
+	templates := []string{"credspecs-users-rbac-role", "service-account", "sa-rbac-binding", "gmsa-policy-deny"}
+
+	testConfig, tearDownFunc := integrationTestSetup(t, testName, credSpecTemplates, templates)
+	defer tearDownFunc()
+
+	expectedSubstr := fmt.Sprintf("the %s gMSA cred spec is denied by GMSAPolicy %s-policy", testConfig.CredSpecNames[0], testName)
+	assertManifestDenied(t, renderTemplate(t, testConfig, "simple-with-gmsa"), expectedSubstr)
+}
+
+func TestGMSAPolicyCapsIdentitiesPerPod(t *testing.T) {
+	testName := "gmsa-policy-caps-identities-per-pod"
+	credSpecTemplates := []string{"credspec-0", "credspec-1", "credspec-2"}
+	templates := []string{"credspecs-users-rbac-role", "service-account", "sa-rbac-binding", "gmsa-policy-max-one-identity"}
+
+	testConfig, tearDownFunc := integrationTestSetup(t, testName, credSpecTemplates, templates)
+	defer tearDownFunc()
+
+	expectedSubstr := fmt.Sprintf("pod uses 3 distinct gMSA cred specs, but GMSAPolicy %s-policy allows at most 1", testName)
+	assertManifestDenied(t, renderTemplate(t, testConfig, "several-containers-with-gmsa"), expectedSubstr)
+}
+
+func TestWindowsSchedulingValidation(t *testing.T) {
+	testName := "windows-scheduling-validation"
+	credSpecTemplates := []string{"credspec-0"}
+	templates := []string{"credspecs-users-rbac-role", "service-account", "sa-rbac-binding"}
+
+	testConfig, tearDownFunc := integrationTestSetup(t, testName, credSpecTemplates, templates)
+	defer tearDownFunc()
+
+	annotateNamespace(t, testConfig.Namespace, "windows.k8s.io/gmsa-windows-scheduling", "validate")
+	assertManifestDenied(t, renderTemplate(t, testConfig, "simple-with-gmsa"), "pods using gMSAs must be restricted to Windows nodes, e.g. with a beta.kubernetes.io/os=windows node selector")
+}
+
+func TestWindowsSchedulingMutation(t *testing.T) {
+	testName := "windows-scheduling-mutation"
+	credSpecTemplates := []string{"credspec-0"}
+	templates := []string{"credspecs-users-rbac-role", "service-account", "sa-rbac-binding"}
+
+	testConfig, tearDownFunc := integrationTestSetup(t, testName, credSpecTemplates, templates)
+	defer tearDownFunc()
+
+	annotateNamespace(t, testConfig.Namespace, "windows.k8s.io/gmsa-windows-scheduling", "mutate")
+	applyManifestOrFail(t, renderTemplate(t, testConfig, "simple-with-gmsa"))
+
+	pod := waitForPodToComeUp(t, testConfig.Namespace, "app="+testName)
+
+	assert.Equal(t, "windows", pod.Spec.NodeSelector["beta.kubernetes.io/os"])
+	assert.Equal(t, expectedCredSpec0, pod.Annotations["pod.alpha.windows.kubernetes.io/gmsa-credential-spec"])
+}
+
+func TestDenialEventOnOwningWorkload(t *testing.T) {
+	testName := "denial-event-on-owning-workload"
+	credSpecTemplates := []string{"credspec-0"}
+	// replica sets' pod templates are not validated, so the denial happens when creating pods
+	templates := []string{"credspecs-users-rbac-role", "service-account", "replica-set-with-gmsa"}
+
+	testConfig, tearDownFunc := integrationTestSetup(t, testName, credSpecTemplates, templates)
+	defer tearDownFunc()
+
+	replicaSet := waitForReplicaSetGen1(t, testConfig.Namespace, "app="+testName)
+
+	event := waitForEvent(t, testConfig.Namespace, replicaSet.Name, "GMSAAdmissionDenied")
+	assert.Equal(t, "Warning", event.Type)
+	assert.Equal(t, "ReplicaSet", event.InvolvedObject.Kind)
+	expectedSubstr := fmt.Sprintf("service account %s does not have `use` access to the %s gMSA cred spec", testConfig.ServiceAccountName, testConfig.CredSpecNames[0])
+	assert.Contains(t, event.Message, expectedSubstr)
+}
+
+func TestAllViolationsAreReportedAtOnce(t *testing.T) {
+	testName := "all-violations-are-reported-at-once"
+	credSpecTemplates := []string{"credspec-0", "credspec-1", "credspec-2"}
+	templates := []string{"credspecs-users-rbac-role", "service-account"}
+
+	testConfig, tearDownFunc := integrationTestSetup(t, testName, credSpecTemplates, templates)
+	defer tearDownFunc()
+
+	expectedSubstrs := []string{"found 3 gMSA violations"}
+	for _, credSpecName := range testConfig.CredSpecNames {
+		expectedSubstrs = append(expectedSubstrs, fmt.Sprintf("service account %s does not have `use` access to the %s gMSA cred spec", testConfig.ServiceAccountName, credSpecName))
+	}
+	assertManifestDenied(t, renderTemplate(t, testConfig, "several-containers-with-gmsa"), expectedSubstrs...)
+}
+
+func TestCronJobPodTemplateIsValidated(t *testing.T) {
+	testName := "cron-job-pod-template-is-validated"
+	credSpecTemplates := []string{"credspec-0"}
+	templates := []string{"credspecs-users-rbac-role", "service-account"}
+
+	testConfig, tearDownFunc := integrationTestSetup(t, testName, credSpecTemplates, templates)
+	defer tearDownFunc()
+
+	expectedSubstr := fmt.Sprintf("service account %s does not have `use` access to the %s gMSA cred spec", testConfig.ServiceAccountName, testConfig.CredSpecNames[0])
+	assertManifestDenied(t, renderTemplate(t, testConfig, "cron-job-with-gmsa"), expectedSubstr)
+
+	// and it's admitted once the service account is granted access
+	applyManifestOrFail(t, renderTemplate(t, testConfig, "sa-rbac-binding"))
+	applyManifestOrFail(t, renderTemplate(t, testConfig, "cron-job-with-gmsa"))
+}
+
+func TestAuditEnforcementModeAdmitsViolatingPods(t *testing.T) {
+	testName := "audit-enforcement-mode-admits-violating-pods"
+	credSpecTemplates := []string{"credspec-0"}
+	templates := []string{"credspecs-users-rbac-role", "service-account"}
+
+	testConfig, tearDownFunc := integrationTestSetup(t, testName, credSpecTemplates, templates)
+	defer tearDownFunc()
+
+	// the service account doesn't have `use` access to the cred spec, but that shouldn't be enforced
+	labelNamespace(t, testConfig.Namespace, "windows.k8s.io/gmsa-enforcement-mode", "audit")
+	applyManifestOrFail(t, renderTemplate(t, testConfig, "simple-with-gmsa"))
+
+	pod := waitForPodToComeUp(t, testConfig.Namespace, "app="+testName)
+
+	assert.Equal(t, expectedCredSpec0, pod.Annotations["pod.alpha.windows.kubernetes.io/gmsa-credential-spec"])
+}
+
+func TestGMSAGrantGivesAccessToCredSpec(t *testing.T) {
+	testName := "gmsa-grant-gives-access-to-cred-spec"
+	credSpecTemplates := []string{"credspec-0"}
+	templates := []string{"service-account", "gmsa-grant"}
+
+	testConfig, tearDownFunc := integrationTestSetup(t, testName, credSpecTemplates, templates)
+	defer tearDownFunc()
+
+	roleBinding := waitForRoleBinding(t, testConfig.Namespace, "windows.k8s.io/gmsa-grant="+testName+"-grant")
+	if assert.Equal(t, 1, len(roleBinding.Subjects)) {
+		assert.Equal(t, testConfig.ServiceAccountName, roleBinding.Subjects[0].Name)
+	}
+
+	applyManifestOrFail(t, renderTemplate(t, testConfig, "simple-with-gmsa"))
+
+	pod := waitForPodToComeUp(t, testConfig.Namespace, "app="+testName)
+
+	assert.Equal(t, expectedCredSpec0, pod.Annotations["pod.alpha.windows.kubernetes.io/gmsa-credential-spec"])
+
+	// deleting the grant should revoke access
+	runKubectlCommandOrFail(t, "delete", "gmsagrant", testName+"-grant", "--namespace", testConfig.Namespace)
+	pollingFunc := func(_ poll.LogT) poll.Result {
+		roleBindings, err := kubeClient(t).RbacV1().RoleBindings(testConfig.Namespace).List(metav1.ListOptions{LabelSelector: "windows.k8s.io/gmsa-grant=" + testName + "-grant"})
+		if err != nil {
+			return poll.Error(err)
+		}
+		if len(roleBindings.Items) != 0 {
+			return poll.Continue("role binding for grant %s still exists", testName+"-grant")
+		}
+		return poll.Success()
+	}
+	poll.WaitOn(t, pollingFunc)
+
+	assertManifestDenied(t, renderTemplate(t, testConfig, "single-pod-with-gmsa"),
+		fmt.Sprintf("service account %s does not have `use` access to the %s gMSA cred spec", testConfig.ServiceAccountName, testConfig.CredSpecNames[0]))
+}
+
+func TestCredSpecUsageIsReportedInStatus(t *testing.T) {
+	testName := "cred-spec-usage-is-reported-in-status"
+	credSpecTemplates := []string{"credspec-0"}
+	templates := []string{"credspecs-users-rbac-role", "service-account", "sa-rbac-binding", "simple-with-gmsa"}
+
+	testConfig, tearDownFunc := integrationTestSetup(t, testName, credSpecTemplates, templates)
+	defer tearDownFunc()
+
+	waitForPodToComeUp(t, testConfig.Namespace, "app="+testName)
+
+	pollingFunc := func(_ poll.LogT) poll.Result {
+		success, stdout, stderr := runKubectlCommand(t, "get", "gmsacredentialspec", testConfig.CredSpecNames[0],
+			"-o", "jsonpath={.status.usage.podCount} {.status.usage.namespaces[*]} {.status.usage.workloads[*].name}")
+		if !success {
+			return poll.Error(fmt.Errorf("unable to get cred spec %s: %s", testConfig.CredSpecNames[0], stderr))
+		}
+		if expected := fmt.Sprintf("1 %s %s", testConfig.Namespace, testName); strings.TrimSpace(stdout) != expected {
+			return poll.Continue("expected usage %q, got %q", expected, stdout)
+		}
+		return poll.Success()
+	}
+	poll.WaitOn(t, pollingFunc)
+}
+
 /* Helpers */
 
+// assertManifestDenied asserts that applying the given manifest fails, with an error
+// containing all the expected substrings.
+func assertManifestDenied(t *testing.T, path string, expectedSubstrs ...string) {
+	success, _, stderr := applyManifest(t, path)
+	if assert.False(t, success) {
+		for _, expectedSubstr := range expectedSubstrs {
+			assert.Contains(t, stderr, expectedSubstr)
+		}
+	}
+}
+
 type testConfig struct {
 	TestName           string
 	Namespace          string
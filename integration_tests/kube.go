@@ -9,6 +9,7 @@ import (
 	"gotest.tools/poll"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
@@ -96,6 +97,25 @@ func waitForReplicaSetGen1(t *testing.T, namespace, selector string, pollOps ...
 	return replicaSet
 }
 
+// waitForRoleBinding waits for a role binding matching `selector` to come up in `namespace`, and returns it.
+func waitForRoleBinding(t *testing.T, namespace, selector string, pollOps ...poll.SettingOp) *rbacv1.RoleBinding {
+	fetcher := func(client kubernetes.Interface, listOptions metav1.ListOptions) ([]interface{}, error) {
+		roleBindingList, err := client.RbacV1().RoleBindings(namespace).List(listOptions)
+		if err == nil {
+			result := make([]interface{}, len(roleBindingList.Items))
+			for i, item := range roleBindingList.Items {
+				result[i] = item
+			}
+			return result, nil
+		}
+		return nil, err
+	}
+
+	rawRoleBinding := waitForKubeObject(t, fetcher, namespace, selector, "role binding", pollOps...)
+	roleBinding := rawRoleBinding.(rbacv1.RoleBinding)
+	return &roleBinding
+}
+
 // waitForKubeObject waits for fetcher to return a list of one object matching `selector` in `namespace`, and returns it.
 func waitForKubeObject(t *testing.T, fetcher func(kubernetes.Interface, metav1.ListOptions) ([]interface{}, error), namespace, selector, displayableName string, pollOps ...poll.SettingOp) (object interface{}) {
 	client := kubeClient(t)
@@ -125,6 +145,31 @@ func waitForKubeObject(t *testing.T, fetcher func(kubernetes.Interface, metav1.L
 	return
 }
 
+// waitForEvent waits for an event with the given reason to be emitted about the object named `involvedObjectName`
+// in `namespace`, and returns it.
+func waitForEvent(t *testing.T, namespace, involvedObjectName, reason string, pollOps ...poll.SettingOp) *corev1.Event {
+	client := kubeClient(t)
+	listOptions := metav1.ListOptions{FieldSelector: "involvedObject.name=" + involvedObjectName + ",reason=" + reason}
+	var event *corev1.Event
+
+	pollingFunc := func(_ poll.LogT) poll.Result {
+		eventList, err := client.CoreV1().Events(namespace).List(listOptions)
+		if err != nil {
+			return poll.Error(err)
+		}
+
+		if len(eventList.Items) == 0 {
+			return poll.Continue("no %s event for %s in namespace %s", reason, involvedObjectName, namespace)
+		}
+		event = &eventList.Items[0]
+		return poll.Success()
+	}
+
+	poll.WaitOn(t, pollingFunc, pollOps...)
+
+	return event
+}
+
 const testNamespacePrefix = "gmsa-webhook-test-"
 
 // createNamespace creates a new namespace, and fails the test if it already exists.
@@ -143,6 +188,14 @@ func deleteNamespace(t *testing.T, name string) {
 	runKubectlCommandOrFail(t, "delete", "namespace", name)
 }
 
+func annotateNamespace(t *testing.T, name, key, value string) {
+	runKubectlCommandOrFail(t, "annotate", "namespace", name, key+"="+value)
+}
+
+func labelNamespace(t *testing.T, name, key, value string) {
+	runKubectlCommandOrFail(t, "label", "namespace", name, key+"="+value)
+}
+
 func applyManifestOrFail(t *testing.T, path string) {
 	runKubectlCommandOrFail(t, "apply", "-f", path)
 }
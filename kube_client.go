@@ -4,13 +4,32 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	appsv1 "k8s.io/api/apps/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
 	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/kubernetes/pkg/serviceaccount"
 )
 
@@ -26,12 +45,33 @@ const (
 
 	// notFound is used in `isNotFoundError` below
 	notFound = "not found"
+
+	// eventSourceComponent is the source component of the events we emit
+	eventSourceComponent = "gmsa-admission-webhook"
+
+	// informersResyncPeriod is how often informers re-list the objects they watch
+	informersResyncPeriod = 10 * time.Minute
+	// missingCRDPollPeriod is how often informers watching resources whose CRD is not installed
+	// check whether it's been installed since
+	missingCRDPollPeriod = time.Minute
 )
 
 // kubeClient centralizes all the operations we need when talking to k8s
 type kubeClient struct {
 	coreClient    kubernetes.Interface
 	dynamicClient dynamic.Interface
+	eventRecorder record.EventRecorder
+
+	// informers keep local caches of the objects we need to look up on every request
+	informerFactory      informers.SharedInformerFactory
+	namespaceLister      corelisters.NamespaceLister
+	serviceAccountLister corelisters.ServiceAccountLister
+	// dynamicInformers watch our CRDs, keyed by resource name; they're only created if something
+	// needs them, see dynamicInformer
+	dynamicInformers map[string]cache.SharedIndexInformer
+	// podsInformer watches pods across the whole cluster, which can be expensive; so it's nil
+	// unless one of the enabled controllers needs it, see watchGMSAPods
+	podsInformer cache.SharedIndexInformer
 }
 
 func newKubeClient(config *rest.Config) (*kubeClient, error) {
@@ -45,22 +85,92 @@ func newKubeClient(config *rest.Config) (*kubeClient, error) {
 		return nil, err
 	}
 
-	return &kubeClient{
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: coreClient.CoreV1().Events("")})
+	eventRecorder := eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventSourceComponent})
+
+	informerFactory := informers.NewSharedInformerFactory(coreClient, informersResyncPeriod)
+
+	kc := &kubeClient{
 		coreClient:    coreClient,
 		dynamicClient: dynamicClient,
-	}, nil
+		eventRecorder: eventRecorder,
+
+		informerFactory:      informerFactory,
+		namespaceLister:      informerFactory.Core().V1().Namespaces().Lister(),
+		serviceAccountLister: informerFactory.Core().V1().ServiceAccounts().Lister(),
+		dynamicInformers:     make(map[string]cache.SharedIndexInformer),
+	}
+	// GMSA policies are looked up on every admission request, and so are the labels of the cred
+	// specs they select
+	kc.dynamicInformer(policyCRDResourceName)
+	kc.dynamicInformer(crdResourceName)
+
+	return kc, nil
+}
+
+// startInformers starts the informers backing the client's listers, and waits for their caches
+// to be populated.
+func (kc *kubeClient) startInformers(stopCh <-chan struct{}) error {
+	kc.informerFactory.Start(stopCh)
+	for _, informer := range kc.dynamicInformers {
+		go informer.Run(stopCh)
+	}
+
+	for informerType, synced := range kc.informerFactory.WaitForCacheSync(stopCh) {
+		if !synced {
+			return fmt.Errorf("unable to populate the cache of the %v informer", informerType)
+		}
+	}
+	for resource, informer := range kc.dynamicInformers {
+		if !cache.WaitForCacheSync(stopCh, informer.HasSynced) {
+			return fmt.Errorf("unable to populate the cache of the %s informer", resource)
+		}
+	}
+	return nil
 }
 
 // isAuthorizedToReadConfigMap checks whether a given service account is authorized to `use` a given cred spec.
 func (kc *kubeClient) isAuthorizedToUseCredSpec(serviceAccountName, namespace, credSpecName string) (bool, string) {
+	authorized, reason, err := kc.checkCredSpecUseAuthorization(serviceAccountName, namespace, credSpecName)
+	if err != nil {
+		return false, err.Error()
+	}
+	return authorized, reason
+}
+
+// checkCredSpecUseAuthorization is the same as isAuthorizedToUseCredSpec, except that it tells
+// apart failing to check access from being denied access.
+func (kc *kubeClient) checkCredSpecUseAuthorization(serviceAccountName, namespace, credSpecName string) (bool, string, error) {
 	servceAccountUserInfo := serviceaccount.UserInfo(namespace, serviceAccountName, "")
 
 	// needed to cast `authorizationv1.ExtraValue` to `[]string`
-	var extra map[string]authorizationv1.ExtraValue
+	extra := make(map[string]authorizationv1.ExtraValue)
 	for k, v := range servceAccountUserInfo.GetExtra() {
 		extra[k] = v
 	}
 
+	return kc.createCredSpecUseAccessReview(servceAccountUserInfo.GetName(), servceAccountUserInfo.GetGroups(), servceAccountUserInfo.GetUID(), extra, namespace, credSpecName)
+}
+
+// isUserAuthorizedToUseCredSpec is the same as isAuthorizedToUseCredSpec, for any user, e.g.
+// the one making an admission request.
+func (kc *kubeClient) isUserAuthorizedToUseCredSpec(userInfo authenticationv1.UserInfo, namespace, credSpecName string) (bool, string) {
+	extra := make(map[string]authorizationv1.ExtraValue)
+	for k, v := range userInfo.Extra {
+		extra[k] = authorizationv1.ExtraValue(v)
+	}
+
+	authorized, reason, err := kc.createCredSpecUseAccessReview(userInfo.Username, userInfo.Groups, userInfo.UID, extra, namespace, credSpecName)
+	if err != nil {
+		return false, err.Error()
+	}
+	return authorized, reason
+}
+
+// createCredSpecUseAccessReview checks whether the given user has `use` access to a cred spec
+// in a namespace.
+func (kc *kubeClient) createCredSpecUseAccessReview(user string, groups []string, uid string, extra map[string]authorizationv1.ExtraValue, namespace, credSpecName string) (bool, string, error) {
 	subjectAccessReview := authorizationv1.LocalSubjectAccessReview{
 		ObjectMeta: metav1.ObjectMeta{
 			Namespace: namespace,
@@ -74,18 +184,18 @@ func (kc *kubeClient) isAuthorizedToUseCredSpec(serviceAccountName, namespace, c
 				Resource:  crdResourceName,
 				Name:      credSpecName,
 			},
-			User:   servceAccountUserInfo.GetName(),
-			Groups: servceAccountUserInfo.GetGroups(),
-			UID:    servceAccountUserInfo.GetUID(),
+			User:   user,
+			Groups: groups,
+			UID:    uid,
 			Extra:  extra,
 		},
 	}
 
 	response, err := kc.coreClient.AuthorizationV1().LocalSubjectAccessReviews(namespace).Create(&subjectAccessReview)
 	if err != nil {
-		return false, fmt.Sprintf("error when checking authz access: %v", err.Error())
+		return false, "", fmt.Errorf("error when checking authz access: %v", err.Error())
 	}
-	return response.Status.Allowed && !response.Status.Denied, response.Status.Reason
+	return response.Status.Allowed && !response.Status.Denied, response.Status.Reason, nil
 }
 
 // retrieveCredSpecContents fetches the actual contents of a cred spec.
@@ -116,6 +226,518 @@ func (kc *kubeClient) retrieveCredSpecContents(credSpecName string) (string, int
 	return string(contentsBytes), 0, nil
 }
 
+// retrieveCredSpecLabels fetches the labels of a cred spec, from the informer's cache if possible.
+// If it returns an error, it also returns the corresponding HTTP code
+func (kc *kubeClient) retrieveCredSpecLabels(credSpecName string) (map[string]string, int, error) {
+	credSpec, exists, err := kc.retrieveCachedCredSpec(credSpecName)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if !exists {
+		// the cache might not have caught up yet with a cred spec created right before the pod
+		resource := schema.GroupVersionResource{
+			Group:    crdAPIGroup,
+			Version:  crdAPIVersion,
+			Resource: crdResourceName,
+		}
+		if credSpec, err = kc.dynamicClient.Resource(resource).Get(credSpecName, metav1.GetOptions{}); err != nil {
+			if isNotFoundError(err) {
+				return nil, http.StatusNotFound, fmt.Errorf("cred spec %s does not exist", credSpecName)
+			}
+			return nil, http.StatusInternalServerError, fmt.Errorf("unable to retrieve the labels of cred spec %s: %v", credSpecName, err)
+		}
+	}
+
+	return credSpec.GetLabels(), 0, nil
+}
+
+// retrieveNamespace fetches a namespace object, from the informer's cache if possible.
+// The returned object is shared with the cache, and must not be modified.
+// If it returns an error, it also returns the corresponding HTTP code
+func (kc *kubeClient) retrieveNamespace(name string) (*corev1.Namespace, int, error) {
+	namespace, err := kc.namespaceLister.Get(name)
+	if apierrors.IsNotFound(err) {
+		// the cache might not have caught up yet with a namespace created right before the pod
+		namespace, err = kc.coreClient.CoreV1().Namespaces().Get(name, metav1.GetOptions{})
+	}
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, http.StatusNotFound, fmt.Errorf("namespace %s does not exist", name)
+		}
+		return nil, http.StatusInternalServerError, fmt.Errorf("unable to retrieve namespace %s: %v", name, err)
+	}
+	return namespace, 0, nil
+}
+
+// listGMSAPolicies fetches all the GMSA policies defined in a namespace from the informer's cache;
+// there are none if the GMSA policy CRD is not installed.
+// If it returns an error, it also returns the corresponding HTTP code
+func (kc *kubeClient) listGMSAPolicies(namespace string) ([]*gmsaPolicy, int, error) {
+	items, err := kc.dynamicInformer(policyCRDResourceName).GetIndexer().ByIndex(cache.NamespaceIndex, namespace)
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("unable to list %s objects in namespace %s: %v", policyCRDKind, namespace, err)
+	}
+
+	policies := make([]*gmsaPolicy, len(items))
+	for i, item := range items {
+		object := item.(*unstructured.Unstructured)
+		policies[i] = &gmsaPolicy{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(object.Object, policies[i]); err != nil {
+			return nil, http.StatusInternalServerError, fmt.Errorf("unable to parse %s %s/%s: %v", policyCRDKind, namespace, object.GetName(), err)
+		}
+	}
+
+	return policies, 0, nil
+}
+
+// retrieveServiceAccount fetches a service account object, from the informer's cache if possible.
+// The returned object is shared with the cache, and must not be modified.
+// If it returns an error, it also returns the corresponding HTTP code
+func (kc *kubeClient) retrieveServiceAccount(namespace, name string) (*corev1.ServiceAccount, int, error) {
+	serviceAccount, err := kc.serviceAccountLister.ServiceAccounts(namespace).Get(name)
+	if apierrors.IsNotFound(err) {
+		// the cache might not have caught up yet with a service account created right before the pod
+		serviceAccount, err = kc.coreClient.CoreV1().ServiceAccounts(namespace).Get(name, metav1.GetOptions{})
+	}
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, http.StatusNotFound, fmt.Errorf("service account %s/%s does not exist", namespace, name)
+		}
+		return nil, http.StatusInternalServerError, fmt.Errorf("unable to retrieve service account %s/%s: %v", namespace, name, err)
+	}
+	return serviceAccount, 0, nil
+}
+
+// dynamicInformer returns the informer watching the given resource from our API group across all
+// namespaces, creating it on first use; like other informers, it must be created before
+// startInformers gets called. If the resource's CRD is not installed, the informer considers
+// that there are no such objects, until it gets installed.
+func (kc *kubeClient) dynamicInformer(resourceName string) cache.SharedIndexInformer {
+	if _, present := kc.dynamicInformers[resourceName]; !present {
+		resource := kc.dynamicClient.Resource(schema.GroupVersionResource{
+			Group:    crdAPIGroup,
+			Version:  crdAPIVersion,
+			Resource: resourceName,
+		})
+
+		kc.dynamicInformers[resourceName] = cache.NewSharedIndexInformer(
+			&cache.ListWatch{
+				ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+					list, err := resource.List(options)
+					if apierrors.IsNotFound(err) {
+						return &unstructured.UnstructuredList{}, nil
+					}
+					return list, err
+				},
+				WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+					w, err := resource.Watch(options)
+					if apierrors.IsNotFound(err) {
+						// there's nothing to watch, and failing would make the informer retry
+						// and log about it right away; instead, it re-lists once that watch ends
+						return newMissingCRDWatch(), nil
+					}
+					return w, err
+				},
+			},
+			&unstructured.Unstructured{},
+			informersResyncPeriod,
+			cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
+		)
+	}
+	return kc.dynamicInformers[resourceName]
+}
+
+// newMissingCRDWatch returns a watch that doesn't emit any event, and ends after
+// missingCRDPollPeriod.
+func newMissingCRDWatch() watch.Interface {
+	w := watch.NewFake()
+	time.AfterFunc(missingCRDPollPeriod, w.Stop)
+	return w
+}
+
+// watchGMSAGrants registers an event handler for GMSA grants.
+func (kc *kubeClient) watchGMSAGrants(handler cache.ResourceEventHandler) {
+	kc.dynamicInformer(grantCRDResourceName).AddEventHandler(handler)
+}
+
+// retrieveGMSAGrant fetches a GMSA grant from the informer's cache; it returns nil if it
+// doesn't exist.
+func (kc *kubeClient) retrieveGMSAGrant(namespace, name string) (*gmsaGrant, error) {
+	item, exists, err := kc.dynamicInformer(grantCRDResourceName).GetIndexer().GetByKey(namespace + "/" + name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve %s %s/%s: %v", grantCRDKind, namespace, name, err)
+	}
+	if !exists {
+		return nil, nil
+	}
+
+	grant := &gmsaGrant{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.(*unstructured.Unstructured).Object, grant); err != nil {
+		return nil, fmt.Errorf("unable to parse %s %s/%s: %v", grantCRDKind, namespace, name, err)
+	}
+	return grant, nil
+}
+
+// updateGMSAGrantStatus updates a GMSA grant's status subresource.
+func (kc *kubeClient) updateGMSAGrantStatus(grant *gmsaGrant) error {
+	object, err := runtime.DefaultUnstructuredConverter.ToUnstructured(grant)
+	if err == nil {
+		resource := schema.GroupVersionResource{
+			Group:    crdAPIGroup,
+			Version:  crdAPIVersion,
+			Resource: grantCRDResourceName,
+		}
+		_, err = kc.dynamicClient.Resource(resource).Namespace(grant.Namespace).UpdateStatus(&unstructured.Unstructured{Object: object}, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return fmt.Errorf("unable to update the status of %s %s/%s: %v", grantCRDKind, grant.Namespace, grant.Name, err)
+	}
+	return nil
+}
+
+// retrieveRole fetches a role; it returns nil if it doesn't exist.
+func (kc *kubeClient) retrieveRole(namespace, name string) (*rbacv1.Role, error) {
+	role, err := kc.coreClient.RbacV1().Roles(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unable to retrieve role %s/%s: %v", namespace, name, err)
+	}
+	return role, nil
+}
+
+// saveRole creates a role if it doesn't have a resource version yet, and updates it otherwise.
+func (kc *kubeClient) saveRole(role *rbacv1.Role) (err error) {
+	if role.ResourceVersion == "" {
+		_, err = kc.coreClient.RbacV1().Roles(role.Namespace).Create(role)
+	} else {
+		_, err = kc.coreClient.RbacV1().Roles(role.Namespace).Update(role)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to save role %s/%s: %v", role.Namespace, role.Name, err)
+	}
+	return nil
+}
+
+// deleteRole deletes a role, if it exists.
+func (kc *kubeClient) deleteRole(namespace, name string) error {
+	if err := kc.coreClient.RbacV1().Roles(namespace).Delete(name, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("unable to delete role %s/%s: %v", namespace, name, err)
+	}
+	return nil
+}
+
+// retrieveRoleBinding fetches a role binding; it returns nil if it doesn't exist.
+func (kc *kubeClient) retrieveRoleBinding(namespace, name string) (*rbacv1.RoleBinding, error) {
+	roleBinding, err := kc.coreClient.RbacV1().RoleBindings(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unable to retrieve role binding %s/%s: %v", namespace, name, err)
+	}
+	return roleBinding, nil
+}
+
+// saveRoleBinding creates a role binding if it doesn't have a resource version yet, and updates
+// it otherwise.
+func (kc *kubeClient) saveRoleBinding(roleBinding *rbacv1.RoleBinding) (err error) {
+	if roleBinding.ResourceVersion == "" {
+		_, err = kc.coreClient.RbacV1().RoleBindings(roleBinding.Namespace).Create(roleBinding)
+	} else {
+		_, err = kc.coreClient.RbacV1().RoleBindings(roleBinding.Namespace).Update(roleBinding)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to save role binding %s/%s: %v", roleBinding.Namespace, roleBinding.Name, err)
+	}
+	return nil
+}
+
+// deleteRoleBinding deletes a role binding, if it exists.
+func (kc *kubeClient) deleteRoleBinding(namespace, name string) error {
+	if err := kc.coreClient.RbacV1().RoleBindings(namespace).Delete(name, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("unable to delete role binding %s/%s: %v", namespace, name, err)
+	}
+	return nil
+}
+
+// watchGMSACredSpecs registers an event handler for GMSA cred specs.
+func (kc *kubeClient) watchGMSACredSpecs(handler cache.ResourceEventHandler) {
+	kc.dynamicInformer(crdResourceName).AddEventHandler(handler)
+}
+
+// watchGMSAPods registers an event handler for pods, creating the informer watching pods across
+// all namespaces, with pods indexed by the names of the cred specs they use, if needed; like
+// other informers, it must be created before startInformers gets called.
+func (kc *kubeClient) watchGMSAPods(handler cache.ResourceEventHandler) error {
+	if kc.podsInformer == nil {
+		informer := kc.informerFactory.Core().V1().Pods().Informer()
+		if err := informer.AddIndexers(cache.Indexers{credSpecNamePodIndex: credSpecNamesIndexFunc}); err != nil {
+			return fmt.Errorf("unable to index pods by cred spec name: %v", err)
+		}
+		kc.podsInformer = informer
+	}
+	kc.podsInformer.AddEventHandler(handler)
+	return nil
+}
+
+// cachedPods returns the cache of the pods informer, which only exists if pods are watched.
+func (kc *kubeClient) cachedPods() (cache.Indexer, error) {
+	if kc.podsInformer == nil {
+		return nil, fmt.Errorf("pods are not being watched")
+	}
+	return kc.podsInformer.GetIndexer(), nil
+}
+
+// listPodsUsingCredSpec returns the pods from the informer's cache that use the given cred spec.
+// The returned objects are shared with the cache, and must not be modified.
+func (kc *kubeClient) listPodsUsingCredSpec(credSpecName string) ([]*corev1.Pod, error) {
+	pods, err := kc.cachedPods()
+	if err != nil {
+		return nil, err
+	}
+	items, err := pods.ByIndex(credSpecNamePodIndex, credSpecName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list pods using cred spec %s: %v", credSpecName, err)
+	}
+
+	credSpecPods := make([]*corev1.Pod, 0, len(items))
+	for _, item := range items {
+		if pod, ok := item.(*corev1.Pod); ok {
+			credSpecPods = append(credSpecPods, pod)
+		}
+	}
+	return credSpecPods, nil
+}
+
+// listGMSAPods returns the pods from the informer's cache that use at least one cred spec.
+// The returned objects are shared with the cache, and must not be modified.
+func (kc *kubeClient) listGMSAPods() ([]*corev1.Pod, error) {
+	cachedPods, err := kc.cachedPods()
+	if err != nil {
+		return nil, err
+	}
+
+	var pods []*corev1.Pod
+	seen := make(map[types.UID]bool)
+	for _, credSpecName := range cachedPods.ListIndexFuncValues(credSpecNamePodIndex) {
+		credSpecPods, err := kc.listPodsUsingCredSpec(credSpecName)
+		if err != nil {
+			return nil, err
+		}
+		for _, pod := range credSpecPods {
+			if !seen[pod.UID] {
+				seen[pod.UID] = true
+				pods = append(pods, pod)
+			}
+		}
+	}
+	return pods, nil
+}
+
+// retrieveCachedPod fetches a pod from the informer's cache; it returns nil if it doesn't exist.
+// The returned object is shared with the cache, and must not be modified.
+func (kc *kubeClient) retrieveCachedPod(namespace, name string) (*corev1.Pod, error) {
+	pods, err := kc.cachedPods()
+	if err != nil {
+		return nil, err
+	}
+	item, exists, err := pods.GetByKey(namespace + "/" + name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve pod %s/%s: %v", namespace, name, err)
+	}
+	if !exists {
+		return nil, nil
+	}
+	return item.(*corev1.Pod), nil
+}
+
+// evictPod evicts a pod through the eviction API, so that pod disruption budgets are honored.
+func (kc *kubeClient) evictPod(pod *corev1.Pod) error {
+	eviction := &policyv1beta1.Eviction{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pod.Name,
+			Namespace: pod.Namespace,
+		},
+		DeleteOptions: &metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{UID: &pod.UID},
+		},
+	}
+	if err := kc.coreClient.CoreV1().Pods(pod.Namespace).Evict(eviction); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("unable to evict pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	}
+	return nil
+}
+
+// retrieveCredSpecUsage fetches the usage reported in a cred spec's status from the informer's
+// cache; it returns false if the cred spec doesn't exist, and a nil usage if it has none yet.
+func (kc *kubeClient) retrieveCredSpecUsage(credSpecName string) (*credSpecUsage, bool, error) {
+	return kc.retrieveCredSpecStatusUsage(credSpecName, credSpecUsageStatusField)
+}
+
+// updateCredSpecUsage updates the usage reported in a cred spec's status subresource; it's a
+// no-op if the cred spec doesn't exist.
+func (kc *kubeClient) updateCredSpecUsage(credSpecName string, usage *credSpecUsage) error {
+	return kc.updateCredSpecStatusUsage(credSpecName, credSpecUsageStatusField, usage)
+}
+
+// retrieveCredSpecStalePods is the same as retrieveCredSpecUsage, for the pods running with
+// outdated contents of the cred spec.
+func (kc *kubeClient) retrieveCredSpecStalePods(credSpecName string) (*credSpecUsage, bool, error) {
+	return kc.retrieveCredSpecStatusUsage(credSpecName, credSpecStalePodsStatusField)
+}
+
+// updateCredSpecStalePods is the same as updateCredSpecUsage, for the pods running with
+// outdated contents of the cred spec.
+func (kc *kubeClient) updateCredSpecStalePods(credSpecName string, stale *credSpecUsage) error {
+	return kc.updateCredSpecStatusUsage(credSpecName, credSpecStalePodsStatusField, stale)
+}
+
+func (kc *kubeClient) retrieveCredSpecStatusUsage(credSpecName, field string) (*credSpecUsage, bool, error) {
+	credSpec, exists, err := kc.retrieveCachedCredSpec(credSpecName)
+	if err != nil || !exists {
+		return nil, exists, err
+	}
+
+	rawUsage, found, err := unstructured.NestedMap(credSpec.Object, "status", field)
+	if err != nil || !found {
+		// invalid usages just get overwritten
+		return nil, true, nil
+	}
+	usage := &credSpecUsage{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(rawUsage, usage); err != nil {
+		return nil, true, nil
+	}
+	return usage, true, nil
+}
+
+func (kc *kubeClient) updateCredSpecStatusUsage(credSpecName, field string, usage *credSpecUsage) error {
+	credSpec, exists, err := kc.retrieveCachedCredSpec(credSpecName)
+	if err != nil || !exists {
+		return err
+	}
+
+	rawUsage, err := runtime.DefaultUnstructuredConverter.ToUnstructured(usage)
+	if err == nil {
+		credSpec = credSpec.DeepCopy()
+		if err = unstructured.SetNestedMap(credSpec.Object, rawUsage, "status", field); err == nil {
+			resource := schema.GroupVersionResource{
+				Group:    crdAPIGroup,
+				Version:  crdAPIVersion,
+				Resource: crdResourceName,
+			}
+			_, err = kc.dynamicClient.Resource(resource).UpdateStatus(credSpec, metav1.UpdateOptions{})
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("unable to update the %s of cred spec %s: %v", field, credSpecName, err)
+	}
+	return nil
+}
+
+// retrieveCachedCredSpecContents is the same as retrieveCredSpecContents, except that it reads
+// from the informer's cache, and also returns the cred spec's annotations; it returns false if
+// the cred spec doesn't exist, and empty contents if it has none.
+func (kc *kubeClient) retrieveCachedCredSpecContents(credSpecName string) (string, map[string]string, bool, error) {
+	credSpec, exists, err := kc.retrieveCachedCredSpec(credSpecName)
+	if err != nil || !exists {
+		return "", nil, exists, err
+	}
+
+	if contents, present := credSpec.Object[crdContentsField]; !present || contents == "" {
+		return "", credSpec.GetAnnotations(), true, nil
+	}
+	contentsBytes, err := json.Marshal(credSpec.Object[crdContentsField])
+	if err != nil {
+		return "", nil, true, fmt.Errorf("unable to marshall cred spec %s into a JSON: %v", credSpecName, err)
+	}
+	return string(contentsBytes), credSpec.GetAnnotations(), true, nil
+}
+
+// restartWorkload triggers a rollout restart of the given deployment or stateful set, unless
+// it's already been restarted for that revision of the cred spec; it returns whether it did
+// restart it. Workloads of other kinds, as well as workloads that don't exist, are ignored.
+func (kc *kubeClient) restartWorkload(namespace, kind, name, credSpecName, revision string) (bool, error) {
+	var (
+		template *corev1.PodTemplateSpec
+		update   func() error
+		err      error
+	)
+	switch kind {
+	case "Deployment":
+		var deployment *appsv1.Deployment
+		if deployment, err = kc.coreClient.AppsV1().Deployments(namespace).Get(name, metav1.GetOptions{}); err == nil {
+			template = &deployment.Spec.Template
+			update = func() error {
+				_, err := kc.coreClient.AppsV1().Deployments(namespace).Update(deployment)
+				return err
+			}
+		}
+	case "StatefulSet":
+		var statefulSet *appsv1.StatefulSet
+		if statefulSet, err = kc.coreClient.AppsV1().StatefulSets(namespace).Get(name, metav1.GetOptions{}); err == nil {
+			template = &statefulSet.Spec.Template
+			update = func() error {
+				_, err := kc.coreClient.AppsV1().StatefulSets(namespace).Update(statefulSet)
+				return err
+			}
+		}
+	default:
+		return false, nil
+	}
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("unable to retrieve %s %s/%s: %v", kind, namespace, name, err)
+	}
+
+	if !markTemplateRestarted(template, credSpecName, revision, time.Now()) {
+		return false, nil
+	}
+	if err := update(); err != nil {
+		return false, fmt.Errorf("unable to restart %s %s/%s: %v", kind, namespace, name, err)
+	}
+	return true, nil
+}
+
+func (kc *kubeClient) retrieveCachedCredSpec(credSpecName string) (*unstructured.Unstructured, bool, error) {
+	item, exists, err := kc.dynamicInformer(crdResourceName).GetIndexer().GetByKey(credSpecName)
+	if err != nil {
+		return nil, false, fmt.Errorf("unable to retrieve cred spec %s: %v", credSpecName, err)
+	}
+	if !exists {
+		return nil, false, nil
+	}
+	return item.(*unstructured.Unstructured), true, nil
+}
+
+// recordEvent asynchronously emits an event about the given object.
+func (kc *kubeClient) recordEvent(object *corev1.ObjectReference, eventType, reason, message string) {
+	kc.eventRecorder.Event(object, eventType, reason, message)
+}
+
+// serverVersion returns the API server's major and minor versions.
+func (kc *kubeClient) serverVersion() (int, int, error) {
+	info, err := kc.coreClient.Discovery().ServerVersion()
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to retrieve the API server's version: %v", err)
+	}
+
+	// some providers append non-numeric suffixes to version numbers, e.g. "13+"
+	major, err := strconv.Atoi(strings.TrimRight(info.Major, "+"))
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to parse API server major version %q: %v", info.Major, err)
+	}
+	minor, err := strconv.Atoi(strings.TrimRight(info.Minor, "+"))
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to parse API server minor version %q: %v", info.Minor, err)
+	}
+
+	return major, minor, nil
+}
+
 // isNotFoundError returns true if the error indicates "not found".  It parses
 // the error string looking for known values, which is imperfect but works in
 // practice; and there's not much better we can do right now with k8s' dynamic client API
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	leaderElectionLeaseDuration = 15 * time.Second
+	leaderElectionRenewDeadline = 10 * time.Second
+	leaderElectionRetryPeriod   = 2 * time.Second
+)
+
+type leaderElectionConfig struct {
+	// enabled controls whether controllers only run on the replica holding the lock; it should
+	// be enabled whenever running several replicas, so that they don't fight each other
+	enabled bool
+	// namespace and lockName are the coordinates of the config map used as a lock
+	namespace string
+	lockName  string
+	// identity identifies this replica in the lock, typically its pod's name
+	identity string
+}
+
+// runControllers is a blocking call that runs the given controllers until `stopCh` gets closed.
+// If leader election is enabled, it first waits to acquire the lock; a replica losing it exits,
+// rather than risking running its controllers at the same time as the new leader.
+func runControllers(kc *kubeClient, config *leaderElectionConfig, stopCh <-chan struct{}, controllers ...runnableController) error {
+	run := func(stopCh <-chan struct{}) {
+		var wg sync.WaitGroup
+		for _, c := range controllers {
+			wg.Add(1)
+			go func(c runnableController) {
+				defer wg.Done()
+				c.run(stopCh)
+			}(c)
+		}
+		wg.Wait()
+	}
+
+	if !config.enabled {
+		run(stopCh)
+		return nil
+	}
+
+	lock, err := resourcelock.New(resourcelock.ConfigMapsResourceLock, config.namespace, config.lockName, kc.coreClient.CoreV1(), resourcelock.ResourceLockConfig{
+		Identity:      config.identity,
+		EventRecorder: kc.eventRecorder,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to create leader election lock %s/%s: %v", config.namespace, config.lockName, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+
+	logrus.Infof("waiting to acquire leader election lock %s/%s as %s", config.namespace, config.lockName, config.identity)
+	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: leaderElectionLeaseDuration,
+		RenewDeadline: leaderElectionRenewDeadline,
+		RetryPeriod:   leaderElectionRetryPeriod,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				logrus.Infof("acquired leader election lock %s/%s", config.namespace, config.lockName)
+				run(ctx.Done())
+			},
+			OnStoppedLeading: func() {
+				select {
+				case <-stopCh:
+				default:
+					logrus.Fatalf("lost leader election lock %s/%s", config.namespace, config.lockName)
+				}
+			},
+			OnNewLeader: func(identity string) {
+				if identity != config.identity {
+					logrus.Infof("%s is now the controllers' leader", identity)
+				}
+			},
+		},
+	})
+
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// logFormat controls how log entries get formatted.
+type logFormat string
+
+const (
+	logFormatText logFormat = "text"
+	logFormatJSON logFormat = "json"
+)
+
+// parseLogFormat parses a string into a logFormat.
+func parseLogFormat(raw string) (logFormat, error) {
+	switch format := logFormat(strings.ToLower(raw)); format {
+	case logFormatText, logFormatJSON:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown log format %q, valid formats are: %s, %s", raw, logFormatText, logFormatJSON)
+	}
+}
+
+func (format logFormat) formatter() logrus.Formatter {
+	if format == logFormatJSON {
+		return &logrus.JSONFormatter{}
+	}
+	return &logrus.TextFormatter{}
+}
+
+// requestLogger is a logger scoped to a single admission request, so that all the entries
+// pertaining to that request can be correlated with one another, as well as with the
+// API server's audit log, through the request's UID.
+type requestLogger struct {
+	*logrus.Entry
+	start time.Time
+}
+
+func newRequestLogger(operation webhookOperation) *requestLogger {
+	return &requestLogger{
+		Entry: logrus.WithField("operation", operation),
+		start: time.Now(),
+	}
+}
+
+// withRequest adds the admission request's identifying fields to the logger.
+func (logger *requestLogger) withRequest(request *admissionv1beta1.AdmissionRequest) {
+	logger.Entry = logger.WithFields(logrus.Fields{
+		"uid":       request.UID,
+		"namespace": request.Namespace,
+		"kind":      request.Kind.Kind,
+		"action":    request.Operation,
+		"dryRun":    request.DryRun != nil && *request.DryRun,
+	})
+}
+
+// withPod adds the fields identifying a pod to the logger.
+func (logger *requestLogger) withPod(pod *corev1.Pod) {
+	logger.Entry = logger.WithField("pod", pod.Name)
+	if pod.Name == "" {
+		// pods created by controllers don't have a name yet when being admitted
+		logger.Entry = logger.WithField("generateName", pod.GenerateName)
+	}
+}
+
+// withWorkload adds the fields identifying a workload to the logger.
+func (logger *requestLogger) withWorkload(workload *corev1.ObjectReference) {
+	logger.Entry = logger.WithField("workload", workload.Name)
+}
+
+// logDecision logs the outcome of the admission request, along with how long it took to reach it.
+func (logger *requestLogger) logDecision(response *admissionv1beta1.AdmissionResponse) {
+	entry := logger.WithField("duration", time.Since(logger.start).String())
+
+	if response.Allowed {
+		entry.WithField("decision", "allowed").Info("admitting request")
+		return
+	}
+
+	entry = entry.WithField("decision", "denied")
+	message := ""
+	if response.Result != nil {
+		entry = entry.WithField("code", response.Result.Code)
+		message = response.Result.Message
+	}
+	entry.Infof("refusing to admit request: %s", message)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// captureJSONLogs makes logrus log to the returned buffer in JSON, at the given level, until the
+// returned function gets called.
+func captureJSONLogs(level logrus.Level) (*bytes.Buffer, func()) {
+	logger := logrus.StandardLogger()
+	out, formatter, previousLevel := logger.Out, logger.Formatter, logger.GetLevel()
+
+	logs := &bytes.Buffer{}
+	logrus.SetOutput(logs)
+	logrus.SetFormatter(logFormatJSON.formatter())
+	logrus.SetLevel(level)
+
+	return logs, func() {
+		logrus.SetOutput(out)
+		logrus.SetFormatter(formatter)
+		logrus.SetLevel(previousLevel)
+	}
+}
+
+// parseJSONLogs returns the entries logged in JSON.
+func parseJSONLogs(t *testing.T, logs *bytes.Buffer) []map[string]interface{} {
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		entry := make(map[string]interface{})
+		require.Nil(t, json.Unmarshal([]byte(line), &entry), "invalid JSON log line: %s", line)
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestRequestLogger(t *testing.T) {
+	logs, restore := captureJSONLogs(logrus.InfoLevel)
+	defer restore()
+
+	request := &admissionv1beta1.AdmissionRequest{
+		UID:       "123",
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+		Namespace: "ns",
+		Operation: admissionv1beta1.Create,
+	}
+
+	t.Run("allowed", func(t *testing.T) {
+		logs.Reset()
+
+		logger := newRequestLogger(validate)
+		logger.withRequest(request)
+		logger.withPod(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod"}})
+		logger.start = logger.start.Add(-1500 * time.Millisecond)
+		logger.logDecision(&admissionv1beta1.AdmissionResponse{Allowed: true})
+
+		entries := parseJSONLogs(t, logs)
+		require.Equal(t, 1, len(entries))
+		entry := entries[0]
+		assert.Equal(t, "admitting request", entry["msg"])
+		assert.Equal(t, "info", entry["level"])
+		assert.Equal(t, "123", entry["uid"])
+		assert.Equal(t, "ns", entry["namespace"])
+		assert.Equal(t, "pod", entry["pod"])
+		assert.Equal(t, "Pod", entry["kind"])
+		assert.Equal(t, string(validate), entry["operation"])
+		assert.Equal(t, "CREATE", entry["action"])
+		assert.Equal(t, false, entry["dryRun"])
+		assert.Equal(t, "allowed", entry["decision"])
+		if assert.IsType(t, "", entry["duration"]) {
+			duration, err := time.ParseDuration(entry["duration"].(string))
+			require.Nil(t, err)
+			assert.True(t, duration >= 1500*time.Millisecond, "unexpected duration %v", duration)
+		}
+		assert.NotContains(t, entry, "code")
+	})
+
+	t.Run("denied", func(t *testing.T) {
+		logs.Reset()
+
+		dryRun := true
+		dryRunRequest := request.DeepCopy()
+		dryRunRequest.DryRun = &dryRun
+		logger := newRequestLogger(mutate)
+		logger.withRequest(dryRunRequest)
+		// pods created by controllers don't have a name yet
+		logger.withPod(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{GenerateName: "web-"}})
+		logger.logDecision(deniedAdmissionResponse(&podAdmissionError{error: fmt.Errorf("nope"), code: http.StatusForbidden}))
+
+		entries := parseJSONLogs(t, logs)
+		require.Equal(t, 1, len(entries))
+		entry := entries[0]
+		assert.Equal(t, "refusing to admit request: nope", entry["msg"])
+		assert.Equal(t, "123", entry["uid"])
+		assert.Equal(t, "ns", entry["namespace"])
+		assert.Equal(t, "", entry["pod"])
+		assert.Equal(t, "web-", entry["generateName"])
+		assert.Equal(t, string(mutate), entry["operation"])
+		assert.Equal(t, true, entry["dryRun"])
+		assert.Equal(t, "denied", entry["decision"])
+		// JSON numbers get decoded as floats
+		assert.Equal(t, float64(http.StatusForbidden), entry["code"])
+		assert.Contains(t, entry, "duration")
+	})
+
+	t.Run("workloads", func(t *testing.T) {
+		logs.Reset()
+
+		logger := newRequestLogger(validate)
+		logger.withRequest(request)
+		logger.withWorkload(&corev1.ObjectReference{Kind: "Deployment", Name: "web"})
+		logger.logDecision(&admissionv1beta1.AdmissionResponse{Allowed: true})
+
+		entries := parseJSONLogs(t, logs)
+		require.Equal(t, 1, len(entries))
+		assert.Equal(t, "web", entries[0]["workload"])
+		assert.NotContains(t, entries[0], "pod")
+	})
+}
@@ -3,7 +3,9 @@ package main
 import (
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"k8s.io/client-go/rest"
@@ -17,14 +19,105 @@ func main() {
 		panic(err)
 	}
 
-	webhook := newWebhook(kubeClient)
+	// controllers need to be created before starting informers, so that they get notified of
+	// all existing objects
+	controllers, err := createControllers(kubeClient)
+	if err != nil {
+		panic(err)
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	if err = kubeClient.startInformers(stopCh); err != nil {
+		panic(err)
+	}
+
+	if len(controllers) != 0 {
+		leaderElection, err := leaderElectionConfigFromEnv()
+		if err != nil {
+			panic(err)
+		}
+		go func() {
+			if err := runControllers(kubeClient, leaderElection, stopCh, controllers...); err != nil {
+				panic(err)
+			}
+		}()
+	}
+
+	enforcementMode, err := parseEnforcementMode(envOrDefault("ENFORCEMENT_MODE", string(enforcementModeEnforce)))
+	if err != nil {
+		panic(err)
+	}
+
+	windowsSchedulingMode, err := parseWindowsSchedulingMode(envOrDefault("WINDOWS_SCHEDULING_MODE", string(windowsSchedulingNone)))
+	if err != nil {
+		panic(err)
+	}
+
+	denialEvents, err := strconv.ParseBool(envOrDefault("DENIAL_EVENTS", "false"))
+	if err != nil {
+		panic(fmt.Errorf("invalid DENIAL_EVENTS env var: %v", err))
+	}
+
+	major, minor, err := kubeClient.serverVersion()
+	if err != nil {
+		panic(err)
+	}
+
+	sharedCredSpecWarningThreshold, err := strconv.Atoi(envOrDefault("SHARED_CRED_SPEC_WARNING_THRESHOLD", "10"))
+	if err != nil {
+		panic(fmt.Errorf("invalid SHARED_CRED_SPEC_WARNING_THRESHOLD env var: %v", err))
+	}
+
+	port, err := strconv.Atoi(envOrDefault("HTTPS_PORT", "8443"))
+	if err != nil {
+		panic(fmt.Errorf("invalid HTTPS_PORT env var: %v", err))
+	}
+
+	opsPort, err := strconv.Atoi(envOrDefault("OPS_PORT", "8080"))
+	if err != nil {
+		panic(fmt.Errorf("invalid OPS_PORT env var: %v", err))
+	}
+
+	pprof, err := strconv.ParseBool(envOrDefault("PPROF", "false"))
+	if err != nil {
+		panic(fmt.Errorf("invalid PPROF env var: %v", err))
+	}
+
+	webhook := newWebhook(kubeClient, &webhookConfig{
+		enforcementMode:       enforcementMode,
+		windowsSchedulingMode: windowsSchedulingMode,
+		denialEvents:          denialEvents,
+		// GMSA fields went GA in k8s 1.18
+		gaGMSAFieldsAvailable:          major > 1 || (major == 1 && minor >= 18),
+		sharedCredSpecWarningThreshold: sharedCredSpecWarningThreshold,
+		// these are the standard OpenTelemetry env vars
+		otlpEndpoint:       envOrDefault("OTEL_EXPORTER_OTLP_ENDPOINT", ""),
+		tracingServiceName: envOrDefault("OTEL_SERVICE_NAME", eventSourceComponent),
+		// the API server gives up on webhooks after 30 seconds at most
+		timeouts: serverTimeouts{
+			read:  durationEnvOrDefault("HTTP_READ_TIMEOUT", "10s"),
+			write: durationEnvOrDefault("HTTP_WRITE_TIMEOUT", "30s"),
+			idle:  durationEnvOrDefault("HTTP_IDLE_TIMEOUT", "2m"),
+		},
+		opsPort:        opsPort,
+		pprof:          pprof,
+		signingKeysDir: envOrDefault("SIGNING_KEYS_DIR", ""),
+	})
+
+	cipherSuites, err := parseCipherSuites(envOrDefault("TLS_CIPHER_SUITES", ""))
+	if err != nil {
+		panic(fmt.Errorf("invalid TLS_CIPHER_SUITES env var: %v", err))
+	}
 
 	tlsConfig := &tlsConfig{
-		crtPath: env("TLS_CRT"),
-		keyPath: env("TLS_KEY"),
+		crtPath:      env("TLS_CRT"),
+		keyPath:      env("TLS_KEY"),
+		cipherSuites: cipherSuites,
+		clientCAPath: envOrDefault("TLS_CLIENT_CA", ""),
 	}
 
-	if err = webhook.start(443, tlsConfig); err != nil {
+	if err = webhook.start(port, tlsConfig); err != nil {
 		panic(err)
 	}
 }
@@ -42,7 +135,7 @@ var logLevels = map[string]logrus.Level{
 func initLogrus() {
 	logrus.SetOutput(os.Stdout)
 
-	logLevel := logrus.DebugLevel
+	logLevel := logrus.InfoLevel
 	invalid := false
 
 	rawLogLevel, present := os.LookupEnv("LOG_LEVEL")
@@ -56,6 +149,11 @@ func initLogrus() {
 
 	logrus.SetLevel(logLevel)
 
+	format, formatErr := parseLogFormat(envOrDefault("LOG_FORMAT", string(logFormatText)))
+	if formatErr == nil {
+		logrus.SetFormatter(format.formatter())
+	}
+
 	if invalid {
 		keys := make([]string, len(logLevels))
 		i := 0
@@ -65,6 +163,9 @@ func initLogrus() {
 		}
 		logrus.Warningf("Unknown log level %s, valid log levels are: %v", rawLogLevel, strings.Join(keys, ", "))
 	}
+	if formatErr != nil {
+		logrus.Warning(formatErr)
+	}
 }
 
 func createKubeClient() (*kubeClient, error) {
@@ -76,9 +177,100 @@ func createKubeClient() (*kubeClient, error) {
 	return newKubeClient(config)
 }
 
+// createControllers creates the controllers enabled through env vars.
+func createControllers(kubeClient *kubeClient) ([]runnableController, error) {
+	var controllers []runnableController
+
+	enableGrantsController, err := strconv.ParseBool(envOrDefault("GRANTS_CONTROLLER", "false"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid GRANTS_CONTROLLER env var: %v", err)
+	}
+	if enableGrantsController {
+		controllers = append(controllers, newGrantsController(kubeClient))
+	}
+
+	enableUsageController, err := strconv.ParseBool(envOrDefault("CRED_SPEC_USAGE_CONTROLLER", "false"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid CRED_SPEC_USAGE_CONTROLLER env var: %v", err)
+	}
+	if enableUsageController {
+		usageController, err := newCredSpecUsageController(kubeClient)
+		if err != nil {
+			return nil, err
+		}
+		controllers = append(controllers, usageController)
+	}
+
+	enableReauthorizationController, err := strconv.ParseBool(envOrDefault("REAUTHORIZATION_CONTROLLER", "false"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid REAUTHORIZATION_CONTROLLER env var: %v", err)
+	}
+	if enableReauthorizationController {
+		reauthorizationController, err := newReauthorizationController(kubeClient,
+			durationEnvOrDefault("REAUTHORIZATION_INTERVAL", "10m"),
+			durationEnvOrDefault("REAUTHORIZATION_EVICTION_GRACE_PERIOD", "0"))
+		if err != nil {
+			return nil, err
+		}
+		controllers = append(controllers, reauthorizationController)
+	}
+
+	enableDriftController, err := strconv.ParseBool(envOrDefault("DRIFT_CONTROLLER", "false"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid DRIFT_CONTROLLER env var: %v", err)
+	}
+	if enableDriftController {
+		driftController, err := newDriftController(kubeClient)
+		if err != nil {
+			return nil, err
+		}
+		controllers = append(controllers, driftController)
+	}
+
+	return controllers, nil
+}
+
+func leaderElectionConfigFromEnv() (*leaderElectionConfig, error) {
+	enabled, err := strconv.ParseBool(envOrDefault("LEADER_ELECTION", "false"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid LEADER_ELECTION env var: %v", err)
+	}
+	if !enabled {
+		return &leaderElectionConfig{}, nil
+	}
+
+	identity, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("unable to determine the leader election identity: %v", err)
+	}
+
+	return &leaderElectionConfig{
+		enabled:   true,
+		namespace: env("LEADER_ELECTION_NAMESPACE"),
+		lockName:  envOrDefault("LEADER_ELECTION_LOCK_NAME", eventSourceComponent+"-controllers"),
+		identity:  identity,
+	}, nil
+}
+
 func env(key string) string {
 	if value, found := os.LookupEnv(key); found {
 		return value
 	}
 	panic(fmt.Errorf("%s env var not found", key))
 }
+
+func envOrDefault(key, defaultValue string) string {
+	if value, found := os.LookupEnv(key); found {
+		return value
+	}
+	return defaultValue
+}
+
+// durationEnvOrDefault parses an env var as a duration, and panics if it's invalid.
+func durationEnvOrDefault(key, defaultValue string) time.Duration {
+	duration, err := time.ParseDuration(envOrDefault(key, defaultValue))
+	if err != nil {
+		panic(fmt.Errorf("invalid %s env var: %v", key, err))
+	}
+	return duration
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "gmsa_webhook"
+
+var (
+	// unenforcedDenialsCounter counts the admission requests that would have been denied if
+	// their namespace's enforcement mode were enforcementModeEnforce. It's only incremented
+	// when validating, so that requests going through both webhooks don't get counted twice.
+	unenforcedDenialsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "unenforced_denials_total",
+		Help:      "Number of admission requests that would have been denied in enforce mode.",
+	}, []string{"mode"})
+
+	// reconciliationsCounter counts the reconciliations performed by the webhook's controllers.
+	reconciliationsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "controller_reconciliations_total",
+		Help:      "Number of reconciliations performed by controllers, by result.",
+	}, []string{"controller", "result"})
+
+	// revokedAccessPodsCounter counts the running pods found to have lost access to the cred
+	// specs they use.
+	revokedAccessPodsCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "revoked_access_pods_total",
+		Help:      "Number of running pods found to have lost access to the gMSA cred specs they use.",
+	})
+
+	// unauthorizedPodsGauge is the number of running pods currently known to have lost access to
+	// the cred specs they use.
+	unauthorizedPodsGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "unauthorized_pods",
+		Help:      "Number of running pods currently known to have lost access to the gMSA cred specs they use.",
+	})
+
+	// evictedPodsCounter counts the pods evicted for having lost access to the cred specs they use.
+	evictedPodsCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "evicted_pods_total",
+		Help:      "Number of pods evicted for having lost access to the gMSA cred specs they use.",
+	})
+
+	// stalePodsGauge is the number of running pods whose contents of the cred spec they use are
+	// outdated, by cred spec.
+	stalePodsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "stale_pods",
+		Help:      "Number of running pods with outdated contents of the gMSA cred spec they use, by cred spec.",
+	}, []string{"cred_spec"})
+
+	// restartedWorkloadsCounter counts the workloads restarted for running with outdated
+	// contents of the cred specs they use.
+	restartedWorkloadsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "restarted_workloads_total",
+		Help:      "Number of workloads restarted for running with outdated contents of the gMSA cred specs they use.",
+	}, []string{"kind"})
+)
+
+func init() {
+	prometheus.MustRegister(unenforcedDenialsCounter, reconciliationsCounter, revokedAccessPodsCounter, unauthorizedPodsGauge, evictedPodsCounter,
+		stalePodsGauge, restartedWorkloadsCounter)
+}
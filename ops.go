@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// The ops server is a plain HTTP server, separate from the admission one, that serves health
+// checks, metrics, and optionally profiling data; that way kubelet probes and Prometheus scrapes
+// don't need the webhook's certificate, nor a client certificate when client auth is enabled.
+
+// newOpsServer creates the ops server for the given port.
+func (webhook *webhook) newOpsServer(port int) *http.Server {
+	mux := http.NewServeMux()
+
+	// the process is alive as long as it answers
+	mux.HandleFunc("/healthz", func(responseWriter http.ResponseWriter, _ *http.Request) {
+		responseWriter.Write([]byte("ok"))
+	})
+	// it's ready as long as the admission server is listening, and not shutting down
+	mux.HandleFunc("/readyz", func(responseWriter http.ResponseWriter, _ *http.Request) {
+		if !webhook.isReady() {
+			http.Error(responseWriter, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		responseWriter.Write([]byte("ok"))
+	})
+
+	mux.Handle("/metrics", promhttp.Handler())
+
+	server := &http.Server{
+		Addr:              ":" + strconv.Itoa(port),
+		Handler:           mux,
+		ReadTimeout:       webhook.config.timeouts.read,
+		ReadHeaderTimeout: webhook.config.timeouts.read,
+		WriteTimeout:      webhook.config.timeouts.write,
+		IdleTimeout:       webhook.config.timeouts.idle,
+	}
+
+	if webhook.config.pprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+		// CPU profiles and traces can take longer than regular requests
+		server.WriteTimeout = 0
+	}
+
+	return server
+}
+
+func (webhook *webhook) setReady(ready bool) {
+	var value int32
+	if ready {
+		value = 1
+	}
+	atomic.StoreInt32(&webhook.ready, value)
+}
+
+func (webhook *webhook) isReady() bool {
+	return atomic.LoadInt32(&webhook.ready) == 1
+}
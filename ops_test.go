@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpsServer(t *testing.T) {
+	get := func(handler http.Handler, path string) int {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		return recorder.Code
+	}
+
+	webhook := newWebhook(&fuzzKubeClient{}, &webhookConfig{timeouts: serverTimeouts{write: 10 * time.Second}})
+	server := webhook.newOpsServer(8080)
+	handler := server.Handler
+	assert.Equal(t, 10*time.Second, server.WriteTimeout)
+
+	assert.Equal(t, http.StatusOK, get(handler, "/healthz"))
+	assert.Equal(t, http.StatusServiceUnavailable, get(handler, "/readyz"))
+	webhook.setReady(true)
+	assert.Equal(t, http.StatusOK, get(handler, "/readyz"))
+
+	assert.Equal(t, http.StatusOK, get(handler, "/metrics"))
+	assert.Equal(t, http.StatusNotFound, get(handler, "/debug/pprof/"))
+	// admission requests are not served on the ops port
+	assert.Equal(t, http.StatusNotFound, get(handler, "/validate"))
+
+	// profiles can take longer than the write timeout
+	webhook = newWebhook(&fuzzKubeClient{}, &webhookConfig{pprof: true, timeouts: serverTimeouts{write: 10 * time.Second}})
+	server = webhook.newOpsServer(8080)
+	assert.Equal(t, http.StatusOK, get(server.Handler, "/debug/pprof/"))
+	assert.Equal(t, time.Duration(0), server.WriteTimeout)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// namespaceDefaultCredSpecNameAnnotationKey is the namespace annotation that can be used to
+	// give the name of the GMSA cred spec to use by default for Windows pods in that namespace
+	// that don't request one explicitly.
+	namespaceDefaultCredSpecNameAnnotationKey = "windows.k8s.io/default-gmsa-credential-spec-name"
+
+	// these 2 constants are the coordinates of the GMSA policy Custom Resource Definition;
+	// it lives in the same API group and version as the cred specs' CRD
+	policyCRDResourceName = "gmsapolicies"
+	policyCRDKind         = "GMSAPolicy"
+)
+
+// osNodeLabels are the node labels that k8s uses to advertise nodes' operating systems;
+// the beta one is still the only one set on older clusters.
+var osNodeLabels = []string{"kubernetes.io/os", "beta.kubernetes.io/os"}
+
+// gmsaPolicy is a namespaced object that allows cluster admins to configure how GMSAs
+// get used in a given namespace.
+type gmsaPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec gmsaPolicySpec `json:"spec"`
+}
+
+type gmsaPolicySpec struct {
+	// PodSelector restricts which pods in the namespace the policy applies to.
+	// A nil selector matches all pods.
+	PodSelector *metav1.LabelSelector `json:"podSelector,omitempty"`
+
+	// DefaultCredSpecName is the name of the cred spec to inject into matching Windows pods that
+	// don't request one explicitly.
+	DefaultCredSpecName string `json:"defaultCredSpecName,omitempty"`
+
+	// AllowedCredSpecs and AllowedCredSpecSelector, if either is set, restrict matching pods to
+	// only using cred specs that are either listed by name, or whose labels match the selector.
+	AllowedCredSpecs        []string              `json:"allowedCredSpecs,omitempty"`
+	AllowedCredSpecSelector *metav1.LabelSelector `json:"allowedCredSpecSelector,omitempty"`
+
+	// DeniedCredSpecs and DeniedCredSpecSelector forbid matching pods from using cred specs that
+	// are either listed by name, or whose labels match the selector. Denials take precedence over
+	// allowances.
+	DeniedCredSpecs        []string              `json:"deniedCredSpecs,omitempty"`
+	DeniedCredSpecSelector *metav1.LabelSelector `json:"deniedCredSpecSelector,omitempty"`
+
+	// RequiredNodeSelector lists node selector terms that matching pods using GMSAs must set.
+	RequiredNodeSelector map[string]string `json:"requiredNodeSelector,omitempty"`
+
+	// MaxIdentitiesPerPod, if positive, caps how many distinct cred specs a single matching pod
+	// can use.
+	MaxIdentitiesPerPod int `json:"maxIdentitiesPerPod,omitempty"`
+}
+
+// matches returns true iff the policy applies to the given pod.
+func (policy *gmsaPolicy) matches(pod *corev1.Pod) (bool, error) {
+	if policy.Spec.PodSelector == nil {
+		return true, nil
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(policy.Spec.PodSelector)
+	if err != nil {
+		return false, fmt.Errorf("invalid pod selector in %s %s/%s: %v", policyCRDKind, policy.Namespace, policy.Name, err)
+	}
+	return selector.Matches(labels.Set(pod.Labels)), nil
+}
+
+// isWindowsPod returns true iff the pod is explicitly scheduled on Windows nodes.
+func isWindowsPod(pod *corev1.Pod) bool {
+	for _, label := range osNodeLabels {
+		if pod.Spec.NodeSelector[label] == "windows" {
+			return true
+		}
+	}
+	return false
+}
+
+// matchingGMSAPolicies returns the GMSA policies from the pod's namespace that apply to it,
+// sorted by name.
+func (webhook *webhook) matchingGMSAPolicies(pod *corev1.Pod, namespace string) ([]*gmsaPolicy, *podAdmissionError) {
+	policies, code, err := webhook.client.listGMSAPolicies(namespace)
+	if err != nil {
+		return nil, &podAdmissionError{error: err, pod: pod, code: code}
+	}
+
+	sort.Slice(policies, func(i, j int) bool {
+		return policies[i].Name < policies[j].Name
+	})
+
+	matching := make([]*gmsaPolicy, 0, len(policies))
+	for _, policy := range policies {
+		matches, err := policy.matches(pod)
+		if err != nil {
+			return nil, &podAdmissionError{error: err, pod: pod, code: http.StatusInternalServerError}
+		}
+		if matches {
+			matching = append(matching, policy)
+		}
+	}
+
+	return matching, nil
+}
+
+// defaultCredSpecName returns the name of the cred spec to use for a pod that doesn't request
+// one explicitly, if any, as well as a human-readable description of where that default comes from.
+// GMSA policies matching the pod take precedence over the namespace's annotation; if several
+// policies match, the first one in alphabetical order wins.
+func (webhook *webhook) defaultCredSpecName(pod *corev1.Pod, namespace string) (string, string, *podAdmissionError) {
+	policies, admissionErr := webhook.matchingGMSAPolicies(pod, namespace)
+	if admissionErr != nil {
+		return "", "", admissionErr
+	}
+
+	for _, policy := range policies {
+		if policy.Spec.DefaultCredSpecName != "" {
+			return policy.Spec.DefaultCredSpecName, fmt.Sprintf("%s %s", policyCRDKind, policy.Name), nil
+		}
+	}
+
+	ns, code, err := webhook.client.retrieveNamespace(namespace)
+	if err != nil {
+		return "", "", &podAdmissionError{error: err, pod: pod, code: code}
+	}
+	if credSpecName := ns.Annotations[namespaceDefaultCredSpecNameAnnotationKey]; credSpecName != "" {
+		return credSpecName, fmt.Sprintf("namespace %s's %s annotation", namespace, namespaceDefaultCredSpecNameAnnotationKey), nil
+	}
+
+	return "", "", nil
+}
+
+// enforceGMSAPolicies checks that the cred specs requested by a pod are compatible with all
+// the GMSA policies that apply to it, and records any violation.
+func (webhook *webhook) enforceGMSAPolicies(violations *podViolations, pod *corev1.Pod, namespace string, credSpecNames []string) {
+	if len(credSpecNames) == 0 {
+		return
+	}
+
+	policies, admissionErr := webhook.matchingGMSAPolicies(pod, namespace)
+	if admissionErr != nil {
+		violations.add(admissionErr)
+		return
+	}
+
+	// cred specs' labels are only fetched if some policy needs them, and at most once each
+	credSpecLabels := make(map[string]labels.Set)
+	matchesSelector := func(credSpecName string, labelSelector *metav1.LabelSelector, policy *gmsaPolicy) (bool, *podAdmissionError) {
+		selector, err := metav1.LabelSelectorAsSelector(labelSelector)
+		if err != nil {
+			return false, &podAdmissionError{error: fmt.Errorf("invalid cred spec selector in %s %s: %v", policyCRDKind, policy.Name, err), pod: pod, code: http.StatusInternalServerError}
+		}
+		if _, present := credSpecLabels[credSpecName]; !present {
+			credSpecLabelsMap, code, err := webhook.client.retrieveCredSpecLabels(credSpecName)
+			if err != nil {
+				return false, &podAdmissionError{error: err, pod: pod, code: code}
+			}
+			credSpecLabels[credSpecName] = labels.Set(credSpecLabelsMap)
+		}
+		return selector.Matches(credSpecLabels[credSpecName]), nil
+	}
+
+	for _, policy := range policies {
+		if policy.Spec.MaxIdentitiesPerPod > 0 && len(credSpecNames) > policy.Spec.MaxIdentitiesPerPod {
+			violations.add(&podAdmissionError{error: fmt.Errorf("pod uses %d distinct gMSA cred specs, but %s %s allows at most %d", len(credSpecNames), policyCRDKind, policy.Name, policy.Spec.MaxIdentitiesPerPod), pod: pod, code: http.StatusForbidden, field: "metadata.annotations"})
+		}
+
+		for _, key := range sortedKeys(policy.Spec.RequiredNodeSelector) {
+			value := policy.Spec.RequiredNodeSelector[key]
+			if actual, present := pod.Spec.NodeSelector[key]; !present || actual != value {
+				violations.add(&podAdmissionError{error: fmt.Errorf("%s %s requires pods using gMSAs to have a %s=%s node selector", policyCRDKind, policy.Name, key, value), pod: pod, code: http.StatusForbidden, field: "spec.nodeSelector"})
+			}
+		}
+
+		for _, credSpecName := range credSpecNames {
+			denied := containsString(policy.Spec.DeniedCredSpecs, credSpecName)
+			if !denied && policy.Spec.DeniedCredSpecSelector != nil {
+				if denied, admissionErr = matchesSelector(credSpecName, policy.Spec.DeniedCredSpecSelector, policy); admissionErr != nil {
+					violations.add(admissionErr)
+					continue
+				}
+			}
+			if denied {
+				violations.add(&podAdmissionError{error: fmt.Errorf("the %s gMSA cred spec is denied by %s %s", credSpecName, policyCRDKind, policy.Name), pod: pod, code: http.StatusForbidden, field: credSpecNameAnnotationsField(pod, credSpecName)})
+				continue
+			}
+
+			if len(policy.Spec.AllowedCredSpecs) == 0 && policy.Spec.AllowedCredSpecSelector == nil {
+				continue
+			}
+			allowed := containsString(policy.Spec.AllowedCredSpecs, credSpecName)
+			if !allowed && policy.Spec.AllowedCredSpecSelector != nil {
+				if allowed, admissionErr = matchesSelector(credSpecName, policy.Spec.AllowedCredSpecSelector, policy); admissionErr != nil {
+					violations.add(admissionErr)
+					continue
+				}
+			}
+			if !allowed {
+				violations.add(&podAdmissionError{error: fmt.Errorf("the %s gMSA cred spec is not allowed by %s %s", credSpecName, policyCRDKind, policy.Name), pod: pod, code: http.StatusForbidden, field: credSpecNameAnnotationsField(pod, credSpecName)})
+			}
+		}
+	}
+}
+
+// credSpecNameAnnotationsField returns the path to the first GMSA name annotation requesting
+// the given cred spec.
+func credSpecNameAnnotationsField(pod *corev1.Pod, credSpecName string) (field string) {
+	iterateOverGMSAAnnotationPairs(pod, func(nameKey, _ string) {
+		if field == "" && pod.Annotations[nameKey] == credSpecName {
+			field = annotationField(nameKey)
+		}
+	})
+	return
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func containsString(slice []string, s string) bool {
+	for _, item := range slice {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	reauthorizationControllerName    = "gmsa-reauthorization"
+	reauthorizationControllerWorkers = 2
+
+	// these are the reasons of the events emitted about pods whose service account lost access
+	// to the cred specs they use
+	accessRevokedEventReason = "GMSAAccessRevoked"
+	evictedEventReason       = "GMSAAccessRevokedEviction"
+)
+
+// reauthorizationController periodically re-checks that running pods' service accounts are still
+// authorized to `use` the cred specs they use, since that's otherwise only checked on admission;
+// pods that aren't get reported through a warning event and metrics, and, if an eviction grace
+// period is set, get evicted once that grace period has elapsed without access being restored.
+// When pods have been found unauthorized is only tracked in memory, so grace periods start over
+// when a new replica starts leading.
+type reauthorizationController struct {
+	*controller
+	client reauthorizationClientInterface
+
+	interval time.Duration
+	// evictionGracePeriod is how long pods can keep running after having been found unauthorized;
+	// 0 disables evictions
+	evictionGracePeriod time.Duration
+	now                 func() time.Time
+
+	mutex sync.Mutex
+	// unauthorizedPods are the pods currently known to be unauthorized, keyed by their keys
+	unauthorizedPods map[string]*unauthorizedPod
+}
+
+type unauthorizedPod struct {
+	uid   types.UID
+	since time.Time
+}
+
+func newReauthorizationController(client reauthorizationClientInterface, interval, evictionGracePeriod time.Duration) (*reauthorizationController, error) {
+	reauthorizationController := &reauthorizationController{
+		client:              client,
+		interval:            interval,
+		evictionGracePeriod: evictionGracePeriod,
+		now:                 time.Now,
+		unauthorizedPods:    make(map[string]*unauthorizedPod),
+	}
+	reauthorizationController.controller = newController(reauthorizationControllerName, reauthorizationControllerWorkers, reauthorizationController.reconcile)
+
+	// only deletions matter, to forget about deleted pods; all pods get checked periodically anyway
+	if err := client.watchGMSAPods(cache.ResourceEventHandlerFuncs{
+		DeleteFunc: reauthorizationController.enqueue,
+	}); err != nil {
+		return nil, err
+	}
+
+	return reauthorizationController, nil
+}
+
+// run is a blocking call that checks all GMSA pods every interval, until `stopCh` gets closed.
+func (rc *reauthorizationController) run(stopCh <-chan struct{}) {
+	go wait.Until(rc.enqueueGMSAPods, rc.interval, stopCh)
+	rc.controller.run(stopCh)
+}
+
+func (rc *reauthorizationController) enqueueGMSAPods() {
+	pods, err := rc.client.listGMSAPods()
+	if err != nil {
+		logrus.Errorf("%s controller: unable to list pods: %v", rc.name, err)
+		return
+	}
+	for _, pod := range pods {
+		rc.enqueue(pod)
+	}
+}
+
+// reconcile re-checks the authorizations of the pod with the given key.
+func (rc *reauthorizationController) reconcile(key string) error {
+	namespace, name, err := splitKey(key)
+	if err != nil {
+		// no point in retrying
+		logrus.Error(err)
+		return nil
+	}
+
+	pod, err := rc.client.retrieveCachedPod(namespace, name)
+	if err != nil {
+		return err
+	}
+	if pod == nil || !isPodActive(pod) || pod.DeletionTimestamp != nil {
+		rc.forget(key)
+		return nil
+	}
+
+	serviceAccountName := podServiceAccountName(pod)
+
+	var revocations []string
+	for _, credSpecName := range requestedCredSpecNames(pod) {
+		authorized, reason, err := rc.client.checkCredSpecUseAuthorization(serviceAccountName, namespace, credSpecName)
+		if err != nil {
+			return err
+		}
+		if !authorized {
+			revocation := fmt.Sprintf("service account %s does not have `use` access to the %s gMSA cred spec any more", serviceAccountName, credSpecName)
+			if reason != "" {
+				revocation += ", reason: " + reason
+			}
+			revocations = append(revocations, revocation)
+		}
+	}
+
+	if len(revocations) == 0 {
+		if rc.forget(key) {
+			logrus.Infof("pod %s is authorized to use its gMSAs again", key)
+		}
+		return nil
+	}
+
+	since, firstFound := rc.markUnauthorized(key, pod)
+	message := strings.Join(revocations, "; ")
+	if firstFound {
+		logrus.Warnf("pod %s: %s", key, message)
+		revokedAccessPodsCounter.Inc()
+		rc.client.recordEvent(podReference(pod), corev1.EventTypeWarning, accessRevokedEventReason, message)
+	}
+
+	if rc.evictionGracePeriod == 0 {
+		return nil
+	}
+	if remaining := rc.evictionGracePeriod - rc.now().Sub(since); remaining > 0 {
+		rc.queue.AddAfter(key, remaining)
+		return nil
+	}
+
+	if err := rc.client.evictPod(pod); err != nil {
+		// e.g. disruption budgets not allowing it right now
+		return err
+	}
+	logrus.Warnf("evicted pod %s: %s", key, message)
+	evictedPodsCounter.Inc()
+	rc.client.recordEvent(podReference(pod), corev1.EventTypeWarning, evictedEventReason, fmt.Sprintf("evicted after %v: %s", rc.evictionGracePeriod, message))
+	rc.forget(key)
+
+	return nil
+}
+
+// markUnauthorized records that a pod is unauthorized, and returns since when it's known to be,
+// as well as whether it was just found to be.
+func (rc *reauthorizationController) markUnauthorized(key string, pod *corev1.Pod) (time.Time, bool) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	if unauthorized, present := rc.unauthorizedPods[key]; present && unauthorized.uid == pod.UID {
+		return unauthorized.since, false
+	}
+
+	unauthorized := &unauthorizedPod{uid: pod.UID, since: rc.now()}
+	rc.unauthorizedPods[key] = unauthorized
+	unauthorizedPodsGauge.Set(float64(len(rc.unauthorizedPods)))
+	return unauthorized.since, true
+}
+
+// forget forgets about a pod, and returns whether it was known to be unauthorized.
+func (rc *reauthorizationController) forget(key string) bool {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	_, present := rc.unauthorizedPods[key]
+	delete(rc.unauthorizedPods, key)
+	unauthorizedPodsGauge.Set(float64(len(rc.unauthorizedPods)))
+	return present
+}
+
+func podReference(pod *corev1.Pod) *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       "Pod",
+		Name:       pod.Name,
+		Namespace:  pod.Namespace,
+		UID:        pod.UID,
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReauthorizationControllerReportsRevokedAccess(t *testing.T) {
+	pod := newPodUsingCredSpec("ns", "pod", "cred-spec", "", nil)
+	pod.UID = "pod-uid"
+	pod.Spec.ServiceAccountName = "sa"
+	client := newFakeControllerClient(pod)
+	client.authorized["ns/sa"] = []string{"cred-spec"}
+
+	reauthorizationController, err := newReauthorizationController(client, time.Minute, 0)
+	require.Nil(t, err)
+
+	require.Nil(t, reauthorizationController.reconcile("ns/pod"))
+	assert.Empty(t, client.events)
+
+	// revoking access
+	client.authorized["ns/sa"] = nil
+	require.Nil(t, reauthorizationController.reconcile("ns/pod"))
+	if assert.Equal(t, 1, len(client.events)) {
+		assert.Equal(t, "Warning GMSAAccessRevoked Pod ns/pod: service account sa does not have `use` access to the cred-spec gMSA cred spec any more, reason: no RBAC policy matched", client.events[0])
+	}
+
+	// events only get emitted once, and nothing gets evicted without a grace period
+	require.Nil(t, reauthorizationController.reconcile("ns/pod"))
+	assert.Equal(t, 1, len(client.events))
+	assert.Empty(t, client.evicted)
+
+	// failing to check access is not the same as being denied access
+	client.authorized["ns/sa"] = []string{"cred-spec"}
+	client.authzErr = fmt.Errorf("API server unavailable")
+	assert.NotNil(t, reauthorizationController.reconcile("ns/pod"))
+	assert.Equal(t, 1, len(reauthorizationController.unauthorizedPods))
+
+	// restoring access
+	client.authzErr = nil
+	require.Nil(t, reauthorizationController.reconcile("ns/pod"))
+	assert.Empty(t, reauthorizationController.unauthorizedPods)
+
+	// deleted pods get forgotten
+	client.authorized["ns/sa"] = nil
+	require.Nil(t, reauthorizationController.reconcile("ns/pod"))
+	assert.Equal(t, 1, len(reauthorizationController.unauthorizedPods))
+	delete(client.pods, "ns/pod")
+	require.Nil(t, reauthorizationController.reconcile("ns/pod"))
+	assert.Empty(t, reauthorizationController.unauthorizedPods)
+}
+
+func TestReauthorizationControllerEvictsAfterGracePeriod(t *testing.T) {
+	pod := newPodUsingCredSpec("ns", "pod", "cred-spec", "", nil)
+	pod.UID = "pod-uid"
+	client := newFakeControllerClient(pod)
+
+	reauthorizationController, err := newReauthorizationController(client, time.Minute, time.Hour)
+	require.Nil(t, err)
+	now := time.Now()
+	reauthorizationController.now = func() time.Time {
+		return now
+	}
+
+	require.Nil(t, reauthorizationController.reconcile("ns/pod"))
+	if assert.Equal(t, 1, len(client.events)) {
+		// the default service account is used when pods don't specify one
+		assert.Contains(t, client.events[0], "service account default does not have `use` access")
+	}
+	assert.Empty(t, client.evicted)
+
+	now = now.Add(59 * time.Minute)
+	require.Nil(t, reauthorizationController.reconcile("ns/pod"))
+	assert.Empty(t, client.evicted)
+
+	now = now.Add(time.Minute)
+	client.evictErr = fmt.Errorf("cannot evict pod as it would violate the pod's disruption budget")
+	assert.NotNil(t, reauthorizationController.reconcile("ns/pod"))
+	assert.Empty(t, client.evicted)
+
+	client.evictErr = nil
+	require.Nil(t, reauthorizationController.reconcile("ns/pod"))
+	assert.Equal(t, []string{"ns/pod"}, client.evicted)
+	if assert.Equal(t, 2, len(client.events)) {
+		assert.Contains(t, client.events[1], "Warning GMSAAccessRevokedEviction Pod ns/pod: evicted after 1h0m0s")
+	}
+	assert.Empty(t, reauthorizationController.unauthorizedPods)
+
+	t.Run("a new pod with the same name gets a new grace period", func(t *testing.T) {
+		newPod := newPodUsingCredSpec("ns", "pod", "cred-spec", "", nil)
+		newPod.UID = "new-pod-uid"
+		client.pods["ns/pod"] = newPod
+		reauthorizationController.unauthorizedPods["ns/pod"] = &unauthorizedPod{uid: "pod-uid", since: now.Add(-2 * time.Hour)}
+
+		require.Nil(t, reauthorizationController.reconcile("ns/pod"))
+		assert.Equal(t, []string{"ns/pod"}, client.evicted)
+		assert.Equal(t, 3, len(client.events))
+	})
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// redactedPlaceholder replaces values that can't be hashed, e.g. because they're not strings.
+const redactedPlaceholder = "<redacted>"
+
+// redactedHash replaces a sensitive string with a short hash of it, so that log lines can still
+// be correlated without leaking its contents.
+func redactedHash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return fmt.Sprintf("<redacted sha256:%s>", hex.EncodeToString(sum[:])[:12])
+}
+
+// isGMSAContentsAnnotationKey returns true iff the annotation key holds the contents of a cred spec.
+func isGMSAContentsAnnotationKey(key string) bool {
+	return key == gMSAPodSpecContentsAnnotationKey || strings.HasSuffix(key, gMSAContainerSpecContentsAnnotationKeySuffix)
+}
+
+// redactAdmissionReviewJSON returns a version of a raw admission review suitable for logging,
+// i.e. with cred spec contents and environment variables values redacted.
+func redactAdmissionReviewJSON(body []byte) string {
+	var review map[string]interface{}
+	if err := json.Unmarshal(body, &review); err != nil {
+		return fmt.Sprintf("<unparseable admission review, %d bytes>", len(body))
+	}
+
+	if request, ok := review["request"].(map[string]interface{}); ok {
+		for _, key := range []string{"object", "oldObject"} {
+			if object, ok := request[key].(map[string]interface{}); ok {
+				redactPodObject(object)
+				// workloads' pod templates can contain the same sensitive values as pods
+				if template := workloadPodTemplateObject(object); template != nil {
+					redactPodObject(template)
+				}
+			}
+		}
+	}
+
+	return marshalForLogs(review)
+}
+
+// redactPodObject redacts a pod's unstructured representation in place.
+func redactPodObject(pod map[string]interface{}) {
+	if metadata, ok := pod["metadata"].(map[string]interface{}); ok {
+		if annotations, ok := metadata["annotations"].(map[string]interface{}); ok {
+			for key, value := range annotations {
+				if isGMSAContentsAnnotationKey(key) {
+					annotations[key] = redactValue(value)
+				}
+			}
+		}
+	}
+
+	spec, ok := pod["spec"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	redactSecurityContext(spec["securityContext"])
+	for _, key := range []string{"containers", "initContainers"} {
+		containers, _ := spec[key].([]interface{})
+		for _, rawContainer := range containers {
+			container, ok := rawContainer.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			redactSecurityContext(container["securityContext"])
+			envVars, _ := container["env"].([]interface{})
+			for _, rawEnvVar := range envVars {
+				if envVar, ok := rawEnvVar.(map[string]interface{}); ok {
+					if value, present := envVar["value"]; present {
+						envVar["value"] = redactValue(value)
+					}
+				}
+			}
+		}
+	}
+}
+
+// workloadPodTemplateObject returns a workload's unstructured pod template, if any.
+func workloadPodTemplateObject(workload map[string]interface{}) map[string]interface{} {
+	spec, _ := workload["spec"].(map[string]interface{})
+	if jobTemplate, ok := spec["jobTemplate"].(map[string]interface{}); ok {
+		spec, _ = jobTemplate["spec"].(map[string]interface{})
+	}
+	template, _ := spec["template"].(map[string]interface{})
+	return template
+}
+
+// redactSecurityContext redacts the cred spec contents from a security context's unstructured
+// representation in place.
+func redactSecurityContext(securityContext interface{}) {
+	if securityContext, ok := securityContext.(map[string]interface{}); ok {
+		redactWindowsOptions(securityContext["windowsOptions"])
+	}
+}
+
+// redactWindowsOptions redacts the cred spec contents from a windowsOptions' unstructured
+// representation in place.
+func redactWindowsOptions(windowsOptions interface{}) {
+	if windowsOptions, ok := windowsOptions.(map[string]interface{}); ok {
+		if value, present := windowsOptions[gmsaCredentialSpecField]; present {
+			windowsOptions[gmsaCredentialSpecField] = redactValue(value)
+		}
+	}
+}
+
+// redactJSONPatch returns a version of a JSON patch suitable for logging, i.e. with the cred
+// spec contents it adds redacted.
+func redactJSONPatch(patch []byte) []byte {
+	var operations []map[string]interface{}
+	if err := json.Unmarshal(patch, &operations); err != nil {
+		return []byte(redactedPlaceholder)
+	}
+
+	for _, operation := range operations {
+		path, _ := operation["path"].(string)
+		switch {
+		case strings.HasPrefix(path, "/metadata/annotations/"):
+			if isGMSAContentsAnnotationKey(jsonPatchUnescaper.Replace(strings.TrimPrefix(path, "/metadata/annotations/"))) {
+				operation["value"] = redactValue(operation["value"])
+			}
+		case strings.HasSuffix(path, "/windowsOptions/"+gmsaCredentialSpecField):
+			operation["value"] = redactValue(operation["value"])
+		case strings.HasSuffix(path, "/windowsOptions"):
+			redactWindowsOptions(operation["value"])
+		case strings.HasSuffix(path, "/securityContext"):
+			redactSecurityContext(operation["value"])
+		}
+	}
+
+	redacted, err := jsonForLogs(operations)
+	if err != nil {
+		return []byte(redactedPlaceholder)
+	}
+	return redacted
+}
+
+// jsonPatchUnescaper reverts jsonPatchEscaper.
+var jsonPatchUnescaper = strings.NewReplacer("~1", "/", "~0", "~")
+
+func redactValue(value interface{}) string {
+	if str, ok := value.(string); ok {
+		return redactedHash(str)
+	}
+	return redactedPlaceholder
+}
+
+// marshalForLogs marshals an object to JSON for logging purposes.
+func marshalForLogs(object interface{}) string {
+	marshalled, err := jsonForLogs(object)
+	if err != nil {
+		return fmt.Sprintf("<unable to marshall for logs: %v>", err)
+	}
+	return string(marshalled)
+}
+
+// jsonForLogs is the same as json.Marshal, except that it doesn't escape HTML characters, so
+// that redacted values remain readable.
+func jsonForLogs(object interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(object); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buffer.Bytes(), []byte("\n")), nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const sensitiveValue = `{"sid":"S-1-5-21-secret"}`
+
+func TestRedactAdmissionReviewJSON(t *testing.T) {
+	podWithContainer := func(container string) string {
+		return fmt.Sprintf(`{"metadata":{"name":"pod"},"spec":{"containers":[%s]}}`, container)
+	}
+	sensitive := fmt.Sprintf("%q", sensitiveValue)
+
+	for _, testCase := range []struct {
+		name   string
+		object string
+		// oldObject is set instead of object if true
+		oldObject bool
+		// expected is what the sensitive value gets replaced with, defaults to its hash
+		expected string
+	}{
+		{
+			name:   "pod contents annotation",
+			object: fmt.Sprintf(`{"metadata":{"annotations":{%q:%s}}}`, gMSAPodSpecContentsAnnotationKey, sensitive),
+		},
+		{
+			name:   "container contents annotation",
+			object: fmt.Sprintf(`{"metadata":{"annotations":{%q:%s}}}`, "container"+gMSAContainerSpecContentsAnnotationKeySuffix, sensitive),
+		},
+		{
+			name:      "contents annotation of the old object",
+			object:    fmt.Sprintf(`{"metadata":{"annotations":{%q:%s}}}`, gMSAPodSpecContentsAnnotationKey, sensitive),
+			oldObject: true,
+		},
+		{
+			name:     "contents annotation that is not a string",
+			object:   fmt.Sprintf(`{"metadata":{"annotations":{%q:{"sid":"S-1-5-21-secret"}}}}`, gMSAPodSpecContentsAnnotationKey),
+			expected: redactedPlaceholder,
+		},
+		{
+			name:   "container env value",
+			object: podWithContainer(fmt.Sprintf(`{"name":"container","env":[{"name":"VAR","value":%s}]}`, sensitive)),
+		},
+		{
+			name:   "init container env value",
+			object: fmt.Sprintf(`{"spec":{"initContainers":[{"name":"init","env":[{"name":"VAR","value":%s}]}]}}`, sensitive),
+		},
+		{
+			name:   "pod windows options",
+			object: fmt.Sprintf(`{"spec":{"securityContext":{"windowsOptions":{%q:%s}}}}`, gmsaCredentialSpecField, sensitive),
+		},
+		{
+			name:   "container windows options",
+			object: podWithContainer(fmt.Sprintf(`{"name":"container","securityContext":{"windowsOptions":{%q:%s}}}`, gmsaCredentialSpecField, sensitive)),
+		},
+		{
+			name:   "deployment pod template",
+			object: fmt.Sprintf(`{"kind":"Deployment","spec":{"template":{"metadata":{"annotations":{%q:%s}}}}}`, gMSAPodSpecContentsAnnotationKey, sensitive),
+		},
+		{
+			name:   "cron job pod template",
+			object: fmt.Sprintf(`{"kind":"CronJob","spec":{"jobTemplate":{"spec":{"template":{"spec":{"containers":[{"name":"container","env":[{"name":"VAR","value":%s}]}]}}}}}}`, sensitive),
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			key := "object"
+			if testCase.oldObject {
+				key = "oldObject"
+			}
+			body := fmt.Sprintf(`{"request":{"uid":"123","%s":%s}}`, key, testCase.object)
+			expected := testCase.expected
+			if expected == "" {
+				expected = redactedHash(sensitiveValue)
+			}
+
+			redacted := redactAdmissionReviewJSON([]byte(body))
+
+			assert.NotContains(t, redacted, "S-1-5-21-secret")
+			assert.Contains(t, redacted, expected)
+			// the rest of the review is kept
+			assert.Contains(t, redacted, `"uid":"123"`)
+		})
+	}
+
+	t.Run("other annotations and env var names are kept", func(t *testing.T) {
+		body := fmt.Sprintf(`{"request":{"object":{"metadata":{"annotations":{%q:"cred-spec"}},"spec":{"containers":[{"name":"container","env":[{"name":"VAR","valueFrom":{"secretKeyRef":{"name":"secret","key":"key"}}}]}]}}}}`, gMSAPodSpecNameAnnotationKey)
+
+		redacted := redactAdmissionReviewJSON([]byte(body))
+
+		assert.JSONEq(t, body, redacted)
+	})
+
+	t.Run("unparseable reviews are not logged at all", func(t *testing.T) {
+		body := fmt.Sprintf(`{"request":{"object":{"metadata":{"annotations":{%q:%q}}}}`, gMSAPodSpecContentsAnnotationKey, sensitiveValue)
+
+		assert.Equal(t, fmt.Sprintf("<unparseable admission review, %d bytes>", len(body)), redactAdmissionReviewJSON([]byte(body)))
+	})
+}
+
+func TestRedactJSONPatch(t *testing.T) {
+	sensitive := fmt.Sprintf("%q", sensitiveValue)
+
+	for _, testCase := range []struct {
+		name  string
+		path  string
+		value string
+		// expected is what the sensitive value gets replaced with, defaults to its hash
+		expected string
+	}{
+		{
+			name:  "pod contents annotation",
+			path:  "/metadata/annotations/" + jsonPatchEscaper.Replace(gMSAPodSpecContentsAnnotationKey),
+			value: sensitive,
+		},
+		{
+			name:  "container contents annotation",
+			path:  "/metadata/annotations/" + jsonPatchEscaper.Replace("container"+gMSAContainerSpecContentsAnnotationKeySuffix),
+			value: sensitive,
+		},
+		{
+			name:     "contents annotation that is not a string",
+			path:     "/metadata/annotations/" + jsonPatchEscaper.Replace(gMSAPodSpecContentsAnnotationKey),
+			value:    `{"sid":"S-1-5-21-secret"}`,
+			expected: redactedPlaceholder,
+		},
+		{
+			name:  "windows options field",
+			path:  "/spec/containers/0/securityContext/windowsOptions/" + gmsaCredentialSpecField,
+			value: sensitive,
+		},
+		{
+			name:  "windows options",
+			path:  "/spec/securityContext/windowsOptions",
+			value: fmt.Sprintf(`{%q:%s}`, gmsaCredentialSpecField, sensitive),
+		},
+		{
+			name:  "security context",
+			path:  "/spec/containers/0/securityContext",
+			value: fmt.Sprintf(`{"windowsOptions":{%q:%s}}`, gmsaCredentialSpecField, sensitive),
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			patch := fmt.Sprintf(`[{"op":"add","path":%q,"value":%s}]`, testCase.path, testCase.value)
+			expected := testCase.expected
+			if expected == "" {
+				expected = redactedHash(sensitiveValue)
+			}
+
+			redacted := string(redactJSONPatch([]byte(patch)))
+
+			assert.NotContains(t, redacted, "S-1-5-21-secret")
+			assert.Contains(t, redacted, expected)
+			assert.Contains(t, redacted, testCase.path)
+		})
+	}
+
+	t.Run("other operations are kept", func(t *testing.T) {
+		patch := fmt.Sprintf(`[{"op":"add","path":%q,"value":"cred-spec"},{"op":"add","path":"/spec/nodeSelector","value":{"kubernetes.io/os":"windows"}}]`,
+			"/metadata/annotations/"+jsonPatchEscaper.Replace(gMSAPodSpecNameAnnotationKey))
+
+		assert.JSONEq(t, patch, string(redactJSONPatch([]byte(patch))))
+	})
+
+	t.Run("unparseable patches are not logged at all", func(t *testing.T) {
+		patch := fmt.Sprintf(`[{"op":"add","path":"/metadata/annotations","value":%s`, sensitive)
+
+		assert.Equal(t, redactedPlaceholder, string(redactJSONPatch([]byte(patch))))
+	})
+}
+
+// secretContentsKubeClient serves the same sensitive contents for all cred specs.
+type secretContentsKubeClient struct {
+	fuzzKubeClient
+}
+
+func (*secretContentsKubeClient) retrieveCredSpecContents(credSpecName string) (string, int, error) {
+	return sensitiveValue, 0, nil
+}
+
+func TestAdmissionLogsAndDenialsAreRedacted(t *testing.T) {
+	logs, restore := captureJSONLogs(logrus.DebugLevel)
+	defer restore()
+
+	webhook := newWebhook(&secretContentsKubeClient{}, &webhookConfig{enforcementMode: enforcementModeEnforce, windowsSchedulingMode: windowsSchedulingNone})
+	serve := func(path string, pod *corev1.Pod) *admissionv1beta1.AdmissionResponse {
+		request := newAdmissionHTTPRequest(t, admissionv1beta1.Create, pod)
+		request.URL.Path = path
+		recorder := httptest.NewRecorder()
+		webhook.ServeHTTP(recorder, request)
+
+		review := &admissionv1beta1.AdmissionReview{}
+		require.Nil(t, json.Unmarshal(recorder.Body.Bytes(), review))
+		require.NotNil(t, review.Response)
+		return review.Response
+	}
+	newPod := func(contents string) *corev1.Pod {
+		pod := newTestPod(map[string]string{gMSAPodSpecNameAnnotationKey: "ab"})
+		if contents != "" {
+			pod.Annotations[gMSAPodSpecContentsAnnotationKey] = contents
+		}
+		pod.Spec.Containers[0].Env = []corev1.EnvVar{{Name: "PASSWORD", Value: "env-var-secret"}}
+		return pod
+	}
+
+	t.Run("injected contents", func(t *testing.T) {
+		logs.Reset()
+
+		admissionResponse := serve("/mutate", newPod(""))
+
+		require.True(t, admissionResponse.Allowed)
+		// the response itself still contains the contents
+		assert.Contains(t, string(admissionResponse.Patch), "S-1-5-21-secret")
+		// patches get logged base64-encoded
+		loggedPatch := string(loggedAdmissionResponse(t, logs).Patch)
+		assert.Contains(t, loggedPatch, redactedHash(sensitiveValue))
+		assert.NotContains(t, loggedPatch, "S-1-5-21-secret")
+		assert.NotContains(t, logs.String(), "S-1-5-21-secret")
+		assert.NotContains(t, logs.String(), "env-var-secret")
+	})
+
+	t.Run("denied pods", func(t *testing.T) {
+		logs.Reset()
+
+		admissionResponse := serve("/validate", newPod(`{"sid":"S-1-5-21-forged"}`))
+
+		require.False(t, admissionResponse.Allowed)
+		responseBytes, err := json.Marshal(admissionResponse)
+		require.Nil(t, err)
+		for _, output := range []string{string(responseBytes), logs.String()} {
+			assert.NotContains(t, output, "S-1-5-21-forged")
+			assert.NotContains(t, output, "env-var-secret")
+		}
+		assert.Contains(t, admissionResponse.Result.Message, "does not match the contents of GMSA ab")
+	})
+}
+
+// loggedAdmissionResponse returns the admission response logged in the given JSON logs.
+func loggedAdmissionResponse(t *testing.T, logs *bytes.Buffer) *admissionv1beta1.AdmissionResponse {
+	for _, entry := range parseJSONLogs(t, logs) {
+		message, _ := entry["msg"].(string)
+		if strings.HasPrefix(message, "sending response: ") {
+			review := &admissionv1beta1.AdmissionReview{}
+			require.Nil(t, json.Unmarshal([]byte(strings.TrimPrefix(message, "sending response: ")), review))
+			require.NotNil(t, review.Response)
+			return review.Response
+		}
+	}
+	require.FailNow(t, "no logged response")
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// windowsSchedulingMode controls what the webhook does about pods that use GMSAs, but aren't
+// restricted to run on Windows nodes.
+type windowsSchedulingMode string
+
+const (
+	// windowsSchedulingNone means such pods are left alone.
+	windowsSchedulingNone windowsSchedulingMode = "none"
+	// windowsSchedulingMutate means such pods get a Windows node selector added to them by "/mutate".
+	windowsSchedulingMutate windowsSchedulingMode = "mutate"
+	// windowsSchedulingValidate means such pods get rejected by "/validate".
+	windowsSchedulingValidate windowsSchedulingMode = "validate"
+
+	// namespaceWindowsSchedulingAnnotationKey is the namespace annotation that can be used to
+	// override the webhook's global Windows scheduling mode for a given namespace.
+	namespaceWindowsSchedulingAnnotationKey = "windows.k8s.io/gmsa-windows-scheduling"
+
+	// windowsNodeSelectorKey is the node selector key we add to pods in windowsSchedulingMutate mode;
+	// we use the beta label since it's the only one set on nodes before k8s 1.14.
+	windowsNodeSelectorKey = "beta.kubernetes.io/os"
+)
+
+// parseWindowsSchedulingMode parses a string into a windowsSchedulingMode.
+func parseWindowsSchedulingMode(raw string) (windowsSchedulingMode, error) {
+	switch mode := windowsSchedulingMode(strings.ToLower(raw)); mode {
+	case windowsSchedulingNone, windowsSchedulingMutate, windowsSchedulingValidate:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown Windows scheduling mode %q, valid modes are: %s, %s, %s", raw, windowsSchedulingNone, windowsSchedulingMutate, windowsSchedulingValidate)
+	}
+}
+
+// windowsSchedulingModeFor returns the Windows scheduling mode that applies to the given namespace.
+func (webhook *webhook) windowsSchedulingModeFor(pod *corev1.Pod, namespace string) (windowsSchedulingMode, *podAdmissionError) {
+	ns, code, err := webhook.client.retrieveNamespace(namespace)
+	if err != nil {
+		return "", &podAdmissionError{error: err, pod: pod, code: code}
+	}
+
+	if rawMode, present := ns.Annotations[namespaceWindowsSchedulingAnnotationKey]; present {
+		mode, err := parseWindowsSchedulingMode(rawMode)
+		if err != nil {
+			return "", &podAdmissionError{error: fmt.Errorf("invalid %s annotation on namespace %s: %v", namespaceWindowsSchedulingAnnotationKey, namespace, err), pod: pod, code: http.StatusInternalServerError}
+		}
+		return mode, nil
+	}
+
+	return webhook.config.windowsSchedulingMode, nil
+}
+
+// isRestrictedToWindowsNodes returns true iff the pod can only be scheduled on Windows nodes,
+// either through its node selector or through its required node affinity.
+// Tolerations are not taken into account, since they don't prevent scheduling on other nodes.
+func isRestrictedToWindowsNodes(pod *corev1.Pod) bool {
+	if isWindowsPod(pod) {
+		return true
+	}
+
+	if pod.Spec.Affinity == nil || pod.Spec.Affinity.NodeAffinity == nil ||
+		pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		return false
+	}
+
+	// node selector terms are ORed, so they all need to require Windows
+	terms := pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+	if len(terms) == 0 {
+		return false
+	}
+	for _, term := range terms {
+		if !nodeSelectorTermRequiresWindows(term) {
+			return false
+		}
+	}
+	return true
+}
+
+// nodeSelectorTermRequiresWindows returns true iff the term only matches Windows nodes.
+func nodeSelectorTermRequiresWindows(term corev1.NodeSelectorTerm) bool {
+	// match expressions within a term are ANDed, so it's enough that one of them requires Windows
+	for _, expression := range term.MatchExpressions {
+		if !containsString(osNodeLabels, expression.Key) || expression.Operator != corev1.NodeSelectorOpIn {
+			continue
+		}
+		if len(expression.Values) == 1 && expression.Values[0] == "windows" {
+			return true
+		}
+	}
+	return false
+}
+
+// windowsSchedulingPatches returns the JSON patches needed to restrict a pod to Windows nodes
+// when the namespace is in windowsSchedulingMutate mode.
+func (webhook *webhook) windowsSchedulingPatches(pod *corev1.Pod, namespace string) ([]map[string]interface{}, *podAdmissionError) {
+	if isRestrictedToWindowsNodes(pod) {
+		return nil, nil
+	}
+
+	mode, admissionErr := webhook.windowsSchedulingModeFor(pod, namespace)
+	if admissionErr != nil || mode != windowsSchedulingMutate {
+		return nil, admissionErr
+	}
+
+	// adding a Windows node selector to a pod that selects another OS would make it unschedulable
+	for _, label := range osNodeLabels {
+		if nodeOS, present := pod.Spec.NodeSelector[label]; present {
+			return nil, &podAdmissionError{error: fmt.Errorf("pods using gMSAs must be scheduled on Windows nodes, but the pod's node selector requires %s=%s", label, nodeOS), pod: pod, code: http.StatusForbidden, field: "spec.nodeSelector"}
+		}
+	}
+
+	if pod.Spec.NodeSelector == nil {
+		return []map[string]interface{}{{
+			"op":    "add",
+			"path":  "/spec/nodeSelector",
+			"value": map[string]string{windowsNodeSelectorKey: "windows"},
+		}}, nil
+	}
+	return []map[string]interface{}{{
+		"op":    "add",
+		"path":  fmt.Sprintf("/spec/nodeSelector/%s", jsonPatchEscaper.Replace(windowsNodeSelectorKey)),
+		"value": "windows",
+	}}, nil
+}
+
+// validateWindowsScheduling rejects pods that aren't restricted to Windows nodes, unless the
+// namespace is in windowsSchedulingNone mode; or, for workloads' pod templates, in
+// windowsSchedulingMutate mode, since "/mutate" will then fix the pods created from them.
+func (webhook *webhook) validateWindowsScheduling(pod *corev1.Pod, namespace string, podTemplate bool) *podAdmissionError {
+	if isRestrictedToWindowsNodes(pod) {
+		return nil
+	}
+
+	mode, admissionErr := webhook.windowsSchedulingModeFor(pod, namespace)
+	if admissionErr != nil || mode == windowsSchedulingNone || (podTemplate && mode == windowsSchedulingMutate) {
+		return admissionErr
+	}
+
+	return &podAdmissionError{error: fmt.Errorf("pods using gMSAs must be restricted to Windows nodes, e.g. with a %s=windows node selector", windowsNodeSelectorKey), pod: pod, code: http.StatusForbidden, field: "spec.nodeSelector"}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// serviceAccountCredSpecNameAnnotationKey is the service account annotation that can be used
+	// to bind a GMSA cred spec to a service account: pods running as that service account that
+	// don't request any GMSA get that one.
+	serviceAccountCredSpecNameAnnotationKey = "windows.k8s.io/gmsa-credential-spec-name"
+
+	// defaultServiceAccountName is the service account pods run as if they don't specify one
+	defaultServiceAccountName = "default"
+)
+
+// podServiceAccountName returns the name of the service account the pod runs as; it's not set
+// yet on pods that don't specify one if the service account admission plugin hasn't run.
+func podServiceAccountName(pod *corev1.Pod) string {
+	if pod.Spec.ServiceAccountName == "" {
+		return defaultServiceAccountName
+	}
+	return pod.Spec.ServiceAccountName
+}
+
+// serviceAccountCredSpecName returns the name of the cred spec bound to the pod's service account,
+// if any, as well as a human-readable description of where it comes from.
+func (webhook *webhook) serviceAccountCredSpecName(pod *corev1.Pod, namespace string) (string, string, *podAdmissionError) {
+	serviceAccountName := podServiceAccountName(pod)
+
+	serviceAccount, code, err := webhook.client.retrieveServiceAccount(namespace, serviceAccountName)
+	if err != nil {
+		if code == http.StatusNotFound {
+			// then the service account admission plugin is disabled, nothing to look up
+			return "", "", nil
+		}
+		return "", "", &podAdmissionError{error: err, pod: pod, code: code, field: "spec.serviceAccountName"}
+	}
+
+	if credSpecName := serviceAccount.Annotations[serviceAccountCredSpecNameAnnotationKey]; credSpecName != "" {
+		return credSpecName, fmt.Sprintf("service account %s's %s annotation", serviceAccountName, serviceAccountCredSpecNameAnnotationKey), nil
+	}
+	return "", "", nil
+}
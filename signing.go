@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// signatureAnnotationKeySuffix is appended to contents annotations' keys to get the key of the
+	// annotation holding the signature of their contents.
+	signatureAnnotationKeySuffix = "-signature"
+
+	// signatureVersion is the version of the signature format, in case we need to change it later on
+	signatureVersion = "v1"
+
+	// signingKeysReloadInterval is how often signing keys get re-read from disk, so that rotating
+	// them only requires updating the secret they're mounted from.
+	signingKeysReloadInterval = time.Minute
+
+	// minSigningKeyLength is the minimum length, in bytes, of signing keys; that's the size of the
+	// SHA-256 HMAC's output.
+	minSigningKeyLength = sha256.Size
+)
+
+// signingKeyring holds the keys used to sign the cred spec contents that the webhook injects into
+// pods, so that it can later tell them apart from contents set by users, e.g. when pods get
+// restored from backups.
+// Keys are read from a directory, typically a mounted secret, where each file is a key, and its
+// name is the key's ID. New signatures are made with the key whose ID comes last in lexicographic
+// order, while all keys can be used to verify signatures; so rotating keys is done by adding a new
+// key with a greater ID (e.g. the current date), then removing the old one once no pod signed with
+// it needs to be verified any more.
+type signingKeyring struct {
+	dir string
+
+	mutex       sync.Mutex
+	keys        map[string][]byte
+	activeKeyID string
+	loadedAt    time.Time
+}
+
+func newSigningKeyring(dir string) *signingKeyring {
+	return &signingKeyring{dir: dir}
+}
+
+// current returns the current keys, and the ID of the active one, reloading them if needed.
+func (keyring *signingKeyring) current() (map[string][]byte, string, error) {
+	keyring.mutex.Lock()
+	defer keyring.mutex.Unlock()
+
+	if keyring.keys != nil && time.Since(keyring.loadedAt) < signingKeysReloadInterval {
+		return keyring.keys, keyring.activeKeyID, nil
+	}
+
+	keys, activeKeyID, err := loadSigningKeys(keyring.dir)
+	if err != nil {
+		if keyring.keys == nil {
+			return nil, "", err
+		}
+		// keep using the previous keys rather than failing all requests
+		logrus.Errorf("unable to reload signing keys, keeping the previous ones: %v", err)
+	} else {
+		keyring.keys = keys
+		keyring.activeKeyID = activeKeyID
+	}
+	keyring.loadedAt = time.Now()
+
+	return keyring.keys, keyring.activeKeyID, nil
+}
+
+func loadSigningKeys(dir string) (map[string][]byte, string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to list signing keys in %s: %v", dir, err)
+	}
+
+	keys := make(map[string][]byte)
+	var keyIDs []string
+	for _, file := range files {
+		// mounted secrets contain hidden directories and symlinks that k8s uses for atomic updates
+		if strings.HasPrefix(file.Name(), ".") || file.IsDir() {
+			continue
+		}
+
+		key, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, "", fmt.Errorf("unable to read signing key %s: %v", file.Name(), err)
+		}
+		if len(key) < minSigningKeyLength {
+			return nil, "", fmt.Errorf("signing key %s is too short: it should be at least %d bytes long, got %d", file.Name(), minSigningKeyLength, len(key))
+		}
+
+		keys[file.Name()] = key
+		keyIDs = append(keyIDs, file.Name())
+	}
+
+	if len(keyIDs) == 0 {
+		return nil, "", fmt.Errorf("no signing key found in %s", dir)
+	}
+	sort.Strings(keyIDs)
+
+	return keys, keyIDs[len(keyIDs)-1], nil
+}
+
+// signedMessage is what gets signed: the contents are bound to the namespace, container and
+// cred spec they were injected for. The pod's UID is not part of it, since it is not set yet
+// when mutating webhooks are called, and restored pods get new ones anyway.
+// The contents are canonicalized first, so that re-serializing them doesn't invalidate signatures.
+func signedMessage(namespace, containerName, credSpecName, contents string) []byte {
+	contentsHash := sha256.Sum256([]byte(canonicalJSON(contents)))
+	return []byte(fmt.Sprintf("%s\n%s\n%s\n%s\n%x", signatureVersion, namespace, containerName, credSpecName, contentsHash))
+}
+
+func computeSignature(key []byte, message []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(message)
+	return mac.Sum(nil)
+}
+
+// sign returns the signature for the given contents, using the active key.
+func (keyring *signingKeyring) sign(namespace, containerName, credSpecName, contents string) (string, error) {
+	keys, activeKeyID, err := keyring.current()
+	if err != nil {
+		return "", err
+	}
+
+	signature := computeSignature(keys[activeKeyID], signedMessage(namespace, containerName, credSpecName, contents))
+	return fmt.Sprintf("%s:%s:%s", signatureVersion, activeKeyID, base64.StdEncoding.EncodeToString(signature)), nil
+}
+
+// verify returns an error if the signature doesn't match the given contents.
+func (keyring *signingKeyring) verify(signature, namespace, containerName, credSpecName, contents string) error {
+	parts := strings.SplitN(signature, ":", 3)
+	if len(parts) != 3 || parts[0] != signatureVersion {
+		return fmt.Errorf("malformed signature")
+	}
+	keyID := parts[1]
+	actualSignature, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("malformed signature: %v", err)
+	}
+
+	keys, _, err := keyring.current()
+	if err != nil {
+		return err
+	}
+	key, present := keys[keyID]
+	if !present {
+		return &unknownSigningKeyError{keyID: keyID}
+	}
+
+	expectedSignature := computeSignature(key, signedMessage(namespace, containerName, credSpecName, contents))
+	if !hmac.Equal(actualSignature, expectedSignature) {
+		return fmt.Errorf("signature does not match")
+	}
+	return nil
+}
+
+// unknownSigningKeyError is returned when verifying signatures made with keys that are not part
+// of the keyring, typically because they have been rotated out.
+type unknownSigningKeyError struct {
+	keyID string
+}
+
+func (err *unknownSigningKeyError) Error() string {
+	return fmt.Sprintf("signed with unknown key %q, which may have been rotated out", err.keyID)
+}
+
+// signatureAnnotationKey returns the key of the annotation holding the signature of the given
+// contents annotation.
+func signatureAnnotationKey(contentsKey string) string {
+	return contentsKey + signatureAnnotationKeySuffix
+}
+
+// containerNameForContentsKey returns the name of the container a contents annotation applies
+// to, or an empty string for the pod-level one.
+func containerNameForContentsKey(contentsKey string) string {
+	if contentsKey == gMSAPodSpecContentsAnnotationKey {
+		return ""
+	}
+	return strings.TrimSuffix(contentsKey, gMSAContainerSpecContentsAnnotationKeySuffix)
+}
+
+// verifyContentsSignature checks the signature of a pod's contents annotation: it returns true
+// iff the signature is valid, and an error iff it's present but invalid. Signatures made with
+// keys that have since been rotated out can't be told apart from forged ones, so these contents
+// are treated as unsigned rather than denied. It always returns false if signing is disabled.
+func (webhook *webhook) verifyContentsSignature(admissionCtx *admissionContext, pod *corev1.Pod, credSpecName, contentsKey string) (bool, *podAdmissionError) {
+	signatureKey := signatureAnnotationKey(contentsKey)
+	signature, present := pod.Annotations[signatureKey]
+	if webhook.signingKeys == nil || !present {
+		return false, nil
+	}
+
+	if _, _, err := webhook.signingKeys.current(); err != nil {
+		return false, &podAdmissionError{error: fmt.Errorf("unable to verify signature in annotation %s: %v", signatureKey, err), pod: pod, code: http.StatusInternalServerError}
+	}
+	if err := webhook.signingKeys.verify(signature, admissionCtx.namespace, containerNameForContentsKey(contentsKey), credSpecName, pod.Annotations[contentsKey]); err != nil {
+		if _, unknownKey := err.(*unknownSigningKeyError); unknownKey {
+			admissionCtx.logger.Infof("ignoring signature in annotation %s: %v", signatureKey, err)
+			return false, nil
+		}
+		return false, &podAdmissionError{error: fmt.Errorf("invalid signature in annotation %s: %v", signatureKey, err), pod: pod, code: http.StatusForbidden, field: annotationField(signatureKey)}
+	}
+	return true, nil
+}
+
+// signaturePatches returns the JSON patches adding the signature of the given contents to the
+// pod, if signing is enabled.
+func (webhook *webhook) signaturePatches(admissionCtx *admissionContext, pod *corev1.Pod, credSpecName, contentsKey, contents string) ([]map[string]interface{}, *podAdmissionError) {
+	if webhook.signingKeys == nil {
+		return nil, nil
+	}
+
+	signature, err := webhook.signingKeys.sign(admissionCtx.namespace, containerNameForContentsKey(contentsKey), credSpecName, contents)
+	if err != nil {
+		return nil, &podAdmissionError{error: fmt.Errorf("unable to sign gMSA cred spec contents: %v", err), pod: pod, code: http.StatusInternalServerError}
+	}
+
+	// "add" operations replace existing values, if any
+	return []map[string]interface{}{{
+		"op":    "add",
+		"path":  fmt.Sprintf("/metadata/annotations/%s", jsonPatchEscaper.Replace(signatureAnnotationKey(contentsKey))),
+		"value": signature,
+	}}, nil
+}
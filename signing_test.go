@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeSigningKey(t *testing.T, dir, keyID string, length int) {
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, keyID), bytes.Repeat([]byte(keyID[:1]), length), 0600))
+}
+
+func TestSigningKeyringSignsAndVerifies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signing-keys")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	writeSigningKey(t, dir, "1-old", minSigningKeyLength)
+
+	keyring := newSigningKeyring(dir)
+
+	signature, err := keyring.sign("default", "container", "credspec-0", "contents")
+	require.Nil(t, err)
+	assert.Contains(t, signature, "v1:1-old:")
+	assert.Nil(t, keyring.verify(signature, "default", "container", "credspec-0", "contents"))
+
+	// any change to the signed data invalidates the signature
+	assert.NotNil(t, keyring.verify(signature, "other", "container", "credspec-0", "contents"))
+	assert.NotNil(t, keyring.verify(signature, "default", "", "credspec-0", "contents"))
+	assert.NotNil(t, keyring.verify(signature, "default", "container", "credspec-1", "contents"))
+	assert.NotNil(t, keyring.verify(signature, "default", "container", "credspec-0", "other contents"))
+	assert.NotNil(t, keyring.verify("v1:1-old:bm9wZQ==", "default", "container", "credspec-0", "contents"))
+	assert.NotNil(t, keyring.verify("garbage", "default", "container", "credspec-0", "contents"))
+
+	// re-serializing the contents doesn't invalidate signatures, including with numbers written differently
+	contentsSignature, err := keyring.sign("default", "container", "credspec-0", `{"Version":1,"Name":"WebApp1"}`)
+	require.Nil(t, err)
+	for _, reserialized := range []string{`{"Name": "WebApp1", "Version": 1}`, `{"Name":"WebApp1","Version":1.0}`, `{"Name":"WebApp1","Version":1e0}`} {
+		assert.Nil(t, keyring.verify(contentsSignature, "default", "container", "credspec-0", reserialized), reserialized)
+	}
+	assert.NotNil(t, keyring.verify(contentsSignature, "default", "container", "credspec-0", `{"Name":"WebApp1","Version":1.5}`))
+
+	// rotate keys: the new key gets used for new signatures, the old one can still verify
+	writeSigningKey(t, dir, "2-new", minSigningKeyLength)
+	keyring.loadedAt = time.Time{}
+
+	newSignature, err := keyring.sign("default", "container", "credspec-0", "contents")
+	require.Nil(t, err)
+	assert.Contains(t, newSignature, "v1:2-new:")
+	assert.Nil(t, keyring.verify(newSignature, "default", "container", "credspec-0", "contents"))
+	assert.Nil(t, keyring.verify(signature, "default", "container", "credspec-0", "contents"))
+
+	// then retire the old key
+	require.Nil(t, os.Remove(filepath.Join(dir, "1-old")))
+	keyring.loadedAt = time.Time{}
+
+	err = keyring.verify(signature, "default", "container", "credspec-0", "contents")
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), `unknown key "1-old"`)
+	}
+}
+
+func TestSigningKeyringErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signing-keys")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = newSigningKeyring(dir).sign("default", "", "credspec-0", "contents")
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "no signing key found")
+	}
+
+	writeSigningKey(t, dir, "short", minSigningKeyLength-1)
+	_, err = newSigningKeyring(dir).sign("default", "", "credspec-0", "contents")
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "signing key short is too short")
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// cipherSuites are the cipher suites that can be enabled, by their IANA names; this only lists
+// suites with forward secrecy, since the API server supports those.
+var cipherSuites = map[string]uint16{
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256":       tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384":       tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256": tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256":   tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+}
+
+// defaultCipherSuites are the AEAD subset of cipherSuites.
+var defaultCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+}
+
+// parseCipherSuites parses a comma-separated list of cipher suite names; an empty list yields
+// the default cipher suites.
+func parseCipherSuites(raw string) ([]uint16, error) {
+	if strings.TrimSpace(raw) == "" {
+		return defaultCipherSuites, nil
+	}
+
+	var suites []uint16
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		suite, present := cipherSuites[name]
+		if !present {
+			validNames := make([]string, 0, len(cipherSuites))
+			for validName := range cipherSuites {
+				validNames = append(validNames, validName)
+			}
+			sort.Strings(validNames)
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q, valid cipher suites are: %s", name, strings.Join(validNames, ", "))
+		}
+		suites = append(suites, suite)
+	}
+	return suites, nil
+}
+
+// serverTLSConfig builds the TLS configuration for the webhook's server: TLS 1.2 at least,
+// and, if a client CA is configured, mandatory client certificates signed by that CA.
+func (tlsConfig *tlsConfig) serverTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:               tls.VersionTLS12,
+		CipherSuites:             tlsConfig.cipherSuites,
+		PreferServerCipherSuites: true,
+	}
+	if len(config.CipherSuites) == 0 {
+		config.CipherSuites = defaultCipherSuites
+	}
+
+	if tlsConfig.clientCAPath != "" {
+		caBytes, err := ioutil.ReadFile(tlsConfig.clientCAPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read client CA file %s: %v", tlsConfig.clientCAPath, err)
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caBytes) {
+			return nil, fmt.Errorf("no valid PEM certificate found in client CA file %s", tlsConfig.clientCAPath)
+		}
+		config.ClientCAs = clientCAs
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
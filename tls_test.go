@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCipherSuites(t *testing.T) {
+	suites, err := parseCipherSuites("")
+	assert.Nil(t, err)
+	assert.Equal(t, defaultCipherSuites, suites)
+
+	suites, err = parseCipherSuites(" TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,")
+	assert.Nil(t, err)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA}, suites)
+
+	_, err = parseCipherSuites("TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,TLS_RSA_WITH_RC4_128_SHA")
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), `unknown or insecure cipher suite "TLS_RSA_WITH_RC4_128_SHA"`)
+	}
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	t.Run("without client CA", func(t *testing.T) {
+		config, err := (&tlsConfig{}).serverTLSConfig()
+		require.Nil(t, err)
+
+		assert.Equal(t, uint16(tls.VersionTLS12), config.MinVersion)
+		assert.Equal(t, defaultCipherSuites, config.CipherSuites)
+		assert.Equal(t, tls.NoClientCert, config.ClientAuth)
+	})
+
+	t.Run("with client CA", func(t *testing.T) {
+		// any PEM certificate will do
+		server := httptest.NewTLSServer(nil)
+		defer server.Close()
+		caFile := writeTempFile(t, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+		defer os.Remove(caFile)
+
+		config, err := (&tlsConfig{clientCAPath: caFile}).serverTLSConfig()
+		require.Nil(t, err)
+
+		assert.Equal(t, tls.RequireAndVerifyClientCert, config.ClientAuth)
+		assert.Equal(t, 1, len(config.ClientCAs.Subjects()))
+	})
+
+	t.Run("with invalid client CA", func(t *testing.T) {
+		caFile := writeTempFile(t, []byte("not a certificate"))
+		defer os.Remove(caFile)
+
+		_, err := (&tlsConfig{clientCAPath: caFile}).serverTLSConfig()
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), "no valid PEM certificate found")
+		}
+	})
+}
+
+func writeTempFile(t *testing.T, contents []byte) string {
+	file, err := ioutil.TempFile("", "gmsa-webhook-test")
+	require.Nil(t, err)
+	defer file.Close()
+
+	_, err = file.Write(contents)
+	require.Nil(t, err)
+	return file.Name()
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The OpenTelemetry Go SDK requires a more recent Go version than what we build with, so this
+// file implements the small subset of it we need: spans, W3C trace context propagation, and an
+// exporter speaking OTLP's HTTP/JSON protocol (see https://opentelemetry.io/docs/specs/otlp/).
+
+const (
+	// otlpTracesPath is appended to the configured OTLP endpoint, as per the OTLP spec.
+	otlpTracesPath = "/v1/traces"
+
+	// tracerBatchSize is how many spans get exported at once at most.
+	tracerBatchSize = 512
+	// tracerQueueSize is how many spans can be waiting to be exported; spans ended while the
+	// queue is full get dropped.
+	tracerQueueSize = 4 * tracerBatchSize
+	// tracerExportInterval is how often pending spans get exported.
+	tracerExportInterval = 5 * time.Second
+	// tracerExportTimeout bounds each export request.
+	tracerExportTimeout = 10 * time.Second
+
+	// traceparentHeader is the W3C trace context header, see https://www.w3.org/TR/trace-context/
+	traceparentHeader = "traceparent"
+)
+
+type spanKind int
+
+// these are OTLP's span kinds
+const (
+	spanKindInternal spanKind = 1
+	spanKindServer   spanKind = 2
+	spanKindClient   spanKind = 3
+)
+
+// these are OTLP's status codes
+const (
+	spanStatusOK    = 1
+	spanStatusError = 2
+)
+
+// tracer creates spans, and exports them in the background once they end.
+// A nil tracer is valid, and creates nil spans, which are no-ops.
+type tracer struct {
+	endpoint    string
+	serviceName string
+	httpClient  *http.Client
+
+	queue    chan *span
+	flushReq chan chan struct{}
+	stopOnce sync.Once
+	stopped  chan struct{}
+}
+
+// newTracer starts a tracer exporting spans to the given OTLP/HTTP endpoint, e.g.
+// "http://otel-collector:4318".
+func newTracer(endpoint, serviceName string) *tracer {
+	tracer := &tracer{
+		endpoint:    strings.TrimSuffix(endpoint, "/") + otlpTracesPath,
+		serviceName: serviceName,
+		httpClient:  &http.Client{Timeout: tracerExportTimeout},
+		queue:       make(chan *span, tracerQueueSize),
+		flushReq:    make(chan chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+	go tracer.run()
+	return tracer
+}
+
+// span is a single timed operation within a trace.
+type span struct {
+	tracer *tracer
+
+	traceID      [16]byte
+	spanID       [8]byte
+	parentSpanID [8]byte
+	name         string
+	kind         spanKind
+	start        time.Time
+	end          time.Time
+	attributes   map[string]interface{}
+	statusCode   int
+	statusMsg    string
+}
+
+// startSpan starts a new span; if parent is nil, the span starts a new trace.
+func (tracer *tracer) startSpan(name string, parent *span, kind spanKind) *span {
+	if tracer == nil {
+		return nil
+	}
+
+	span := &span{
+		tracer:     tracer,
+		name:       name,
+		kind:       kind,
+		start:      time.Now(),
+		attributes: make(map[string]interface{}),
+	}
+	if parent != nil {
+		span.traceID = parent.traceID
+		span.parentSpanID = parent.spanID
+	} else {
+		randomBytes(span.traceID[:])
+	}
+	randomBytes(span.spanID[:])
+
+	return span
+}
+
+// startServerSpan starts a span for an incoming HTTP request, continuing the caller's trace
+// if the request carries a valid W3C traceparent header.
+func (tracer *tracer) startServerSpan(name string, request *http.Request) *span {
+	return tracer.startSpan(name, remoteParentSpan(request.Header.Get(traceparentHeader)), spanKindServer)
+}
+
+// remoteParentSpan parses a W3C traceparent header into a span that can be used as a parent,
+// or returns nil if the header is absent or invalid.
+func remoteParentSpan(traceparent string) *span {
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return nil
+	}
+
+	parent := &span{}
+	if _, err := hex.Decode(parent.traceID[:], []byte(parts[1])); err != nil || parent.traceID == [16]byte{} {
+		return nil
+	}
+	if _, err := hex.Decode(parent.spanID[:], []byte(parts[2])); err != nil || parent.spanID == [8]byte{} {
+		return nil
+	}
+	return parent
+}
+
+func randomBytes(buffer []byte) {
+	if _, err := rand.Read(buffer); err != nil {
+		logrus.Warningf("unable to generate random trace IDs: %v", err)
+	}
+}
+
+// setAttribute sets an attribute on the span; values should be strings, bools, or ints.
+func (span *span) setAttribute(key string, value interface{}) {
+	if span != nil {
+		span.attributes[key] = value
+	}
+}
+
+// recordError marks the span as failed.
+func (span *span) recordError(err error) {
+	if span != nil && err != nil {
+		span.statusCode = spanStatusError
+		span.statusMsg = err.Error()
+	}
+}
+
+// finish ends the span, and queues it for export.
+func (span *span) finish() {
+	if span == nil {
+		return
+	}
+	span.end = time.Now()
+
+	select {
+	case span.tracer.queue <- span:
+	default:
+		logrus.Warningf("tracing queue full, dropping span %s", span.name)
+	}
+}
+
+type spanContextKey struct{}
+
+// contextWithSpan returns a copy of ctx carrying the given span.
+func contextWithSpan(ctx context.Context, span *span) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, span)
+}
+
+// spanFromContext returns the span carried by ctx, if any.
+func spanFromContext(ctx context.Context) *span {
+	span, _ := ctx.Value(spanContextKey{}).(*span)
+	return span
+}
+
+func (tracer *tracer) run() {
+	ticker := time.NewTicker(tracerExportInterval)
+	defer ticker.Stop()
+
+	batch := make([]*span, 0, tracerBatchSize)
+	export := func() {
+		if len(batch) != 0 {
+			tracer.export(batch)
+			batch = make([]*span, 0, tracerBatchSize)
+		}
+	}
+	drain := func() {
+		for {
+			select {
+			case span := <-tracer.queue:
+				batch = append(batch, span)
+				if len(batch) == tracerBatchSize {
+					export()
+				}
+			default:
+				export()
+				return
+			}
+		}
+	}
+
+	for {
+		select {
+		case span := <-tracer.queue:
+			batch = append(batch, span)
+			if len(batch) == tracerBatchSize {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		case done := <-tracer.flushReq:
+			drain()
+			close(done)
+		case <-tracer.stopped:
+			drain()
+			return
+		}
+	}
+}
+
+// flush synchronously exports all the spans that have ended so far.
+func (tracer *tracer) flush() {
+	if tracer == nil {
+		return
+	}
+	done := make(chan struct{})
+	select {
+	case tracer.flushReq <- done:
+		<-done
+	case <-tracer.stopped:
+	}
+}
+
+// stop flushes pending spans, and stops the background exporter.
+func (tracer *tracer) stop() {
+	if tracer == nil {
+		return
+	}
+	tracer.flush()
+	tracer.stopOnce.Do(func() {
+		close(tracer.stopped)
+	})
+}
+
+// the following types are the JSON representation of OTLP's ExportTraceServiceRequest
+
+type otlpExportRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              spanKind       `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+	// OTLP's JSON encoding represents 64-bit integers as strings
+	IntValue *string `json:"intValue,omitempty"`
+}
+
+func newOTLPKeyValue(key string, value interface{}) otlpKeyValue {
+	keyValue := otlpKeyValue{Key: key}
+	switch typedValue := value.(type) {
+	case bool:
+		keyValue.Value.BoolValue = &typedValue
+	case int:
+		intValue := strconv.Itoa(typedValue)
+		keyValue.Value.IntValue = &intValue
+	case string:
+		keyValue.Value.StringValue = &typedValue
+	default:
+		stringValue := fmt.Sprintf("%v", value)
+		keyValue.Value.StringValue = &stringValue
+	}
+	return keyValue
+}
+
+func (span *span) toOTLP() otlpSpan {
+	otlp := otlpSpan{
+		TraceID:           hex.EncodeToString(span.traceID[:]),
+		SpanID:            hex.EncodeToString(span.spanID[:]),
+		Name:              span.name,
+		Kind:              span.kind,
+		StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.end.UnixNano(), 10),
+		Status:            otlpStatus{Code: span.statusCode, Message: span.statusMsg},
+	}
+	if span.parentSpanID != [8]byte{} {
+		otlp.ParentSpanID = hex.EncodeToString(span.parentSpanID[:])
+	}
+	if otlp.Status.Code == 0 && span.kind == spanKindServer {
+		otlp.Status.Code = spanStatusOK
+	}
+
+	for _, key := range sortedAttributeKeys(span.attributes) {
+		otlp.Attributes = append(otlp.Attributes, newOTLPKeyValue(key, span.attributes[key]))
+	}
+
+	return otlp
+}
+
+func sortedAttributeKeys(attributes map[string]interface{}) []string {
+	stringMap := make(map[string]string, len(attributes))
+	for key := range attributes {
+		stringMap[key] = ""
+	}
+	return sortedKeys(stringMap)
+}
+
+// export sends a batch of spans to the OTLP endpoint; failures are logged, and the spans dropped.
+func (tracer *tracer) export(batch []*span) {
+	spans := make([]otlpSpan, len(batch))
+	for i, span := range batch {
+		spans[i] = span.toOTLP()
+	}
+
+	exportRequest := otlpExportRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpKeyValue{newOTLPKeyValue("service.name", tracer.serviceName)},
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: eventSourceComponent},
+				Spans: spans,
+			}},
+		}},
+	}
+
+	body, err := json.Marshal(exportRequest)
+	if err != nil {
+		logrus.Errorf("unable to marshall %d spans: %v", len(batch), err)
+		return
+	}
+
+	response, err := tracer.httpClient.Post(tracer.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logrus.Errorf("unable to export %d spans to %s: %v", len(batch), tracer.endpoint, err)
+		return
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		logrus.Errorf("unable to export %d spans to %s: got HTTP code %d", len(batch), tracer.endpoint, response.StatusCode)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// collectorStandIn is a minimal stand-in for an OpenTelemetry collector's OTLP/HTTP receiver.
+type collectorStandIn struct {
+	*httptest.Server
+
+	mutex    sync.Mutex
+	requests []otlpExportRequest
+	errors   []string
+}
+
+func newCollectorStandIn() *collectorStandIn {
+	collector := &collectorStandIn{}
+	collector.Server = httptest.NewServer(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		collector.mutex.Lock()
+		defer collector.mutex.Unlock()
+
+		if request.Method != "POST" || request.URL.Path != otlpTracesPath || request.Header.Get("Content-Type") != "application/json" {
+			collector.errors = append(collector.errors, fmt.Sprintf("unexpected request %s %s with content type %q", request.Method, request.URL.Path, request.Header.Get("Content-Type")))
+			responseWriter.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		exportRequest := otlpExportRequest{}
+		if err := json.NewDecoder(request.Body).Decode(&exportRequest); err != nil {
+			collector.errors = append(collector.errors, err.Error())
+			responseWriter.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		collector.requests = append(collector.requests, exportRequest)
+	}))
+	return collector
+}
+
+func (collector *collectorStandIn) spans(t *testing.T) []otlpSpan {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+
+	require.Empty(t, collector.errors)
+
+	var spans []otlpSpan
+	for _, exportRequest := range collector.requests {
+		require.Equal(t, 1, len(exportRequest.ResourceSpans))
+		resourceSpans := exportRequest.ResourceSpans[0]
+
+		require.Equal(t, 1, len(resourceSpans.Resource.Attributes))
+		assert.Equal(t, "service.name", resourceSpans.Resource.Attributes[0].Key)
+		if assert.NotNil(t, resourceSpans.Resource.Attributes[0].Value.StringValue) {
+			assert.Equal(t, "test-service", *resourceSpans.Resource.Attributes[0].Value.StringValue)
+		}
+
+		for _, scopeSpans := range resourceSpans.ScopeSpans {
+			spans = append(spans, scopeSpans.Spans...)
+		}
+	}
+	return spans
+}
+
+func TestTracerExportsSpansToOTLPEndpoint(t *testing.T) {
+	collector := newCollectorStandIn()
+	defer collector.Close()
+
+	tracer := newTracer(collector.URL+"/", "test-service")
+
+	request := httptest.NewRequest("POST", "/validate", nil)
+	request.Header.Set(traceparentHeader, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	root := tracer.startServerSpan("ServeHTTP", request)
+	child := tracer.startSpan("isAuthorizedToUseCredSpec", root, spanKindClient)
+	child.setAttribute("gmsa.credspec.name", "credspec-0")
+	child.setAttribute("gmsa.authorized", false)
+	child.setAttribute("http.status_code", 403)
+	child.recordError(fmt.Errorf("not authorized"))
+	child.finish()
+	root.finish()
+
+	tracer.stop()
+
+	spans := collector.spans(t)
+	require.Equal(t, 2, len(spans))
+	childSpan, rootSpan := spans[0], spans[1]
+
+	assert.Equal(t, "ServeHTTP", rootSpan.Name)
+	assert.Equal(t, spanKindServer, rootSpan.Kind)
+	assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", rootSpan.TraceID)
+	assert.Equal(t, "b7ad6b7169203331", rootSpan.ParentSpanID)
+	assert.Equal(t, spanStatusOK, rootSpan.Status.Code)
+
+	assert.Equal(t, "isAuthorizedToUseCredSpec", childSpan.Name)
+	assert.Equal(t, spanKindClient, childSpan.Kind)
+	assert.Equal(t, rootSpan.TraceID, childSpan.TraceID)
+	assert.Equal(t, rootSpan.SpanID, childSpan.ParentSpanID)
+	assert.Equal(t, spanStatusError, childSpan.Status.Code)
+	assert.Equal(t, "not authorized", childSpan.Status.Message)
+
+	spanID, err := hex.DecodeString(childSpan.SpanID)
+	require.Nil(t, err)
+	assert.Equal(t, 8, len(spanID))
+	assert.NotEqual(t, rootSpan.SpanID, childSpan.SpanID)
+
+	require.Equal(t, 3, len(childSpan.Attributes))
+	// attributes are sorted by key
+	assert.Equal(t, "gmsa.authorized", childSpan.Attributes[0].Key)
+	if assert.NotNil(t, childSpan.Attributes[0].Value.BoolValue) {
+		assert.False(t, *childSpan.Attributes[0].Value.BoolValue)
+	}
+	assert.Equal(t, "gmsa.credspec.name", childSpan.Attributes[1].Key)
+	if assert.NotNil(t, childSpan.Attributes[1].Value.StringValue) {
+		assert.Equal(t, "credspec-0", *childSpan.Attributes[1].Value.StringValue)
+	}
+	assert.Equal(t, "http.status_code", childSpan.Attributes[2].Key)
+	if assert.NotNil(t, childSpan.Attributes[2].Value.IntValue) {
+		assert.Equal(t, "403", *childSpan.Attributes[2].Value.IntValue)
+	}
+}
+
+func TestTracerStartsNewTracesWithoutValidTraceparent(t *testing.T) {
+	for _, traceparent := range []string{
+		"",
+		"garbage",
+		"00-00000000000000000000000000000000-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319c-0000000000000000-01",
+		"ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319z-b7ad6b7169203331-01",
+	} {
+		t.Run(traceparent, func(t *testing.T) {
+			assert.Nil(t, remoteParentSpan(traceparent))
+		})
+	}
+}
+
+func TestNilTracerIsANoOp(t *testing.T) {
+	var tracer *tracer
+
+	span := tracer.startServerSpan("ServeHTTP", httptest.NewRequest("POST", "/mutate", nil))
+	assert.Nil(t, span)
+
+	span.setAttribute("key", "value")
+	span.recordError(fmt.Errorf("error"))
+	span.finish()
+	tracer.stop()
+}
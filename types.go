@@ -1,11 +1,117 @@
 package main
 
+import (
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
 type tlsConfig struct {
 	crtPath string
 	keyPath string
+	// cipherSuites are the cipher suites to enable; defaults to defaultCipherSuites if empty
+	cipherSuites []uint16
+	// clientCAPath, if set, is the path to the CA bundle that clients' certificates must be signed
+	// with; clients without such a certificate get rejected
+	clientCAPath string
+}
+
+// serverTimeouts bound how long the webhook's HTTP server waits on clients.
+type serverTimeouts struct {
+	read  time.Duration
+	write time.Duration
+	idle  time.Duration
+}
+
+type webhookConfig struct {
+	// enforcementMode is the default enforcement mode, that can be overridden per namespace
+	enforcementMode enforcementMode
+	// windowsSchedulingMode is the default Windows scheduling mode, that can be overridden
+	// per namespace
+	windowsSchedulingMode windowsSchedulingMode
+	// denialEvents controls whether to emit events on the workloads owning denied pods
+	denialEvents bool
+	// gaGMSAFieldsAvailable is true if the API server supports GA GMSA fields in pod specs,
+	// and we should then warn about uses of the alpha annotations
+	gaGMSAFieldsAvailable bool
+	// sharedCredSpecWarningThreshold is the number of namespaces using the same cred spec
+	// at which we start warning about it; 0 disables these warnings
+	sharedCredSpecWarningThreshold int
+	// otlpEndpoint is the OTLP/HTTP endpoint to export traces to; empty disables tracing
+	otlpEndpoint string
+	// tracingServiceName is the service name reported in traces
+	tracingServiceName string
+	// timeouts are the HTTP servers' timeouts
+	timeouts serverTimeouts
+	// opsPort is the port of the plain HTTP server serving health checks and metrics;
+	// 0 disables it
+	opsPort int
+	// pprof controls whether the ops server also serves profiling data
+	pprof bool
+	// signingKeysDir is the directory containing the keys used to sign injected cred spec
+	// contents, see signingKeyring; empty disables signing
+	signingKeysDir string
 }
 
 type kubeClientInterface interface {
 	isAuthorizedToUseCredSpec(serviceAccountName, namespace, credSpecName string) (authorized bool, reason string)
+	isUserAuthorizedToUseCredSpec(userInfo authenticationv1.UserInfo, namespace, credSpecName string) (authorized bool, reason string)
 	retrieveCredSpecContents(credSpecName string) (contents string, httpCode int, err error)
+	retrieveCredSpecLabels(credSpecName string) (labels map[string]string, httpCode int, err error)
+	retrieveNamespace(name string) (namespace *corev1.Namespace, httpCode int, err error)
+	listGMSAPolicies(namespace string) (policies []*gmsaPolicy, httpCode int, err error)
+	retrieveServiceAccount(namespace, name string) (serviceAccount *corev1.ServiceAccount, httpCode int, err error)
+	recordEvent(object *corev1.ObjectReference, eventType, reason, message string)
+}
+
+// grantsClientInterface is what the grants controller needs from k8s. Retrieval methods return
+// nil objects and no error for objects that don't exist, and deletion methods don't return
+// errors for them either.
+type grantsClientInterface interface {
+	watchGMSAGrants(handler cache.ResourceEventHandler)
+	retrieveGMSAGrant(namespace, name string) (grant *gmsaGrant, err error)
+	updateGMSAGrantStatus(grant *gmsaGrant) error
+	retrieveNamespace(name string) (namespace *corev1.Namespace, httpCode int, err error)
+	retrieveCredSpecLabels(credSpecName string) (labels map[string]string, httpCode int, err error)
+	retrieveServiceAccount(namespace, name string) (serviceAccount *corev1.ServiceAccount, httpCode int, err error)
+	retrieveRole(namespace, name string) (role *rbacv1.Role, err error)
+	saveRole(role *rbacv1.Role) error
+	deleteRole(namespace, name string) error
+	retrieveRoleBinding(namespace, name string) (roleBinding *rbacv1.RoleBinding, err error)
+	saveRoleBinding(roleBinding *rbacv1.RoleBinding) error
+	deleteRoleBinding(namespace, name string) error
+}
+
+// credSpecUsageClientInterface is what the cred spec usage controller needs from k8s.
+type credSpecUsageClientInterface interface {
+	watchGMSACredSpecs(handler cache.ResourceEventHandler)
+	watchGMSAPods(handler cache.ResourceEventHandler) error
+	listPodsUsingCredSpec(credSpecName string) (pods []*corev1.Pod, err error)
+	retrieveCredSpecUsage(credSpecName string) (usage *credSpecUsage, exists bool, err error)
+	updateCredSpecUsage(credSpecName string, usage *credSpecUsage) error
+}
+
+// reauthorizationClientInterface is what the reauthorization controller needs from k8s.
+type reauthorizationClientInterface interface {
+	watchGMSAPods(handler cache.ResourceEventHandler) error
+	listGMSAPods() (pods []*corev1.Pod, err error)
+	retrieveCachedPod(namespace, name string) (pod *corev1.Pod, err error)
+	checkCredSpecUseAuthorization(serviceAccountName, namespace, credSpecName string) (authorized bool, reason string, err error)
+	evictPod(pod *corev1.Pod) error
+	recordEvent(object *corev1.ObjectReference, eventType, reason, message string)
+}
+
+// driftClientInterface is what the drift controller needs from k8s.
+type driftClientInterface interface {
+	watchGMSACredSpecs(handler cache.ResourceEventHandler)
+	watchGMSAPods(handler cache.ResourceEventHandler) error
+	listPodsUsingCredSpec(credSpecName string) (pods []*corev1.Pod, err error)
+	retrieveCachedCredSpecContents(credSpecName string) (contents string, annotations map[string]string, exists bool, err error)
+	retrieveCredSpecStalePods(credSpecName string) (stale *credSpecUsage, exists bool, err error)
+	updateCredSpecStalePods(credSpecName string, stale *credSpecUsage) error
+	restartWorkload(namespace, kind, name, credSpecName, revision string) (restarted bool, err error)
+	recordEvent(object *corev1.ObjectReference, eventType, reason, message string)
 }
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	credSpecUsageControllerName    = "gmsa-cred-spec-usage"
+	credSpecUsageControllerWorkers = 2
+
+	// credSpecUsageStatusField is the field of cred specs' status that the usage controller
+	// maintains.
+	credSpecUsageStatusField = "usage"
+
+	// maxReportedCredSpecUsages caps how many namespaces and workloads get listed in a cred
+	// spec's usage, to keep cred spec objects small.
+	maxReportedCredSpecUsages = 50
+
+	// credSpecNamePodIndex is the name of the pod informer's index on the names of the cred
+	// specs pods use.
+	credSpecNamePodIndex = "gmsaCredSpecName"
+)
+
+// credSpecUsage describes which running pods use a given cred spec.
+type credSpecUsage struct {
+	PodCount int `json:"podCount"`
+
+	// Namespaces lists, in alphabetical order, up to maxReportedCredSpecUsages of the
+	// NamespaceCount namespaces these pods run in.
+	NamespaceCount int      `json:"namespaceCount"`
+	Namespaces     []string `json:"namespaces,omitempty"`
+
+	// Workloads lists, sorted by namespace then kind then name, up to maxReportedCredSpecUsages
+	// of the WorkloadCount workloads these pods belong to.
+	WorkloadCount int                     `json:"workloadCount"`
+	Workloads     []credSpecWorkloadUsage `json:"workloads,omitempty"`
+}
+
+type credSpecWorkloadUsage struct {
+	Namespace string `json:"namespace"`
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	PodCount  int    `json:"podCount"`
+}
+
+// credSpecUsageController maintains the usage reported in cred specs' status, based on the GMSA
+// annotations of the pods watched by the pod informer. Since these annotations get populated on
+// admission, the usage covers pods using cred specs through the GA fields too.
+type credSpecUsageController struct {
+	*controller
+	client credSpecUsageClientInterface
+}
+
+func newCredSpecUsageController(client credSpecUsageClientInterface) (*credSpecUsageController, error) {
+	usageController := &credSpecUsageController{client: client}
+	usageController.controller = newController(credSpecUsageControllerName, credSpecUsageControllerWorkers, usageController.reconcile)
+
+	// cred specs get reconciled when they're created, and on every resync, so that their usage
+	// eventually gets fixed even if pod events have been missed, e.g. while no replica was leading
+	client.watchGMSACredSpecs(usageController.eventHandler())
+
+	if err := client.watchGMSAPods(usageController.podCredSpecsEventHandler(func(oldPod, newPod *corev1.Pod) bool {
+		return isPodActive(oldPod) != isPodActive(newPod) || !reflect.DeepEqual(requestedCredSpecNames(oldPod), requestedCredSpecNames(newPod))
+	})); err != nil {
+		return nil, err
+	}
+
+	return usageController, nil
+}
+
+// podCredSpecsEventHandler returns a pod informer event handler that enqueues the names of the
+// cred specs used by the pods it's notified about; updates only get enqueued if `changed`
+// returns true.
+func (c *controller) podCredSpecsEventHandler(changed func(oldPod, newPod *corev1.Pod) bool) cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueuePodCredSpecs,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldPod, oldOK := oldObj.(*corev1.Pod)
+			newPod, newOK := newObj.(*corev1.Pod)
+			if oldOK && newOK && !changed(oldPod, newPod) {
+				return
+			}
+			c.enqueuePodCredSpecs(oldObj)
+			c.enqueuePodCredSpecs(newObj)
+		},
+		DeleteFunc: c.enqueuePodCredSpecs,
+	}
+}
+
+// enqueuePodCredSpecs enqueues the names of the cred specs the pod uses.
+func (c *controller) enqueuePodCredSpecs(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return
+	}
+
+	for _, credSpecName := range requestedCredSpecNames(pod) {
+		c.queue.Add(credSpecName)
+	}
+}
+
+// reconcile updates the usage of the cred spec with the given name.
+func (uc *credSpecUsageController) reconcile(credSpecName string) error {
+	currentUsage, exists, err := uc.client.retrieveCredSpecUsage(credSpecName)
+	if err != nil || !exists {
+		return err
+	}
+
+	pods, err := uc.client.listPodsUsingCredSpec(credSpecName)
+	if err != nil {
+		return err
+	}
+
+	usage := computeCredSpecUsage(pods)
+	if reflect.DeepEqual(usage, currentUsage) {
+		return nil
+	}
+
+	logrus.Debugf("cred spec %s is used by %d pods in %d namespaces", credSpecName, usage.PodCount, usage.NamespaceCount)
+	return uc.client.updateCredSpecUsage(credSpecName, usage)
+}
+
+// computeCredSpecUsage summarizes which of the given pods are still running.
+func computeCredSpecUsage(pods []*corev1.Pod) *credSpecUsage {
+	usage := &credSpecUsage{}
+
+	namespaces := make(map[string]bool)
+	workloads := make(map[credSpecWorkloadUsage]int)
+	for _, pod := range pods {
+		if !isPodActive(pod) {
+			continue
+		}
+
+		usage.PodCount++
+		namespaces[pod.Namespace] = true
+		kind, name := podWorkload(pod)
+		workloads[credSpecWorkloadUsage{Namespace: pod.Namespace, Kind: kind, Name: name}]++
+	}
+
+	usage.NamespaceCount = len(namespaces)
+	for namespace := range namespaces {
+		usage.Namespaces = append(usage.Namespaces, namespace)
+	}
+	sort.Strings(usage.Namespaces)
+	if len(usage.Namespaces) > maxReportedCredSpecUsages {
+		usage.Namespaces = usage.Namespaces[:maxReportedCredSpecUsages]
+	}
+
+	usage.WorkloadCount = len(workloads)
+	for workload, podCount := range workloads {
+		workload.PodCount = podCount
+		usage.Workloads = append(usage.Workloads, workload)
+	}
+	sort.Slice(usage.Workloads, func(i, j int) bool {
+		a, b := usage.Workloads[i], usage.Workloads[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Name < b.Name
+	})
+	if len(usage.Workloads) > maxReportedCredSpecUsages {
+		usage.Workloads = usage.Workloads[:maxReportedCredSpecUsages]
+	}
+
+	return usage
+}
+
+// podWorkload returns the kind and name of the workload a pod belongs to: its controller, or
+// the pod itself if it has none. Pods from deployments are attributed to their deployment
+// rather than to their replica set, whose name is the deployment's suffixed with the pods'
+// template hash.
+func podWorkload(pod *corev1.Pod) (string, string) {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		return "Pod", pod.Name
+	}
+
+	if owner.Kind == "ReplicaSet" {
+		if hash := pod.Labels[appsv1.DefaultDeploymentUniqueLabelKey]; hash != "" && strings.HasSuffix(owner.Name, "-"+hash) {
+			return "Deployment", strings.TrimSuffix(owner.Name, "-"+hash)
+		}
+	}
+	return owner.Kind, owner.Name
+}
+
+// isPodActive returns false iff the pod has terminated.
+func isPodActive(pod *corev1.Pod) bool {
+	return pod.Status.Phase != corev1.PodSucceeded && pod.Status.Phase != corev1.PodFailed
+}
+
+// credSpecNamesIndexFunc indexes pods by the names of the cred specs they use.
+func credSpecNamesIndexFunc(obj interface{}) ([]string, error) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return nil, nil
+	}
+	return requestedCredSpecNames(pod), nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestComputeCredSpecUsage(t *testing.T) {
+	terminatedPod := newPodUsingCredSpec("ns-2", "terminated", "cred-spec", "", nil)
+	terminatedPod.Status.Phase = corev1.PodSucceeded
+
+	usage := computeCredSpecUsage([]*corev1.Pod{
+		newPodUsingCredSpec("ns-0", "web-5d8f9c6b7-abcde", "cred-spec", "", &metav1.OwnerReference{Kind: "ReplicaSet", Name: "web-5d8f9c6b7"}),
+		newPodUsingCredSpec("ns-0", "web-5d8f9c6b7-fghij", "cred-spec", "", &metav1.OwnerReference{Kind: "ReplicaSet", Name: "web-5d8f9c6b7"}),
+		newPodUsingCredSpec("ns-1", "db-0", "cred-spec", "", &metav1.OwnerReference{Kind: "StatefulSet", Name: "db"}),
+		newPodUsingCredSpec("ns-1", "bare", "cred-spec", "", nil),
+		terminatedPod,
+	})
+
+	assert.Equal(t, &credSpecUsage{
+		PodCount:       4,
+		NamespaceCount: 2,
+		Namespaces:     []string{"ns-0", "ns-1"},
+		WorkloadCount:  3,
+		Workloads: []credSpecWorkloadUsage{
+			{Namespace: "ns-0", Kind: "Deployment", Name: "web", PodCount: 2},
+			{Namespace: "ns-1", Kind: "Pod", Name: "bare", PodCount: 1},
+			{Namespace: "ns-1", Kind: "StatefulSet", Name: "db", PodCount: 1},
+		},
+	}, usage)
+
+	t.Run("lists are bounded", func(t *testing.T) {
+		var pods []*corev1.Pod
+		for i := 0; i < 2*maxReportedCredSpecUsages; i++ {
+			pods = append(pods, newPodUsingCredSpec(fmt.Sprintf("ns-%03d", i), "pod", "cred-spec", "", nil))
+		}
+
+		usage := computeCredSpecUsage(pods)
+
+		assert.Equal(t, 2*maxReportedCredSpecUsages, usage.PodCount)
+		assert.Equal(t, 2*maxReportedCredSpecUsages, usage.NamespaceCount)
+		assert.Equal(t, 2*maxReportedCredSpecUsages, usage.WorkloadCount)
+		if assert.Equal(t, maxReportedCredSpecUsages, len(usage.Namespaces)) {
+			assert.Equal(t, "ns-000", usage.Namespaces[0])
+		}
+		assert.Equal(t, maxReportedCredSpecUsages, len(usage.Workloads))
+	})
+}
+
+func TestCredSpecUsageControllerOnlyWritesChanges(t *testing.T) {
+	client := newFakeControllerClient(
+		newPodUsingCredSpec("ns", "pod-0", "cred-spec-0", "", nil),
+		newPodUsingCredSpec("ns", "pod-1", "cred-spec-1", "", nil),
+	)
+	client.credSpecs["cred-spec-0"] = &fakeCredSpec{}
+	client.credSpecs["cred-spec-1"] = &fakeCredSpec{}
+
+	usageController, err := newCredSpecUsageController(client)
+	require.Nil(t, err)
+
+	require.Nil(t, usageController.reconcile("cred-spec-0"))
+	assert.Equal(t, 1, client.updates)
+	assert.Equal(t, 1, client.credSpecs["cred-spec-0"].usage.PodCount)
+	assert.Nil(t, client.credSpecs["cred-spec-1"].usage)
+
+	require.Nil(t, usageController.reconcile("cred-spec-0"))
+	assert.Equal(t, 1, client.updates)
+
+	client.pods["ns/pod-0"].Status.Phase = corev1.PodFailed
+	require.Nil(t, usageController.reconcile("cred-spec-0"))
+	assert.Equal(t, 2, client.updates)
+	assert.Equal(t, &credSpecUsage{}, client.credSpecs["cred-spec-0"].usage)
+
+	// cred specs that don't exist don't get a usage
+	require.Nil(t, usageController.reconcile("unknown"))
+	assert.Equal(t, 2, client.updates)
+	_, present := client.credSpecs["unknown"]
+	assert.False(t, present)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// causeTypeFieldValueForbidden is the cause type used for violations that stem from the pod
+// not being allowed to do something, as opposed to being invalid; metav1 doesn't define it,
+// but the API server's own field validation errors use that same value.
+const causeTypeFieldValueForbidden metav1.CauseType = "FieldValueForbidden"
+
+// podViolations collects all the reasons to refuse admitting a pod, so that they can all be
+// reported at once instead of having users fix them one at a time.
+type podViolations struct {
+	pod        *corev1.Pod
+	violations []*podAdmissionError
+}
+
+func newPodViolations(pod *corev1.Pod) *podViolations {
+	return &podViolations{pod: pod}
+}
+
+// add records a new violation; it's a no-op if passed nil.
+func (violations *podViolations) add(err *podAdmissionError) {
+	if err != nil {
+		violations.violations = append(violations.violations, err)
+	}
+}
+
+// aggregate returns a single error describing all the violations recorded so far,
+// or nil if there are none.
+func (violations *podViolations) aggregate() *podAdmissionError {
+	switch len(violations.violations) {
+	case 0:
+		return nil
+	case 1:
+		err := *violations.violations[0]
+		err.causes = []metav1.StatusCause{err.statusCause()}
+		return &err
+	}
+
+	messages := make([]string, len(violations.violations))
+	causes := make([]metav1.StatusCause, len(violations.violations))
+	code := violations.violations[0].code
+	for i, violation := range violations.violations {
+		messages[i] = violation.Error()
+		causes[i] = violation.statusCause()
+
+		// server-side errors take precedence, so that the API server knows it's worth retrying
+		if violation.code >= http.StatusInternalServerError && code < http.StatusInternalServerError {
+			code = violation.code
+		}
+	}
+
+	return &podAdmissionError{
+		error:  fmt.Errorf("found %d gMSA violations: %s", len(messages), strings.Join(messages, "; ")),
+		code:   code,
+		pod:    violations.pod,
+		causes: causes,
+	}
+}
+
+// statusCause converts a single violation to a metav1.StatusCause.
+func (err *podAdmissionError) statusCause() metav1.StatusCause {
+	var causeType metav1.CauseType
+	switch err.code {
+	case http.StatusForbidden:
+		causeType = causeTypeFieldValueForbidden
+	case http.StatusNotFound:
+		causeType = metav1.CauseTypeFieldValueNotFound
+	default:
+		causeType = metav1.CauseTypeFieldValueInvalid
+	}
+
+	return metav1.StatusCause{
+		Type:    causeType,
+		Message: err.Error(),
+		Field:   err.field,
+	}
+}
+
+// annotationField returns the path to the given annotation key, as used in metav1.StatusCause.
+func annotationField(key string) string {
+	return fmt.Sprintf("metadata.annotations[%s]", key)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// admissionReviewResponse is the AdmissionReview we send back to the API server; it's
+// only needed because the version of k8s.io/api we use predates admission warnings.
+type admissionReviewResponse struct {
+	metav1.TypeMeta `json:",inline"`
+	Response        *admissionResponseWithWarnings `json:"response,omitempty"`
+}
+
+// admissionResponseWithWarnings adds the `warnings` field that API servers support as of
+// k8s 1.19 to admission responses; older API servers simply ignore it.
+type admissionResponseWithWarnings struct {
+	*admissionv1beta1.AdmissionResponse
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// addWarning records a warning to return to the client along with the admission response.
+func (admissionCtx *admissionContext) addWarning(format string, args ...interface{}) {
+	admissionCtx.warnings = append(admissionCtx.warnings, fmt.Sprintf(format, args...))
+}
+
+// warnAboutRiskyConfigurations adds warnings for configurations that are allowed, but
+// likely to cause trouble.
+func (webhook *webhook) warnAboutRiskyConfigurations(admissionCtx *admissionContext, pod *corev1.Pod, credSpecNames []string) {
+	if webhook.config.gaGMSAFieldsAvailable {
+		// annotations that just mirror their GA field, e.g. because "/mutate" populated them, are
+		// not worth warning about
+		iterateOverGMSAFields(pod, admissionCtx.windowsOptions, func(fields *gmsaFields) {
+			if pod.Annotations[fields.nameKey] != "" && fields.credSpecName() == "" {
+				admissionCtx.addWarning("annotation %s is deprecated, use the securityContext.windowsOptions.gmsaCredentialSpecName field instead", fields.nameKey)
+			}
+		})
+	}
+
+	if !isRestrictedToWindowsNodes(pod) {
+		admissionCtx.addWarning("pod uses gMSAs but can be scheduled on non-Windows nodes, consider adding a %s=windows node selector", windowsNodeSelectorKey)
+	}
+
+	if webhook.credSpecUsage == nil {
+		return
+	}
+	for _, credSpecName := range credSpecNames {
+		namespaceCount := webhook.credSpecUsage.record(credSpecName, admissionCtx.namespace, admissionCtx.dryRun)
+		if namespaceCount >= webhook.config.sharedCredSpecWarningThreshold {
+			admissionCtx.addWarning("gMSA cred spec %s is shared by at least %d namespaces, consider using dedicated gMSAs", credSpecName, namespaceCount)
+		}
+	}
+}
+
+// credSpecUsageTracker keeps track, in memory, of which namespaces have had pods admitted
+// with which cred specs since the webhook started. It's only meant to give a rough idea
+// of how widely shared cred specs are, and is not shared between replicas.
+type credSpecUsageTracker struct {
+	sync.Mutex
+	namespaces map[string]map[string]bool
+}
+
+func newCredSpecUsageTracker() *credSpecUsageTracker {
+	return &credSpecUsageTracker{namespaces: make(map[string]map[string]bool)}
+}
+
+// record adds the namespace to the ones using the cred spec, unless dryRun is true, and
+// returns how many distinct namespaces use that cred spec, including this one.
+func (tracker *credSpecUsageTracker) record(credSpecName, namespace string, dryRun bool) int {
+	tracker.Lock()
+	defer tracker.Unlock()
+
+	namespaces := tracker.namespaces[credSpecName]
+	count := len(namespaces)
+	if !namespaces[namespace] {
+		count++
+	}
+
+	if !dryRun {
+		if namespaces == nil {
+			namespaces = make(map[string]bool)
+			tracker.namespaces[credSpecName] = namespaces
+		}
+		namespaces[namespace] = true
+	}
+
+	return count
+}
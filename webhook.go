@@ -4,7 +4,10 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"mime"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
@@ -41,8 +44,17 @@ const (
 var jsonPatchEscaper = strings.NewReplacer("~", "~0", "/", "~1")
 
 type webhook struct {
-	server *http.Server
-	client kubeClientInterface
+	server        *http.Server
+	client        kubeClientInterface
+	config        *webhookConfig
+	credSpecUsage *credSpecUsageTracker
+	tracer        *tracer
+	// opsServer serves health checks and metrics, see ops.go
+	opsServer *http.Server
+	// signingKeys sign injected cred spec contents; nil if signing is disabled
+	signingKeys *signingKeyring
+	// ready is 1 when the admission server is ready to serve requests; only to be accessed atomically
+	ready int32
 }
 
 type webhookOperation string
@@ -52,127 +64,343 @@ const (
 	mutate   webhookOperation = "MUTATE"
 )
 
+// admissionContext holds the state specific to a single admission request.
+type admissionContext struct {
+	namespace string
+	// dryRun is true when the API server won't persist the result of the admission request;
+	// the webhook must then refrain from any side effect.
+	// Note that creating LocalSubjectAccessReviews is not considered a side effect, since the
+	// API server never persists them.
+	dryRun bool
+	// logger carries the request's identifying fields
+	logger *requestLogger
+	// span is the tracing span that calls made while handling the request should be children of
+	span *span
+
+	pod *corev1.Pod
+	// windowsOptions are the pod's GA GMSA fields
+	windowsOptions *podWindowsOptions
+	// workload is set when validating a workload, in which case pod is built from its pod template
+	workload *corev1.ObjectReference
+	// authorizationReasons maps the cred specs we've checked authorization for to the
+	// authorizer's reasons
+	authorizationReasons map[string]string
+	// warnings are returned to the client along with the admission response
+	warnings []string
+	// enforcementMode and unenforcedViolations are set when the request's namespace is not in
+	// enforcementModeEnforce mode, and the pod would have been denied otherwise
+	enforcementMode      enforcementMode
+	unenforcedViolations []string
+}
+
 type podAdmissionError struct {
 	error
 	code int
 	pod  *corev1.Pod
+	// field is the path to the field of the pod that this error is about, if any
+	field string
+	// causes details the individual violations this error is made of, see podViolations
+	causes []metav1.StatusCause
 }
 
-func newWebhook(client kubeClientInterface) *webhook {
-	return &webhook{client: client}
+func newWebhook(client kubeClientInterface, config *webhookConfig) *webhook {
+	webhook := &webhook{client: client, config: config}
+	if config.sharedCredSpecWarningThreshold > 0 {
+		webhook.credSpecUsage = newCredSpecUsageTracker()
+	}
+	if config.signingKeysDir != "" {
+		webhook.signingKeys = newSigningKeyring(config.signingKeysDir)
+	}
+	if config.otlpEndpoint != "" {
+		webhook.tracer = newTracer(config.otlpEndpoint, config.tracingServiceName)
+	}
+	return webhook
 }
 
-// start is a blocking call.
+// start is a blocking call; it starts both the admission server on the given port, and the
+// ops server if enabled.
 func (webhook *webhook) start(port int, tlsConfig *tlsConfig) error {
 	if webhook.server != nil {
 		return fmt.Errorf("webhook already started")
 	}
 
 	webhook.server = &http.Server{
-		Addr:    ":" + strconv.Itoa(port),
-		Handler: webhook,
+		Addr:              ":" + strconv.Itoa(port),
+		Handler:           webhook,
+		ReadTimeout:       webhook.config.timeouts.read,
+		ReadHeaderTimeout: webhook.config.timeouts.read,
+		WriteTimeout:      webhook.config.timeouts.write,
+		IdleTimeout:       webhook.config.timeouts.idle,
+	}
+	if tlsConfig != nil {
+		var err error
+		if webhook.server.TLSConfig, err = tlsConfig.serverTLSConfig(); err != nil {
+			return err
+		}
 	}
 
-	logrus.Infof("starting webhook server at port %v", port)
-	var err error
-	if tlsConfig == nil {
-		err = webhook.server.ListenAndServe()
-	} else {
-		err = webhook.server.ListenAndServeTLS(tlsConfig.crtPath, tlsConfig.keyPath)
+	errs := make(chan error, 2)
+
+	if webhook.config.opsPort != 0 {
+		webhook.opsServer = webhook.newOpsServer(webhook.config.opsPort)
+		go func() {
+			logrus.Infof("starting ops server at port %v", webhook.config.opsPort)
+			errs <- webhook.opsServer.ListenAndServe()
+		}()
 	}
 
+	go func() {
+		errs <- webhook.serveAdmissions(tlsConfig)
+	}()
+
+	err := <-errs
+	if err == http.ErrServerClosed {
+		logrus.Infof("server closed")
+		return nil
+	}
+
+	// one of the servers failed, take the other one down too
+	logrus.Errorf("server failed, shutting down: %v", err)
+	if stopErr := webhook.stop(); stopErr != nil {
+		logrus.Errorf("error when shutting down: %v", stopErr)
+	}
+	return err
+}
+
+// serveAdmissions is a blocking call that serves admission requests.
+func (webhook *webhook) serveAdmissions(tlsConfig *tlsConfig) error {
+	listener, err := net.Listen("tcp", webhook.server.Addr)
 	if err != nil {
-		if err == http.ErrServerClosed {
-			logrus.Infof("server closed")
-		} else {
-			return err
-		}
+		return err
 	}
 
-	return nil
+	logrus.Infof("starting webhook server at %v", listener.Addr())
+	webhook.setReady(true)
+
+	if tlsConfig == nil {
+		return webhook.server.Serve(listener)
+	}
+	return webhook.server.ServeTLS(listener, tlsConfig.crtPath, tlsConfig.keyPath)
 }
 
-// stop stops the HTTP server.
+// stop stops both HTTP servers, and flushes pending traces.
 func (webhook *webhook) stop() error {
 	if webhook.server == nil {
 		return fmt.Errorf("webhook server not started yet")
 	}
-	return webhook.server.Shutdown(context.Background())
+
+	webhook.setReady(false)
+
+	err := webhook.server.Shutdown(context.Background())
+	if webhook.opsServer != nil {
+		if opsErr := webhook.opsServer.Shutdown(context.Background()); err == nil {
+			err = opsErr
+		}
+	}
+	webhook.tracer.stop()
+	return err
 }
 
 // ServeHTTP makes this object a http.Handler.
 // Since we only have a couple of endpoints, there's no need for a full-fleged router here.
 func (webhook *webhook) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
-	var admissionResponse *admissionv1beta1.AdmissionResponse
+	var (
+		admissionResponse *admissionv1beta1.AdmissionResponse
+		warnings          []string
+	)
 
 	switch request.URL.Path {
-	case "/validate":
-		admissionResponse = webhook.httpRequestToAdmissionResponse(request, validate)
-	case "/mutate":
-		admissionResponse = webhook.httpRequestToAdmissionResponse(request, mutate)
+	case "/validate", "/mutate":
+		span := webhook.tracer.startServerSpan("ServeHTTP", request)
+		defer span.finish()
+		span.setAttribute("http.method", request.Method)
+		span.setAttribute("http.target", request.URL.Path)
+		request = request.WithContext(contextWithSpan(request.Context(), span))
+
+		operation := validate
+		if request.URL.Path == "/mutate" {
+			operation = mutate
+		}
+		var httpErr *httpError
+		admissionResponse, warnings, httpErr = webhook.httpRequestToAdmissionResponse(request, operation)
+		if httpErr != nil {
+			span.setAttribute("http.status_code", httpErr.code)
+			span.recordError(httpErr)
+			if httpErr.code == http.StatusMethodNotAllowed {
+				responseWriter.Header().Set("Allow", http.MethodPost)
+			}
+			http.Error(responseWriter, httpErr.Error(), httpErr.code)
+			return
+		}
+
+		span.setAttribute("admission.uid", string(admissionResponse.UID))
+		span.setAttribute("admission.allowed", admissionResponse.Allowed)
 	default:
 		logrus.Infof("received POST request for unknown path %s", request.URL.Path)
 		responseWriter.WriteHeader(http.StatusNotFound)
 		return
 	}
 
-	responseAdmissionReview := admissionv1beta1.AdmissionReview{Response: admissionResponse}
+	responseAdmissionReview := admissionReviewResponse{
+		Response: &admissionResponseWithWarnings{
+			AdmissionResponse: admissionResponse,
+			Warnings:          warnings,
+		},
+	}
 	if responseBytes, err := json.Marshal(responseAdmissionReview); err == nil {
-		logrus.Debugf("sending response: %s", responseBytes)
+		if logrus.GetLevel() >= logrus.DebugLevel {
+			logrus.Debugf("sending response: %s", redactedAdmissionReviewResponse(responseAdmissionReview))
+		}
 
 		if _, err = responseWriter.Write(responseBytes); err != nil {
-			logrus.Errorf("error when writing response JSON %s: %v", responseBytes, err)
+			logrus.Errorf("error when writing response JSON for request %s: %v", admissionResponse.UID, err)
 		}
 	} else {
-		logrus.Errorf("error when marshalling response %v: %v", responseAdmissionReview, err)
+		logrus.Errorf("error when marshalling response for request %s: %v", admissionResponse.UID, err)
 	}
 }
 
-// httpRequestToAdmissionResponse turns a raw HTTP request into an AdmissionResponse struct.
-func (webhook *webhook) httpRequestToAdmissionResponse(request *http.Request, operation webhookOperation) *admissionv1beta1.AdmissionResponse {
+// redactedAdmissionReviewResponse returns a version of the response suitable for logging,
+// i.e. with the cred spec contents contained in its patch, if any, redacted.
+func redactedAdmissionReviewResponse(review admissionReviewResponse) string {
+	if review.Response == nil || review.Response.AdmissionResponse == nil || len(review.Response.AdmissionResponse.Patch) == 0 {
+		return marshalForLogs(review)
+	}
+
+	redactedResponse := *review.Response.AdmissionResponse
+	redactedResponse.Patch = redactJSONPatch(redactedResponse.Patch)
+	review.Response = &admissionResponseWithWarnings{
+		AdmissionResponse: &redactedResponse,
+		Warnings:          review.Response.Warnings,
+	}
+	return marshalForLogs(review)
+}
+
+// httpError is a protocol-level error, i.e. one about the HTTP request itself rather than about
+// the admission request it may contain; those get answered with a plain HTTP error.
+type httpError struct {
+	error
+	code int
+}
+
+// maxRequestBodyBytes caps the size of admission reviews we accept; the API server limits objects
+// to about 3MB, and update reviews contain both the old and the new object.
+const maxRequestBodyBytes = 7 * 1024 * 1024
+
+// httpRequestToAdmissionResponse turns a raw HTTP request into an AdmissionResponse struct,
+// and a list of warnings for the client.
+// If the request is not a well-formed admission review, it returns an httpError instead.
+func (webhook *webhook) httpRequestToAdmissionResponse(request *http.Request, operation webhookOperation) (*admissionv1beta1.AdmissionResponse, []string, *httpError) {
+	logger := newRequestLogger(operation)
+
+	admissionReview, httpErr := readAdmissionReview(request, logger)
+	if httpErr != nil {
+		logger.WithField("code", httpErr.code).Infof("rejecting malformed request: %v", httpErr)
+		return nil, nil, httpErr
+	}
+
+	logger.withRequest(admissionReview.Request)
+
+	span := webhook.tracer.startSpan("validateOrMutate", spanFromContext(request.Context()), spanKindInternal)
+	span.setAttribute("admission.operation", string(operation))
+	span.setAttribute("k8s.namespace.name", admissionReview.Request.Namespace)
+
+	admissionCtx := &admissionContext{
+		namespace: admissionReview.Request.Namespace,
+		dryRun:    admissionReview.Request.DryRun != nil && *admissionReview.Request.DryRun,
+		logger:    logger,
+		span:      span,
+	}
+
+	admissionResponse, admissionError := webhook.validateOrMutate(admissionCtx, admissionReview.Request, operation)
+	if admissionError != nil {
+		span.recordError(admissionError)
+	}
+	span.finish()
+	if admissionError != nil {
+		admissionResponse = deniedAdmissionResponse(admissionError)
+		if workload := admissionCtx.workload; workload != nil && admissionResponse.Result.Details != nil {
+			admissionResponse.Result.Details.Kind = workload.Kind
+			admissionResponse.Result.Details.Name = workload.Name
+		}
+		webhook.recordDenialEvent(admissionCtx, admissionError)
+	}
+
+	// return the same UID
+	admissionResponse.UID = admissionReview.Request.UID
+	admissionResponse.AuditAnnotations = admissionCtx.auditAnnotations()
+
+	logger.logDecision(admissionResponse)
+
+	return admissionResponse, admissionCtx.warnings, nil
+}
+
+// readAdmissionReview reads and unmarshalls the admission review contained in an HTTP request.
+func readAdmissionReview(request *http.Request, logger *requestLogger) (*admissionv1beta1.AdmissionReview, *httpError) {
 	// should be a POST request
-	if strings.ToUpper(request.Method) != "POST" {
-		return deniedAdmissionResponse(fmt.Errorf("expected POST HTTP request"), http.StatusMethodNotAllowed)
+	if strings.ToUpper(request.Method) != http.MethodPost {
+		return nil, &httpError{error: fmt.Errorf("expected POST HTTP request, got %s", request.Method), code: http.StatusMethodNotAllowed}
 	}
 	// verify the content type is accurate
-	contentType := request.Header.Get("Content-Type")
-	if contentType != "application/json" {
-		return deniedAdmissionResponse(fmt.Errorf("expected JSON content-type header"), http.StatusUnsupportedMediaType)
+	if mediaType, params, err := mime.ParseMediaType(request.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+		return nil, &httpError{error: fmt.Errorf("expected JSON content-type header, got %q", request.Header.Get("Content-Type")), code: http.StatusUnsupportedMediaType}
+	} else if charset, present := params["charset"]; present && !strings.EqualFold(charset, "utf-8") {
+		return nil, &httpError{error: fmt.Errorf("unsupported charset %q, only utf-8 is supported", charset), code: http.StatusUnsupportedMediaType}
 	}
 
 	// read the body
 	if request.Body == nil {
-		deniedAdmissionResponse(fmt.Errorf("no request body"), http.StatusBadRequest)
+		return nil, &httpError{error: fmt.Errorf("no request body"), code: http.StatusBadRequest}
+	}
+	if request.ContentLength > maxRequestBodyBytes {
+		return nil, &httpError{error: fmt.Errorf("request body too large: %d bytes, at most %d allowed", request.ContentLength, maxRequestBodyBytes), code: http.StatusRequestEntityTooLarge}
 	}
-	body, err := ioutil.ReadAll(request.Body)
+	body, err := ioutil.ReadAll(io.LimitReader(request.Body, maxRequestBodyBytes+1))
 	if err != nil {
-		return deniedAdmissionResponse(fmt.Errorf("couldn't read request body: %v", err), http.StatusBadRequest)
+		return nil, &httpError{error: fmt.Errorf("couldn't read request body: %v", err), code: http.StatusBadRequest}
+	}
+	if len(body) > maxRequestBodyBytes {
+		return nil, &httpError{error: fmt.Errorf("request body too large: at most %d bytes allowed", maxRequestBodyBytes), code: http.StatusRequestEntityTooLarge}
 	}
 
-	logrus.Debugf("handling %s request: %s", operation, body)
+	if logrus.GetLevel() >= logrus.DebugLevel {
+		logger.Debugf("handling request: %s", redactAdmissionReviewJSON(body))
+	}
 
 	// unmarshall the request
-	admissionReview := admissionv1beta1.AdmissionReview{}
-	if err = json.Unmarshal(body, &admissionReview); err != nil {
-		return deniedAdmissionResponse(fmt.Errorf("unable to unmarshall JSON body as an admission review: %v", err), http.StatusBadRequest)
+	admissionReview := &admissionv1beta1.AdmissionReview{}
+	if err = json.Unmarshal(body, admissionReview); err != nil {
+		return nil, &httpError{error: fmt.Errorf("unable to unmarshall JSON body as an admission review: %v", err), code: http.StatusBadRequest}
 	}
 	if admissionReview.Request == nil {
-		return deniedAdmissionResponse(fmt.Errorf("no 'Request' field in JSON body"), http.StatusBadRequest)
+		return nil, &httpError{error: fmt.Errorf("no 'Request' field in JSON body"), code: http.StatusBadRequest}
 	}
 
-	admissionResponse, admissionError := webhook.validateOrMutate(admissionReview.Request, operation)
-	if admissionError != nil {
-		admissionResponse = deniedAdmissionResponse(admissionError)
-	}
+	return admissionReview, nil
+}
 
-	// return the same UID
-	admissionResponse.UID = admissionReview.Request.UID
+// retrieveCredSpecContents fetches the contents of a cred spec, tracing the call.
+func (webhook *webhook) retrieveCredSpecContents(admissionCtx *admissionContext, credSpecName string) (string, int, error) {
+	span := webhook.tracer.startSpan("retrieveCredSpecContents", admissionCtx.span, spanKindClient)
+	defer span.finish()
+	span.setAttribute("gmsa.credspec.name", credSpecName)
 
-	return admissionResponse
+	contents, code, err := webhook.client.retrieveCredSpecContents(credSpecName)
+	if err != nil {
+		span.setAttribute("http.status_code", code)
+		span.recordError(err)
+	}
+	return contents, code, err
 }
 
 // validateOrMutate is where the non-HTTP-related work happens.
-func (webhook *webhook) validateOrMutate(request *admissionv1beta1.AdmissionRequest, operation webhookOperation) (*admissionv1beta1.AdmissionResponse, *podAdmissionError) {
+func (webhook *webhook) validateOrMutate(admissionCtx *admissionContext, request *admissionv1beta1.AdmissionRequest, operation webhookOperation) (*admissionv1beta1.AdmissionResponse, *podAdmissionError) {
+	if workloadKinds[request.Kind.Kind] && operation == validate {
+		return webhook.validateWorkloadRequest(admissionCtx, request)
+	}
+	if request.Kind.Kind == grantCRDKind && operation == validate {
+		return webhook.validateGrantRequest(admissionCtx, request)
+	}
 	if request.Kind.Kind != "Pod" {
 		return nil, &podAdmissionError{error: fmt.Errorf("expected a pod object, got a %v", request.Kind.Kind), code: http.StatusBadRequest}
 	}
@@ -182,13 +410,22 @@ func (webhook *webhook) validateOrMutate(request *admissionv1beta1.AdmissionRequ
 		return nil, err
 	}
 
+	windowsOptions, err := unmarshallPodWindowsOptions(request.Object.Raw)
+	if err != nil {
+		return nil, err
+	}
+
+	admissionCtx.pod = pod
+	admissionCtx.windowsOptions = windowsOptions
+	admissionCtx.logger.withPod(pod)
+
 	switch request.Operation {
 	case admissionv1beta1.Create:
 		switch operation {
 		case validate:
-			return webhook.validateCreateRequest(pod, request.Namespace)
+			return webhook.validateCreateRequest(admissionCtx, pod)
 		case mutate:
-			return webhook.mutateCreateRequest(pod)
+			return webhook.mutateCreateRequest(admissionCtx, pod)
 		default:
 			// shouldn't happen, but needed so that all paths in the function have a return value
 			panic(fmt.Errorf("unexpected webhook operation: %v", operation))
@@ -200,7 +437,7 @@ func (webhook *webhook) validateOrMutate(request *admissionv1beta1.AdmissionRequ
 			if err != nil {
 				return nil, err
 			}
-			return validateUpdateRequest(pod, oldPod)
+			return webhook.validateUpdateRequest(admissionCtx, pod, oldPod)
 		}
 
 		// we only do validation on updates, no mutation
@@ -221,79 +458,163 @@ func unmarshallPod(object runtime.RawExtension) (*corev1.Pod, *podAdmissionError
 }
 
 // validateCreateRequest ensures that the only GMSA content annotations set on the pod,
-// match the corresponding GMSA name annotations, and that the pod's service account
-// is authorized to `use` the requested GMSA's.
-func (webhook *webhook) validateCreateRequest(pod *corev1.Pod, namespace string) (*admissionv1beta1.AdmissionResponse, *podAdmissionError) {
-	var err *podAdmissionError
+// match the corresponding GMSA name annotations, that the pod's service account
+// is authorized to `use` the requested GMSA's, and that the pod complies with
+// its namespace's GMSA policies.
+func (webhook *webhook) validateCreateRequest(admissionCtx *admissionContext, pod *corev1.Pod) (*admissionv1beta1.AdmissionResponse, *podAdmissionError) {
+	violations := newPodViolations(pod)
 
 	iterateOverGMSAAnnotationPairs(pod, func(nameKey, contentsKey string) {
-		if err != nil {
-			return
-		}
-
 		if credSpecName, present := pod.Annotations[nameKey]; present && credSpecName != "" {
 			// let's check that the associated service account can read the relevant cred spec CRD
-			if authorized, reason := webhook.client.isAuthorizedToUseCredSpec(pod.Spec.ServiceAccountName, namespace, credSpecName); !authorized {
-				msg := fmt.Sprintf("service account %s does not have `use` access to the %s gMSA cred spec", pod.Spec.ServiceAccountName, credSpecName)
+			if authorized, reason := webhook.authorizeCredSpecUse(admissionCtx, pod, credSpecName); !authorized {
+				msg := fmt.Sprintf("service account %s does not have `use` access to the %s gMSA cred spec", podServiceAccountName(pod), credSpecName)
 				if reason != "" {
 					msg += fmt.Sprintf(", reason : %s", reason)
 				}
-				err = &podAdmissionError{error: fmt.Errorf(msg), pod: pod, code: http.StatusForbidden}
+				violations.add(&podAdmissionError{error: fmt.Errorf(msg), pod: pod, code: http.StatusForbidden, field: annotationField(nameKey)})
 				return
 			}
 
 			// and the content annotation should contain the expected cred spec
 			if credSpecContents, present := pod.Annotations[contentsKey]; present {
-				if expectedContents, code, retrieveErr := webhook.client.retrieveCredSpecContents(credSpecName); retrieveErr != nil {
-					err = &podAdmissionError{error: retrieveErr, pod: pod, code: code}
-				} else if credSpecContents != expectedContents {
-					err = &podAdmissionError{error: fmt.Errorf("cred spec contained in annotation %s does not match the contents of GMSA %s", contentsKey, credSpecName), pod: pod, code: http.StatusForbidden}
+				if expectedContents, code, retrieveErr := webhook.retrieveCredSpecContents(admissionCtx, credSpecName); retrieveErr != nil {
+					violations.add(&podAdmissionError{error: retrieveErr, pod: pod, code: code, field: annotationField(nameKey)})
+				} else if equal, diffPaths := credSpecContentsEqual(credSpecContents, expectedContents); !equal {
+					msg := fmt.Sprintf("cred spec contained in annotation %s does not match the contents of GMSA %s", contentsKey, credSpecName)
+					if len(diffPaths) != 0 {
+						msg += fmt.Sprintf(", differing paths: %s", formatJSONDiffPaths(diffPaths))
+					}
+					violations.add(&podAdmissionError{error: fmt.Errorf(msg), pod: pod, code: http.StatusForbidden, field: annotationField(contentsKey)})
+				}
+
+				// as well as have been injected by "/mutate", if signing is enabled
+				if verified, signatureErr := webhook.verifyContentsSignature(admissionCtx, pod, credSpecName, contentsKey); signatureErr != nil {
+					violations.add(signatureErr)
+				} else if !verified && webhook.signingKeys != nil {
+					violations.add(&podAdmissionError{error: fmt.Errorf("cred spec contained in annotation %s was not injected by this webhook (annotation %s missing, or signed with a key that has been rotated out)", contentsKey, signatureAnnotationKey(contentsKey)), pod: pod, code: http.StatusForbidden, field: annotationField(contentsKey)})
 				}
 			}
 
 		} else if _, present := pod.Annotations[contentsKey]; present {
 			// the name annotation is not present, but the content one is
-			err = &podAdmissionError{error: fmt.Errorf("cannot pre-set a pod's gMSA content annotation (annotation %v present)", contentsKey), pod: pod, code: http.StatusForbidden}
+			violations.add(&podAdmissionError{error: fmt.Errorf("cannot pre-set a pod's gMSA content annotation (annotation %v present)", contentsKey), pod: pod, code: http.StatusForbidden, field: annotationField(contentsKey)})
 		}
 	})
-	if err != nil {
+
+	webhook.validateGMSAFieldsConsistency(violations, admissionCtx, pod)
+
+	credSpecNames := requestedCredSpecNames(pod)
+	if len(credSpecNames) != 0 {
+		violations.add(webhook.validateWindowsScheduling(pod, admissionCtx.namespace, admissionCtx.workload != nil))
+		webhook.enforceGMSAPolicies(violations, pod, admissionCtx.namespace, credSpecNames)
+	}
+
+	if err := webhook.enforce(admissionCtx, validate, violations.aggregate()); err != nil {
 		return nil, err
 	}
 
+	if len(credSpecNames) != 0 {
+		webhook.warnAboutRiskyConfigurations(admissionCtx, pod, credSpecNames)
+	}
+
 	return &admissionv1beta1.AdmissionResponse{Allowed: true}, nil
 }
 
 // mutateCreateRequest inlines the requested GMSA's into the pod's spec as annotations.
-func (webhook *webhook) mutateCreateRequest(pod *corev1.Pod) (*admissionv1beta1.AdmissionResponse, *podAdmissionError) {
-	var (
-		patches []map[string]string
-		err     *podAdmissionError
-	)
+// Pods that don't request any GMSA get the one bound to their service account, if any; and
+// Windows pods that don't request a pod-level GMSA get their namespace's default one, if any.
+func (webhook *webhook) mutateCreateRequest(admissionCtx *admissionContext, pod *corev1.Pod) (*admissionv1beta1.AdmissionResponse, *podAdmissionError) {
+	violations := newPodViolations(pod)
+
+	// cred specs requested through the GA fields take precedence over defaults
+	patches := webhook.annotationsFromGMSAFields(violations, admissionCtx, pod)
+
+	// pods that don't request any GMSA get the one bound to their service account, if any
+	if len(requestedCredSpecNames(pod)) == 0 {
+		credSpecName, source, serviceAccountErr := webhook.serviceAccountCredSpecName(pod, admissionCtx.namespace)
+		violations.add(serviceAccountErr)
+		patches = append(patches, webhook.injectPodCredSpec(admissionCtx, violations, pod, credSpecName, source)...)
+	}
+
+	if pod.Annotations[gMSAPodSpecNameAnnotationKey] == "" && isWindowsPod(pod) {
+		credSpecName, source, defaultErr := webhook.defaultCredSpecName(pod, admissionCtx.namespace)
+		violations.add(defaultErr)
+		patches = append(patches, webhook.injectPodCredSpec(admissionCtx, violations, pod, credSpecName, source)...)
+	}
 
+	// finalContents maps contents annotations' keys to the cred spec contents they end up with
+	finalContents := make(map[string]string)
 	iterateOverGMSAAnnotationPairs(pod, func(nameKey, contentsKey string) {
-		if err != nil {
-			return
-		}
+		credSpecName := pod.Annotations[nameKey]
+		existingContents, contentsPresent := pod.Annotations[contentsKey]
 
-		if _, present := pod.Annotations[contentsKey]; present {
+		if contentsPresent && credSpecName == "" {
 			// only this admission controller is allowed to populate the actual contents of the cred spec
 			// and "/mutate" is called before "/validate"
-			err = &podAdmissionError{error: fmt.Errorf("cannot pre-set a pod's gMSA content annotation (annotation %v present)", contentsKey), pod: pod, code: http.StatusForbidden}
-		} else if credSpecName, present := pod.Annotations[nameKey]; present && credSpecName != "" {
-			if contents, code, retrieveErr := webhook.client.retrieveCredSpecContents(credSpecName); retrieveErr != nil {
-				err = &podAdmissionError{error: retrieveErr, pod: pod, code: code}
-			} else {
+			violations.add(&podAdmissionError{error: fmt.Errorf("cannot pre-set a pod's gMSA content annotation (annotation %v present)", contentsKey), pod: pod, code: http.StatusForbidden, field: annotationField(contentsKey)})
+		} else if credSpecName != "" {
+			contents, code, retrieveErr := webhook.retrieveCredSpecContents(admissionCtx, credSpecName)
+			if retrieveErr != nil {
+				violations.add(&podAdmissionError{error: retrieveErr, pod: pod, code: code, field: annotationField(nameKey)})
+				return
+			}
+			finalContents[contentsKey] = contents
+
+			injectContents, sign := !contentsPresent, !contentsPresent
+			if contentsPresent {
+				contentsEqual, _ := credSpecContentsEqual(existingContents, contents)
+
+				// when the API server re-invokes us after other mutating webhooks have run, the
+				// contents we injected the first time around are already there; and pods restored
+				// from backups carry the contents we injected when they were first created.
+				// Anything else is still forbidden. Note that accepting contents matching the cred
+				// spec is safe even if they weren't injected by us, since that's what we would have
+				// injected anyway; but then we only ever sign our own copy of them, never the user's.
+				verified, signatureErr := webhook.verifyContentsSignature(admissionCtx, pod, credSpecName, contentsKey)
+				switch {
+				case signatureErr != nil:
+					violations.add(signatureErr)
+				case contentsEqual && verified:
+					// nothing to do
+				case contentsEqual:
+					injectContents = webhook.signingKeys != nil
+					sign = injectContents
+				case verified:
+					// the cred spec has changed since we signed these contents, let's refresh them
+					admissionCtx.logger.Infof("refreshing outdated contents of the %s gMSA cred spec in annotation %s", credSpecName, contentsKey)
+					injectContents, sign = true, true
+				default:
+					violations.add(&podAdmissionError{error: fmt.Errorf("cannot pre-set a pod's gMSA content annotation (annotation %v present, and does not match the contents of the %s cred spec)", contentsKey, credSpecName), pod: pod, code: http.StatusForbidden, field: annotationField(contentsKey)})
+				}
+			}
+
+			if injectContents {
 				// worth noting that this JSON patch is guaranteed to work since we know at this point
-				// that the pod has annotations, and and that it doesn't have this specific one
-				patches = append(patches, map[string]string{
+				// that the pod has annotations; and if this one is already present, "add" replaces it
+				patches = append(patches, map[string]interface{}{
 					"op":    "add",
 					"path":  fmt.Sprintf("/metadata/annotations/%s", jsonPatchEscaper.Replace(contentsKey)),
 					"value": contents,
 				})
 			}
+			if sign {
+				signaturePatches, signErr := webhook.signaturePatches(admissionCtx, pod, credSpecName, contentsKey, contents)
+				violations.add(signErr)
+				patches = append(patches, signaturePatches...)
+			}
 		}
 	})
-	if err != nil {
+
+	patches = append(patches, webhook.gmsaFieldsPatches(admissionCtx, pod, finalContents)...)
+
+	if len(requestedCredSpecNames(pod)) != 0 {
+		schedulingPatches, schedulingErr := webhook.windowsSchedulingPatches(pod, admissionCtx.namespace)
+		violations.add(schedulingErr)
+		patches = append(patches, schedulingPatches...)
+	}
+
+	if err := webhook.enforce(admissionCtx, mutate, violations.aggregate()); err != nil {
 		return nil, err
 	}
 
@@ -313,21 +634,40 @@ func (webhook *webhook) mutateCreateRequest(pod *corev1.Pod) (*admissionv1beta1.
 	return admissionResponse, nil
 }
 
+// injectPodCredSpec returns the JSON patches requesting the given cred spec at pod level, if
+// any, provided that the pod's service account is authorized to use it; source describes where
+// that cred spec comes from.
+func (webhook *webhook) injectPodCredSpec(admissionCtx *admissionContext, violations *podViolations, pod *corev1.Pod, credSpecName, source string) []map[string]interface{} {
+	if credSpecName == "" {
+		return nil
+	}
+
+	// this ensures that e.g. annotating a service account can't grant it access to a cred spec
+	if authorized, reason := webhook.authorizeCredSpecUse(admissionCtx, pod, credSpecName); !authorized {
+		msg := fmt.Sprintf("service account %s does not have `use` access to the %s gMSA cred spec (default from %s)", podServiceAccountName(pod), credSpecName, source)
+		if reason != "" {
+			msg += fmt.Sprintf(", reason : %s", reason)
+		}
+		violations.add(&podAdmissionError{error: fmt.Errorf(msg), pod: pod, code: http.StatusForbidden, field: "spec.serviceAccountName"})
+		return nil
+	}
+
+	admissionCtx.logger.Infof("injecting default gMSA cred spec %s from %s", credSpecName, source)
+	return annotationPatches(pod, gMSAPodSpecNameAnnotationKey, credSpecName)
+}
+
 // validateUpdateRequest ensures that there are no updates to any of the GMSA annotations.
-func validateUpdateRequest(pod, oldPod *corev1.Pod) (*admissionv1beta1.AdmissionResponse, *podAdmissionError) {
-	var err *podAdmissionError
+func (webhook *webhook) validateUpdateRequest(admissionCtx *admissionContext, pod, oldPod *corev1.Pod) (*admissionv1beta1.AdmissionResponse, *podAdmissionError) {
+	violations := newPodViolations(pod)
 
 	iterateOverGMSAAnnotationPairs(pod, func(nameKey, contentsKey string) {
-		if err != nil {
-			return
-		}
-		if nameKeyErr := assertAnnotationsUnchanged(pod, oldPod, nameKey); nameKeyErr != nil {
-			err = nameKeyErr
-		} else if contentsKeyErr := assertAnnotationsUnchanged(pod, oldPod, contentsKey); contentsKeyErr != nil {
-			err = contentsKeyErr
-		}
+		violations.add(assertAnnotationsUnchanged(pod, oldPod, nameKey))
+		violations.add(assertAnnotationsUnchanged(pod, oldPod, contentsKey))
+		violations.add(assertAnnotationsUnchanged(pod, oldPod, signatureAnnotationKey(contentsKey)))
 	})
-	if err != nil {
+	webhook.validateGMSAFieldsConsistency(violations, admissionCtx, pod)
+
+	if err := webhook.enforce(admissionCtx, validate, violations.aggregate()); err != nil {
 		return nil, err
 	}
 
@@ -341,11 +681,33 @@ func assertAnnotationsUnchanged(pod, oldPod *corev1.Pod, key string) *podAdmissi
 			error: fmt.Errorf("cannot update an existing pod's gMSA annotation (annotation %v changed)", key),
 			pod:   pod,
 			code:  http.StatusForbidden,
+			field: annotationField(key),
 		}
 	}
 	return nil
 }
 
+// annotationPatches returns the JSON patches setting the given annotation on the pod, and sets
+// it on the pod itself.
+func annotationPatches(pod *corev1.Pod, key, value string) []map[string]interface{} {
+	var patches []map[string]interface{}
+	if pod.Annotations == nil {
+		pod.Annotations = make(map[string]string)
+		patches = append(patches, map[string]interface{}{
+			"op":    "add",
+			"path":  "/metadata/annotations",
+			"value": map[string]string{},
+		})
+	}
+	pod.Annotations[key] = value
+
+	return append(patches, map[string]interface{}{
+		"op":    "add",
+		"path":  fmt.Sprintf("/metadata/annotations/%s", jsonPatchEscaper.Replace(key)),
+		"value": value,
+	})
+}
+
 // iterateOverGMSAAnnotationPairs calls `f` on the successive pairs of GMSA name and contents
 // annotation keys.
 func iterateOverGMSAAnnotationPairs(pod *corev1.Pod, f func(nameKey, contentsKey string)) {
@@ -355,34 +717,36 @@ func iterateOverGMSAAnnotationPairs(pod *corev1.Pod, f func(nameKey, contentsKey
 	}
 }
 
+// requestedCredSpecNames returns the distinct names of the GMSA cred specs requested by the pod.
+func requestedCredSpecNames(pod *corev1.Pod) []string {
+	var credSpecNames []string
+	iterateOverGMSAAnnotationPairs(pod, func(nameKey, _ string) {
+		if credSpecName := pod.Annotations[nameKey]; credSpecName != "" && !containsString(credSpecNames, credSpecName) {
+			credSpecNames = append(credSpecNames, credSpecName)
+		}
+	})
+	return credSpecNames
+}
+
 // deniedAdmissionResponse is a helper function to create an AdmissionResponse
 // with an embedded error.
-func deniedAdmissionResponse(err error, httpCode ...int) *admissionv1beta1.AdmissionResponse {
-	var code int
-	logMsg := "refusing to admit"
-
-	if admissionError, ok := err.(*podAdmissionError); ok {
-		code = admissionError.code
+func deniedAdmissionResponse(admissionError *podAdmissionError) *admissionv1beta1.AdmissionResponse {
+	status := &metav1.Status{
+		Message: admissionError.Error(),
+		Code:    int32(admissionError.code),
+	}
+	if len(admissionError.causes) != 0 {
+		status.Details = &metav1.StatusDetails{
+			Kind:   "Pod",
+			Causes: admissionError.causes,
+		}
 		if admissionError.pod != nil {
-			logMsg += fmt.Sprintf(" pod %+v", admissionError.pod)
+			status.Details.Name = admissionError.pod.Name
 		}
 	}
 
-	if len(httpCode) > 0 {
-		code = httpCode[0]
-	}
-
-	if code != 0 {
-		logMsg += fmt.Sprintf(" with code %v", code)
-	}
-
-	logrus.Infof("%s: %v", logMsg, err)
-
 	return &admissionv1beta1.AdmissionResponse{
 		Allowed: false,
-		Result: &metav1.Status{
-			Message: err.Error(),
-			Code:    int32(code),
-		},
+		Result:  status,
 	}
 }
@@ -0,0 +1,921 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	fuzz "github.com/google/gofuzz"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const fuzzIterations = 2000
+
+// fuzzKubeClient is a kubeClientInterface whose answers only depend on its inputs, so that
+// fuzzed requests exercise both the happy and the unhappy paths.
+type fuzzKubeClient struct{}
+
+func (*fuzzKubeClient) isAuthorizedToUseCredSpec(serviceAccountName, namespace, credSpecName string) (bool, string) {
+	return len(credSpecName)%2 == 0, "fuzzed"
+}
+
+func (*fuzzKubeClient) isUserAuthorizedToUseCredSpec(userInfo authenticationv1.UserInfo, namespace, credSpecName string) (bool, string) {
+	return len(credSpecName)%2 == 0, "fuzzed"
+}
+
+func (*fuzzKubeClient) retrieveCredSpecContents(credSpecName string) (string, int, error) {
+	if len(credSpecName)%3 == 0 {
+		return "", http.StatusNotFound, fmt.Errorf("cred spec %s does not exist", credSpecName)
+	}
+	return fmt.Sprintf(`{"name":%q}`, credSpecName), 0, nil
+}
+
+func (*fuzzKubeClient) retrieveCredSpecLabels(credSpecName string) (map[string]string, int, error) {
+	return map[string]string{"name": credSpecName}, 0, nil
+}
+
+func (*fuzzKubeClient) retrieveNamespace(name string) (*corev1.Namespace, int, error) {
+	return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}, 0, nil
+}
+
+func (*fuzzKubeClient) listGMSAPolicies(namespace string) ([]*gmsaPolicy, int, error) {
+	return []*gmsaPolicy{{
+		ObjectMeta: metav1.ObjectMeta{Name: "policy", Namespace: namespace},
+		Spec:       gmsaPolicySpec{MaxIdentitiesPerPod: 2},
+	}}, 0, nil
+}
+
+// retrieveServiceAccount binds service accounts named "gmsa-<name>" to the cred spec named <name>.
+func (*fuzzKubeClient) retrieveServiceAccount(namespace, name string) (*corev1.ServiceAccount, int, error) {
+	serviceAccount := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace}}
+	if strings.HasPrefix(name, "gmsa-") {
+		serviceAccount.Annotations = map[string]string{serviceAccountCredSpecNameAnnotationKey: strings.TrimPrefix(name, "gmsa-")}
+	}
+	return serviceAccount, 0, nil
+}
+
+func (*fuzzKubeClient) recordEvent(object *corev1.ObjectReference, eventType, reason, message string) {
+}
+
+// defaultServiceAccountKubeClient is a fuzzKubeClient whose namespaces' default service account
+// is bound to the given cred spec.
+type defaultServiceAccountKubeClient struct {
+	fuzzKubeClient
+	credSpecName string
+}
+
+func (client *defaultServiceAccountKubeClient) retrieveServiceAccount(namespace, name string) (*corev1.ServiceAccount, int, error) {
+	serviceAccount, code, err := client.fuzzKubeClient.retrieveServiceAccount(namespace, name)
+	if err == nil && name == defaultServiceAccountName {
+		serviceAccount.Annotations = map[string]string{serviceAccountCredSpecNameAnnotationKey: client.credSpecName}
+	}
+	return serviceAccount, code, err
+}
+
+// eventRecordingKubeClient is a fuzzKubeClient that keeps track of the events it records.
+type eventRecordingKubeClient struct {
+	fuzzKubeClient
+	events []string
+}
+
+func (client *eventRecordingKubeClient) recordEvent(object *corev1.ObjectReference, eventType, reason, message string) {
+	client.events = append(client.events, fmt.Sprintf("%s %s %s %s/%s: %s", eventType, reason, object.Kind, object.Namespace, object.Name, message))
+}
+
+// newRequestFuzzer returns a fuzzer generating admission reviews that, more often than not,
+// contain pods that use GMSAs.
+func newRequestFuzzer(seed int64) *fuzz.Fuzzer {
+	return fuzz.New().RandSource(rand.NewSource(seed)).NilChance(.2).NumElements(0, 3).Funcs(
+		func(quantity *resource.Quantity, c fuzz.Continue) {
+			*quantity = *resource.NewQuantity(c.Int63n(1000), resource.DecimalSI)
+		},
+		func(intOrString *intstr.IntOrString, c fuzz.Continue) {
+			if c.RandBool() {
+				*intOrString = intstr.FromInt(c.Intn(1000))
+			} else {
+				*intOrString = intstr.FromString(c.RandString())
+			}
+		},
+		func(pod *corev1.Pod, c fuzz.Continue) {
+			c.FuzzNoCustom(pod)
+			if pod.Annotations == nil && c.RandBool() {
+				pod.Annotations = make(map[string]string)
+			}
+			if pod.Annotations == nil {
+				return
+			}
+
+			randomCredSpecName := func() string {
+				return []string{"", "a", "ab", "abc", "abcd", c.RandString()}[c.Intn(6)]
+			}
+			if c.RandBool() {
+				pod.Annotations[gMSAPodSpecNameAnnotationKey] = randomCredSpecName()
+			}
+			if c.RandBool() {
+				pod.Annotations[gMSAPodSpecContentsAnnotationKey] = c.RandString()
+			}
+			for _, container := range pod.Spec.Containers {
+				if c.RandBool() {
+					pod.Annotations[container.Name+gMSAContainerSpecNameAnnotationKeySuffix] = randomCredSpecName()
+				}
+				if c.RandBool() {
+					pod.Annotations[container.Name+gMSAContainerSpecContentsAnnotationKeySuffix] = c.RandString()
+				}
+			}
+			if c.RandBool() {
+				pod.Spec.NodeSelector = map[string]string{windowsNodeSelectorKey: "windows"}
+			}
+		},
+		func(rawExtension *runtime.RawExtension, c fuzz.Continue) {
+			switch c.Intn(4) {
+			case 0:
+				c.Fuzz(&rawExtension.Raw)
+			case 1:
+				rawExtension.Raw = []byte("null")
+			default:
+				pod := &corev1.Pod{}
+				c.Fuzz(pod)
+				rawExtension.Raw, _ = json.Marshal(pod)
+			}
+		},
+		func(request *admissionv1beta1.AdmissionRequest, c fuzz.Continue) {
+			c.FuzzNoCustom(request)
+			if c.Intn(4) != 0 {
+				request.Kind = metav1.GroupVersionKind{Version: "v1", Kind: "Pod"}
+			}
+			if c.Intn(4) != 0 {
+				request.Operation = []admissionv1beta1.Operation{admissionv1beta1.Create, admissionv1beta1.Update}[c.Intn(2)]
+			}
+		},
+	)
+}
+
+// fuzzHTTPRequest generates a random HTTP request, more often than not a well-formed one.
+func fuzzHTTPRequest(fuzzer *fuzz.Fuzzer, random *rand.Rand) *http.Request {
+	var body []byte
+	switch random.Intn(5) {
+	case 0:
+		fuzzer.Fuzz(&body)
+	default:
+		admissionReview := &admissionv1beta1.AdmissionReview{}
+		fuzzer.Fuzz(admissionReview)
+		body, _ = json.Marshal(admissionReview)
+		if random.Intn(10) == 0 {
+			// truncated JSON
+			body = body[:random.Intn(len(body)+1)]
+		}
+	}
+
+	method := []string{"POST", "post", "GET", "PUT"}[random.Intn(4)]
+	request := httptest.NewRequest(method, "/", bytes.NewReader(body))
+
+	contentType := []string{"application/json", "application/json; charset=utf-8", "application/json; charset=latin1", "text/plain", "", "application/json; ;"}[random.Intn(6)]
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	if random.Intn(20) == 0 {
+		request.Body = nil
+	}
+
+	return request
+}
+
+func TestHTTPRequestToAdmissionResponseNeverPanicsOnMalformedInput(t *testing.T) {
+	defer logrus.SetOutput(logrus.StandardLogger().Out)
+	logrus.SetOutput(ioutil.Discard)
+
+	webhook := newWebhook(&fuzzKubeClient{}, &webhookConfig{
+		enforcementMode:                enforcementModeEnforce,
+		windowsSchedulingMode:          windowsSchedulingMutate,
+		gaGMSAFieldsAvailable:          true,
+		sharedCredSpecWarningThreshold: 2,
+	})
+
+	seed := rand.Int63()
+	t.Logf("fuzzing with seed %d", seed)
+	fuzzer := newRequestFuzzer(seed)
+	random := rand.New(rand.NewSource(seed))
+
+	for i := 0; i < fuzzIterations; i++ {
+		for _, operation := range []webhookOperation{validate, mutate} {
+			request := fuzzHTTPRequest(fuzzer, random)
+
+			if !assert.NotPanics(t, func() {
+				admissionResponse, _, httpErr := webhook.httpRequestToAdmissionResponse(request, operation)
+
+				if httpErr == nil {
+					assert.NotNil(t, admissionResponse)
+				} else {
+					assert.Nil(t, admissionResponse)
+					assert.True(t, httpErr.code >= 400 && httpErr.code < 500, "unexpected HTTP code %d", httpErr.code)
+				}
+			}, "iteration %d", i) {
+				return
+			}
+		}
+	}
+}
+
+func TestHTTPRequestToAdmissionResponseProtocolErrors(t *testing.T) {
+	webhook := newWebhook(&fuzzKubeClient{}, &webhookConfig{enforcementMode: enforcementModeEnforce})
+	validBody := `{"request":{"uid":"123","kind":{"version":"v1","kind":"Pod"},"operation":"CREATE","object":{"metadata":{"name":"pod"}}}}`
+
+	for _, testCase := range []struct {
+		name         string
+		method       string
+		contentType  string
+		body         string
+		nilBody      bool
+		expectedCode int
+	}{
+		{name: "valid", method: "POST", contentType: "application/json", body: validBody},
+		{name: "with utf-8 charset", method: "POST", contentType: "application/json; charset=UTF-8", body: validBody},
+		{name: "wrong method", method: "GET", contentType: "application/json", body: validBody, expectedCode: http.StatusMethodNotAllowed},
+		{name: "wrong content type", method: "POST", contentType: "text/plain", body: validBody, expectedCode: http.StatusUnsupportedMediaType},
+		{name: "wrong charset", method: "POST", contentType: "application/json; charset=latin1", body: validBody, expectedCode: http.StatusUnsupportedMediaType},
+		{name: "no body", method: "POST", contentType: "application/json", nilBody: true, expectedCode: http.StatusBadRequest},
+		{name: "invalid JSON", method: "POST", contentType: "application/json", body: "{", expectedCode: http.StatusBadRequest},
+		{name: "no request", method: "POST", contentType: "application/json", body: "{}", expectedCode: http.StatusBadRequest},
+		{name: "too large", method: "POST", contentType: "application/json", body: fmt.Sprintf(`{"padding":%q}`, strings.Repeat("a", maxRequestBodyBytes)), expectedCode: http.StatusRequestEntityTooLarge},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			request := httptest.NewRequest(testCase.method, "/validate", bytes.NewReader([]byte(testCase.body)))
+			request.Header.Set("Content-Type", testCase.contentType)
+			if testCase.nilBody {
+				request.Body = nil
+			}
+
+			admissionResponse, _, httpErr := webhook.httpRequestToAdmissionResponse(request, validate)
+
+			if testCase.expectedCode == 0 {
+				if assert.Nil(t, httpErr) && assert.NotNil(t, admissionResponse) {
+					assert.True(t, admissionResponse.Allowed)
+					assert.Equal(t, "123", string(admissionResponse.UID))
+				}
+			} else if assert.NotNil(t, httpErr) {
+				assert.Nil(t, admissionResponse)
+				assert.Equal(t, testCase.expectedCode, httpErr.code)
+			}
+		})
+	}
+}
+
+// newAdmissionHTTPRequest wraps a pod into an HTTP admission request.
+func newAdmissionHTTPRequest(t *testing.T, operation admissionv1beta1.Operation, pod *corev1.Pod) *http.Request {
+	return newObjectAdmissionHTTPRequest(t, operation, metav1.GroupVersionKind{Version: "v1", Kind: "Pod"}, pod, nil)
+}
+
+// newObjectAdmissionHTTPRequest returns a request to admit any kind of object; oldObject
+// can be nil, except for updates.
+func newObjectAdmissionHTTPRequest(t *testing.T, operation admissionv1beta1.Operation, kind metav1.GroupVersionKind, object, oldObject interface{}) *http.Request {
+	objectBytes, err := json.Marshal(object)
+	require.Nil(t, err)
+
+	admissionRequest := &admissionv1beta1.AdmissionRequest{
+		UID:       "123",
+		Kind:      kind,
+		Namespace: "default",
+		Operation: operation,
+		Object:    runtime.RawExtension{Raw: objectBytes},
+	}
+	if oldObject != nil {
+		oldObjectBytes, err := json.Marshal(oldObject)
+		require.Nil(t, err)
+		admissionRequest.OldObject = runtime.RawExtension{Raw: oldObjectBytes}
+	}
+
+	return admissionRequestToHTTPRequest(t, admissionRequest)
+}
+
+// newDryRunAdmissionHTTPRequest is the same as newAdmissionHTTPRequest, for a dry run request.
+func newDryRunAdmissionHTTPRequest(t *testing.T, operation admissionv1beta1.Operation, pod *corev1.Pod) *http.Request {
+	podBytes, err := json.Marshal(pod)
+	require.Nil(t, err)
+
+	dryRun := true
+	return admissionRequestToHTTPRequest(t, &admissionv1beta1.AdmissionRequest{
+		UID:       "123",
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+		Namespace: "default",
+		Operation: operation,
+		Object:    runtime.RawExtension{Raw: podBytes},
+		DryRun:    &dryRun,
+	})
+}
+
+func admissionRequestToHTTPRequest(t *testing.T, admissionRequest *admissionv1beta1.AdmissionRequest) *http.Request {
+	body, err := json.Marshal(&admissionv1beta1.AdmissionReview{Request: admissionRequest})
+	require.Nil(t, err)
+
+	request := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	return request
+}
+
+func TestDryRunRequestsHaveNoSideEffects(t *testing.T) {
+	t.Run("no denial events", func(t *testing.T) {
+		client := &eventRecordingKubeClient{}
+		webhook := newWebhook(client, &webhookConfig{enforcementMode: enforcementModeEnforce, windowsSchedulingMode: windowsSchedulingNone, denialEvents: true})
+		isController := true
+		// odd-length cred spec names are not authorized
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "web-5d8f9c6b7-abcde",
+				Annotations:     map[string]string{gMSAPodSpecNameAnnotationKey: "a"},
+				OwnerReferences: []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "web-5d8f9c6b7", Controller: &isController}},
+			},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "container"}}},
+		}
+
+		admissionResponse, _, httpErr := webhook.httpRequestToAdmissionResponse(newDryRunAdmissionHTTPRequest(t, admissionv1beta1.Create, pod), validate)
+		require.Nil(t, httpErr)
+		assert.False(t, admissionResponse.Allowed)
+		assert.Empty(t, client.events)
+
+		admissionResponse, _, httpErr = webhook.httpRequestToAdmissionResponse(newAdmissionHTTPRequest(t, admissionv1beta1.Create, pod), validate)
+		require.Nil(t, httpErr)
+		assert.False(t, admissionResponse.Allowed)
+		assert.Equal(t, 1, len(client.events))
+	})
+
+	t.Run("no usage tracking", func(t *testing.T) {
+		webhook := newWebhook(&fuzzKubeClient{}, &webhookConfig{enforcementMode: enforcementModeEnforce, windowsSchedulingMode: windowsSchedulingNone, sharedCredSpecWarningThreshold: 1})
+		pod := newTestPod(map[string]string{
+			gMSAPodSpecNameAnnotationKey:     "ab",
+			gMSAPodSpecContentsAnnotationKey: `{"name":"ab"}`,
+		})
+
+		admissionResponse, _, httpErr := webhook.httpRequestToAdmissionResponse(newDryRunAdmissionHTTPRequest(t, admissionv1beta1.Create, pod), validate)
+		require.Nil(t, httpErr)
+		require.True(t, admissionResponse.Allowed)
+		assert.Empty(t, webhook.credSpecUsage.namespaces)
+
+		admissionResponse, _, httpErr = webhook.httpRequestToAdmissionResponse(newAdmissionHTTPRequest(t, admissionv1beta1.Create, pod), validate)
+		require.Nil(t, httpErr)
+		require.True(t, admissionResponse.Allowed)
+		assert.Equal(t, map[string]map[string]bool{"ab": {"default": true}}, webhook.credSpecUsage.namespaces)
+	})
+}
+
+func TestUnenforcedViolationsOnlyWarnedAboutWhenValidating(t *testing.T) {
+	webhook := newWebhook(&fuzzKubeClient{}, &webhookConfig{enforcementMode: enforcementModeWarn, windowsSchedulingMode: windowsSchedulingNone})
+	// odd-length cred spec names are not authorized
+	pod := newTestPod(map[string]string{gMSAPodSpecNameAnnotationKey: "a"})
+	wouldHaveBeenDenied := func(warnings []string) (count int) {
+		for _, warning := range warnings {
+			if strings.HasPrefix(warning, "this pod would have been denied") {
+				count++
+			}
+		}
+		return
+	}
+
+	admissionResponse, warnings, httpErr := webhook.httpRequestToAdmissionResponse(newAdmissionHTTPRequest(t, admissionv1beta1.Create, pod), mutate)
+	require.Nil(t, httpErr)
+	assert.True(t, admissionResponse.Allowed)
+	assert.Equal(t, 0, wouldHaveBeenDenied(warnings))
+
+	// the mutated pod
+	pod.Annotations[gMSAPodSpecContentsAnnotationKey] = `{"name":"a"}`
+	admissionResponse, warnings, httpErr = webhook.httpRequestToAdmissionResponse(newAdmissionHTTPRequest(t, admissionv1beta1.Create, pod), validate)
+	require.Nil(t, httpErr)
+	assert.True(t, admissionResponse.Allowed)
+	assert.Equal(t, 1, wouldHaveBeenDenied(warnings))
+}
+
+// newTestPod returns a pod with a single container, and the given annotations.
+func newTestPod(annotations map[string]string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod", Annotations: annotations},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "container"}}},
+	}
+}
+
+// admitPod runs a pod creation request through the webhook, and returns its response, along
+// with the values set by its JSON patches, keyed by path; pod can also be the unstructured
+// representation of a pod.
+func admitPod(t *testing.T, webhook *webhook, operation webhookOperation, pod interface{}) (*admissionv1beta1.AdmissionResponse, map[string]interface{}) {
+	request := newObjectAdmissionHTTPRequest(t, admissionv1beta1.Create, metav1.GroupVersionKind{Version: "v1", Kind: "Pod"}, pod, nil)
+	admissionResponse, _, httpErr := webhook.httpRequestToAdmissionResponse(request, operation)
+	require.Nil(t, httpErr)
+
+	patchedValues := make(map[string]interface{})
+	if admissionResponse.Patch != nil {
+		var patches []map[string]interface{}
+		require.Nil(t, json.Unmarshal(admissionResponse.Patch, &patches))
+		for _, patch := range patches {
+			patchedValues[patch["path"].(string)] = patch["value"]
+		}
+	}
+	return admissionResponse, patchedValues
+}
+
+func TestPodViolationsAggregate(t *testing.T) {
+	pod := newTestPod(nil)
+	violation := func(message string, code int, field string) *podAdmissionError {
+		return &podAdmissionError{error: fmt.Errorf(message), code: code, pod: pod, field: field}
+	}
+	nameField := annotationField(gMSAPodSpecNameAnnotationKey)
+	contentsField := annotationField(gMSAPodSpecContentsAnnotationKey)
+
+	for _, testCase := range []struct {
+		name            string
+		violations      []*podAdmissionError
+		expectedMessage string
+		expectedCode    int
+		expectedCauses  []metav1.StatusCause
+	}{
+		{
+			name: "no violations",
+		},
+		{
+			name:            "single violation",
+			violations:      []*podAdmissionError{violation("forbidden", http.StatusForbidden, nameField)},
+			expectedMessage: "forbidden",
+			expectedCode:    http.StatusForbidden,
+			expectedCauses:  []metav1.StatusCause{{Type: causeTypeFieldValueForbidden, Message: "forbidden", Field: nameField}},
+		},
+		{
+			name: "multiple client-side violations",
+			violations: []*podAdmissionError{
+				violation("forbidden", http.StatusForbidden, nameField),
+				violation("not found", http.StatusNotFound, nameField),
+				violation("invalid", http.StatusBadRequest, contentsField),
+			},
+			expectedMessage: "found 3 gMSA violations: forbidden; not found; invalid",
+			expectedCode:    http.StatusForbidden,
+			expectedCauses: []metav1.StatusCause{
+				{Type: causeTypeFieldValueForbidden, Message: "forbidden", Field: nameField},
+				{Type: metav1.CauseTypeFieldValueNotFound, Message: "not found", Field: nameField},
+				{Type: metav1.CauseTypeFieldValueInvalid, Message: "invalid", Field: contentsField},
+			},
+		},
+		{
+			name: "server-side errors take precedence",
+			violations: []*podAdmissionError{
+				violation("forbidden", http.StatusForbidden, nameField),
+				violation("internal", http.StatusInternalServerError, nameField),
+				violation("unavailable", http.StatusServiceUnavailable, ""),
+			},
+			expectedMessage: "found 3 gMSA violations: forbidden; internal; unavailable",
+			expectedCode:    http.StatusInternalServerError,
+			expectedCauses: []metav1.StatusCause{
+				{Type: causeTypeFieldValueForbidden, Message: "forbidden", Field: nameField},
+				{Type: metav1.CauseTypeFieldValueInvalid, Message: "internal", Field: nameField},
+				{Type: metav1.CauseTypeFieldValueInvalid, Message: "unavailable"},
+			},
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			violations := newPodViolations(pod)
+			for _, violation := range testCase.violations {
+				violations.add(violation)
+			}
+			violations.add(nil)
+
+			err := violations.aggregate()
+
+			if testCase.expectedCode == 0 {
+				assert.Nil(t, err)
+				return
+			}
+			require.NotNil(t, err)
+			assert.Equal(t, testCase.expectedMessage, err.Error())
+			assert.Equal(t, testCase.expectedCode, err.code)
+			assert.Equal(t, testCase.expectedCauses, err.causes)
+
+			// and the causes get passed on to the API server
+			admissionResponse := deniedAdmissionResponse(err)
+			assert.False(t, admissionResponse.Allowed)
+			assert.Equal(t, testCase.expectedMessage, admissionResponse.Result.Message)
+			assert.Equal(t, int32(testCase.expectedCode), admissionResponse.Result.Code)
+			if assert.NotNil(t, admissionResponse.Result.Details) {
+				assert.Equal(t, "Pod", admissionResponse.Result.Details.Kind)
+				assert.Equal(t, pod.Name, admissionResponse.Result.Details.Name)
+				assert.Equal(t, testCase.expectedCauses, admissionResponse.Result.Details.Causes)
+			}
+		})
+	}
+}
+
+func TestMutateCreateRequestIsIdempotent(t *testing.T) {
+	webhook := newWebhook(&fuzzKubeClient{}, &webhookConfig{enforcementMode: enforcementModeEnforce, windowsSchedulingMode: windowsSchedulingNone})
+	newPod := func(contents string) *corev1.Pod {
+		pod := newTestPod(map[string]string{gMSAPodSpecNameAnnotationKey: "ab"})
+		if contents != "" {
+			pod.Annotations[gMSAPodSpecContentsAnnotationKey] = contents
+		}
+		return pod
+	}
+	expectedContents, _, _ := (&fuzzKubeClient{}).retrieveCredSpecContents("ab")
+
+	// first invocation: the contents get injected
+	admissionResponse, patchedValues := admitPod(t, webhook, mutate, newPod(""))
+	assert.True(t, admissionResponse.Allowed)
+	assert.Equal(t, expectedContents, patchedValues["/metadata/annotations/"+jsonPatchEscaper.Replace(gMSAPodSpecContentsAnnotationKey)])
+
+	// re-invocation: nothing left to do
+	admissionResponse, _, httpErr := webhook.httpRequestToAdmissionResponse(newAdmissionHTTPRequest(t, admissionv1beta1.Create, newPod(expectedContents)), mutate)
+	require.Nil(t, httpErr)
+	assert.True(t, admissionResponse.Allowed)
+	assert.Nil(t, admissionResponse.Patch)
+
+	// contents that we wouldn't have injected are still forbidden
+	admissionResponse, _, httpErr = webhook.httpRequestToAdmissionResponse(newAdmissionHTTPRequest(t, admissionv1beta1.Create, newPod(`{"name":"forged"}`)), mutate)
+	require.Nil(t, httpErr)
+	assert.False(t, admissionResponse.Allowed)
+	assert.Contains(t, admissionResponse.Result.Message, "cannot pre-set a pod's gMSA content annotation")
+}
+
+func TestSignedContents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signing-keys")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	writeSigningKey(t, dir, "key", minSigningKeyLength)
+
+	webhook := newWebhook(&fuzzKubeClient{}, &webhookConfig{enforcementMode: enforcementModeEnforce, windowsSchedulingMode: windowsSchedulingNone, signingKeysDir: dir})
+	credSpecName := "ab"
+	currentContents, _, _ := (&fuzzKubeClient{}).retrieveCredSpecContents(credSpecName)
+	signatureKey := signatureAnnotationKey(gMSAPodSpecContentsAnnotationKey)
+
+	newPod := func(contents, signature string) *corev1.Pod {
+		pod := newTestPod(map[string]string{gMSAPodSpecNameAnnotationKey: credSpecName})
+		if contents != "" {
+			pod.Annotations[gMSAPodSpecContentsAnnotationKey] = contents
+		}
+		if signature != "" {
+			pod.Annotations[signatureKey] = signature
+		}
+		return pod
+	}
+	contentsPath := "/metadata/annotations/" + jsonPatchEscaper.Replace(gMSAPodSpecContentsAnnotationKey)
+	signaturePath := "/metadata/annotations/" + jsonPatchEscaper.Replace(signatureKey)
+
+	// mutation signs the contents it injects...
+	admissionResponse, patchedValues := admitPod(t, webhook, mutate, newPod("", ""))
+	require.True(t, admissionResponse.Allowed)
+	assert.Equal(t, currentContents, patchedValues[contentsPath])
+	signature, _ := patchedValues[signaturePath].(string)
+	require.NotEmpty(t, signature)
+
+	// ... which validation then accepts
+	admissionResponse, _ = admitPod(t, webhook, validate, newPod(currentContents, signature))
+	assert.True(t, admissionResponse.Allowed)
+
+	// and that don't need to be re-signed when mutation gets re-invoked
+	admissionResponse, patchedValues = admitPod(t, webhook, mutate, newPod(currentContents, signature))
+	require.True(t, admissionResponse.Allowed)
+	assert.Empty(t, patchedValues)
+
+	// unsigned contents matching the cred spec get replaced with signed ones, rather than signed as is
+	reserializedContents := strings.Replace(currentContents, ":", ": ", 1)
+	admissionResponse, patchedValues = admitPod(t, webhook, mutate, newPod(reserializedContents, ""))
+	require.True(t, admissionResponse.Allowed)
+	assert.Equal(t, currentContents, patchedValues[contentsPath])
+	assert.Equal(t, signature, patchedValues[signaturePath])
+
+	// same for contents signed with keys that have since been rotated out
+	admissionResponse, patchedValues = admitPod(t, webhook, mutate, newPod(currentContents, "v1:retired:Zm9yZ2Vk"))
+	require.True(t, admissionResponse.Allowed)
+	assert.Equal(t, currentContents, patchedValues[contentsPath])
+	assert.Equal(t, signature, patchedValues[signaturePath])
+
+	// unsigned contents are rejected by validation, even if they match the cred spec
+	admissionResponse, _ = admitPod(t, webhook, validate, newPod(currentContents, ""))
+	if assert.False(t, admissionResponse.Allowed) {
+		assert.Contains(t, admissionResponse.Result.Message, "was not injected by this webhook")
+	}
+
+	// restored pods whose signed contents are outdated get them refreshed
+	staleSignature, err := webhook.signingKeys.sign("default", "", credSpecName, "stale contents")
+	require.Nil(t, err)
+	admissionResponse, patchedValues = admitPod(t, webhook, mutate, newPod("stale contents", staleSignature))
+	require.True(t, admissionResponse.Allowed)
+	assert.Equal(t, currentContents, patchedValues[contentsPath])
+	assert.NotEmpty(t, patchedValues[signaturePath])
+	assert.NotEqual(t, staleSignature, patchedValues[signaturePath])
+
+	// but signatures for other namespaces, or forged ones, are rejected
+	otherNamespaceSignature, err := webhook.signingKeys.sign("other", "", credSpecName, "stale contents")
+	require.Nil(t, err)
+	for _, forgedSignature := range []string{otherNamespaceSignature, "v1:key:Zm9yZ2Vk"} {
+		admissionResponse, _ = admitPod(t, webhook, mutate, newPod("stale contents", forgedSignature))
+		if assert.False(t, admissionResponse.Allowed) {
+			assert.Contains(t, admissionResponse.Result.Message, "invalid signature in annotation")
+		}
+	}
+}
+
+func TestWindowsSchedulingMutationRejectsConflictingNodeSelectors(t *testing.T) {
+	webhook := newWebhook(&fuzzKubeClient{}, &webhookConfig{enforcementMode: enforcementModeEnforce, windowsSchedulingMode: windowsSchedulingMutate})
+	newPod := func(nodeSelector map[string]string) *corev1.Pod {
+		pod := newTestPod(map[string]string{gMSAPodSpecNameAnnotationKey: "ab"})
+		pod.Spec.NodeSelector = nodeSelector
+		return pod
+	}
+
+	for _, label := range osNodeLabels {
+		admissionResponse, _, httpErr := webhook.httpRequestToAdmissionResponse(newAdmissionHTTPRequest(t, admissionv1beta1.Create, newPod(map[string]string{label: "linux"})), mutate)
+		require.Nil(t, httpErr)
+		if assert.False(t, admissionResponse.Allowed, label) {
+			assert.Contains(t, admissionResponse.Result.Message, fmt.Sprintf("the pod's node selector requires %s=linux", label))
+		}
+	}
+
+	// pods not selecting any OS get restricted to Windows nodes
+	admissionResponse, _, httpErr := webhook.httpRequestToAdmissionResponse(newAdmissionHTTPRequest(t, admissionv1beta1.Create, newPod(map[string]string{"disk": "ssd"})), mutate)
+	require.Nil(t, httpErr)
+	require.True(t, admissionResponse.Allowed)
+	assert.Contains(t, string(admissionResponse.Patch), `"path":"/spec/nodeSelector/beta.kubernetes.io~1os","value":"windows"`)
+}
+
+func TestValidateWorkloadPodTemplates(t *testing.T) {
+	webhook := newWebhook(&fuzzKubeClient{}, &webhookConfig{enforcementMode: enforcementModeEnforce, windowsSchedulingMode: windowsSchedulingMutate})
+	newTemplate := func(credSpecName string) corev1.PodTemplateSpec {
+		return corev1.PodTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{gMSAPodSpecNameAnnotationKey: credSpecName},
+			},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "container"}}},
+		}
+	}
+	newDeployment := func(credSpecName string, replicas int32) *appsv1.Deployment {
+		return &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "deployment"},
+			Spec: appsv1.DeploymentSpec{
+				Replicas: &replicas,
+				Template: newTemplate(credSpecName),
+			},
+		}
+	}
+	newCronJob := func(credSpecName string) *batchv1beta1.CronJob {
+		cronJob := &batchv1beta1.CronJob{ObjectMeta: metav1.ObjectMeta{Name: "cron-job"}}
+		cronJob.Spec.JobTemplate.Spec.Template = newTemplate(credSpecName)
+		return cronJob
+	}
+	deploymentKind := metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}
+	cronJobKind := metav1.GroupVersionKind{Group: "batch", Version: "v1beta1", Kind: "CronJob"}
+
+	for name, testCase := range map[string]struct {
+		request       *http.Request
+		expectedField string
+		expectedKind  string
+		expectedName  string
+	}{
+		"authorized deployment": {
+			request: newObjectAdmissionHTTPRequest(t, admissionv1beta1.Create, deploymentKind, newDeployment("ab", 1), nil),
+		},
+		"unauthorized deployment": {
+			request:       newObjectAdmissionHTTPRequest(t, admissionv1beta1.Create, deploymentKind, newDeployment("abc", 1), nil),
+			expectedField: "spec.template." + annotationField(gMSAPodSpecNameAnnotationKey),
+			expectedKind:  "Deployment",
+			expectedName:  "deployment",
+		},
+		"deployment updated to use an unauthorized cred spec": {
+			request:       newObjectAdmissionHTTPRequest(t, admissionv1beta1.Update, deploymentKind, newDeployment("abc", 1), newDeployment("ab", 1)),
+			expectedField: "spec.template." + annotationField(gMSAPodSpecNameAnnotationKey),
+			expectedKind:  "Deployment",
+			expectedName:  "deployment",
+		},
+		"scaling a deployment doesn't re-validate its pod template": {
+			request: newObjectAdmissionHTTPRequest(t, admissionv1beta1.Update, deploymentKind, newDeployment("abc", 2), newDeployment("abc", 1)),
+		},
+		"authorized cron job": {
+			request: newObjectAdmissionHTTPRequest(t, admissionv1beta1.Create, cronJobKind, newCronJob("ab"), nil),
+		},
+		"unauthorized cron job": {
+			request:       newObjectAdmissionHTTPRequest(t, admissionv1beta1.Create, cronJobKind, newCronJob("abc"), nil),
+			expectedField: "spec.jobTemplate.spec.template." + annotationField(gMSAPodSpecNameAnnotationKey),
+			expectedKind:  "CronJob",
+			expectedName:  "cron-job",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			admissionResponse, _, httpErr := webhook.httpRequestToAdmissionResponse(testCase.request, validate)
+			require.Nil(t, httpErr)
+
+			if testCase.expectedField == "" {
+				// not being restricted to Windows nodes is fine, since "/mutate" will fix the pods
+				assert.True(t, admissionResponse.Allowed)
+				return
+			}
+
+			require.False(t, admissionResponse.Allowed)
+			assert.Contains(t, admissionResponse.Result.Message, "service account default does not have `use` access to the abc gMSA cred spec")
+			require.NotNil(t, admissionResponse.Result.Details)
+			assert.Equal(t, testCase.expectedKind, admissionResponse.Result.Details.Kind)
+			assert.Equal(t, testCase.expectedName, admissionResponse.Result.Details.Name)
+			if assert.Equal(t, 1, len(admissionResponse.Result.Details.Causes)) {
+				assert.Equal(t, testCase.expectedField, admissionResponse.Result.Details.Causes[0].Field)
+			}
+		})
+	}
+}
+
+func TestGMSAFieldsConsistency(t *testing.T) {
+	gaWebhook := newWebhook(&fuzzKubeClient{}, &webhookConfig{enforcementMode: enforcementModeEnforce, windowsSchedulingMode: windowsSchedulingNone, gaGMSAFieldsAvailable: true})
+	contents, _, _ := (&fuzzKubeClient{}).retrieveCredSpecContents("ab")
+	reserializedContents := strings.Replace(contents, ":", ": ", 1)
+
+	// newPod returns the unstructured representation of a pod with the given GMSA annotations,
+	// and the given GMSA fields on its pod-level security context, if any
+	newPod := func(annotations map[string]string, podOptions *windowsOptions) map[string]interface{} {
+		podBytes, err := json.Marshal(newTestPod(annotations))
+		require.Nil(t, err)
+		var pod map[string]interface{}
+		require.Nil(t, json.Unmarshal(podBytes, &pod))
+		if podOptions != nil {
+			pod["spec"].(map[string]interface{})["securityContext"] = map[string]interface{}{"windowsOptions": podOptions}
+		}
+		return pod
+	}
+	stringPointer := func(s string) *string {
+		return &s
+	}
+	nameAnnotationPath := "/metadata/annotations/" + jsonPatchEscaper.Replace(gMSAPodSpecNameAnnotationKey)
+	contentsAnnotationPath := "/metadata/annotations/" + jsonPatchEscaper.Replace(gMSAPodSpecContentsAnnotationKey)
+
+	// cred specs requested through the GA field get their annotations populated...
+	admissionResponse, patchedValues := admitPod(t, gaWebhook, mutate, newPod(nil, &windowsOptions{GMSACredentialSpecName: stringPointer("ab")}))
+	require.True(t, admissionResponse.Allowed)
+	assert.Equal(t, "ab", patchedValues[nameAnnotationPath])
+	assert.Equal(t, contents, patchedValues[contentsAnnotationPath])
+	assert.Equal(t, contents, patchedValues["/spec/securityContext/windowsOptions/gmsaCredentialSpec"])
+	assert.NotContains(t, patchedValues, "/spec/securityContext/windowsOptions/gmsaCredentialSpecName")
+
+	// ... and vice versa
+	admissionResponse, patchedValues = admitPod(t, gaWebhook, mutate, newPod(map[string]string{gMSAPodSpecNameAnnotationKey: "ab"}, nil))
+	require.True(t, admissionResponse.Allowed)
+	assert.Equal(t, map[string]interface{}{"windowsOptions": map[string]interface{}{"gmsaCredentialSpecName": "ab", "gmsaCredentialSpec": contents}}, patchedValues["/spec/securityContext"])
+
+	// but only if the API server supports the GA fields
+	admissionResponse, patchedValues = admitPod(t, newWebhook(&fuzzKubeClient{}, &webhookConfig{enforcementMode: enforcementModeEnforce, windowsSchedulingMode: windowsSchedulingNone}), mutate, newPod(map[string]string{gMSAPodSpecNameAnnotationKey: "ab"}, nil))
+	require.True(t, admissionResponse.Allowed)
+	assert.NotContains(t, patchedValues, "/spec/securityContext")
+
+	// annotations and fields can't request different cred specs
+	admissionResponse, _ = admitPod(t, gaWebhook, mutate, newPod(map[string]string{gMSAPodSpecNameAnnotationKey: "ab"}, &windowsOptions{GMSACredentialSpecName: stringPointer("cd")}))
+	if assert.False(t, admissionResponse.Allowed) {
+		assert.Contains(t, admissionResponse.Result.Message, "request different gMSA cred specs")
+	}
+
+	for name, testCase := range map[string]struct {
+		annotations   map[string]string
+		podOptions    *windowsOptions
+		expectedField string
+	}{
+		"consistent annotations and fields": {
+			annotations: map[string]string{gMSAPodSpecNameAnnotationKey: "ab", gMSAPodSpecContentsAnnotationKey: contents},
+			podOptions:  &windowsOptions{GMSACredentialSpecName: stringPointer("ab"), GMSACredentialSpec: &reserializedContents},
+		},
+		"field missing": {
+			annotations:   map[string]string{gMSAPodSpecNameAnnotationKey: "ab", gMSAPodSpecContentsAnnotationKey: contents},
+			expectedField: "spec.securityContext.windowsOptions.gmsaCredentialSpecName",
+		},
+		"different contents": {
+			annotations:   map[string]string{gMSAPodSpecNameAnnotationKey: "ab", gMSAPodSpecContentsAnnotationKey: contents},
+			podOptions:    &windowsOptions{GMSACredentialSpecName: stringPointer("ab"), GMSACredentialSpec: stringPointer(`{"name":"forged"}`)},
+			expectedField: "spec.securityContext.windowsOptions.gmsaCredentialSpec",
+		},
+		"contents field without annotation": {
+			annotations:   map[string]string{gMSAPodSpecNameAnnotationKey: "ab"},
+			podOptions:    &windowsOptions{GMSACredentialSpecName: stringPointer("ab"), GMSACredentialSpec: &contents},
+			expectedField: "spec.securityContext.windowsOptions.gmsaCredentialSpec",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			admissionResponse, _ := admitPod(t, gaWebhook, validate, newPod(testCase.annotations, testCase.podOptions))
+
+			if testCase.expectedField == "" {
+				assert.True(t, admissionResponse.Allowed)
+				return
+			}
+
+			require.False(t, admissionResponse.Allowed)
+			require.NotNil(t, admissionResponse.Result.Details)
+			var fields []string
+			for _, cause := range admissionResponse.Result.Details.Causes {
+				fields = append(fields, cause.Field)
+			}
+			assert.Contains(t, fields, testCase.expectedField)
+		})
+	}
+}
+
+func TestDeprecatedAnnotationWarnings(t *testing.T) {
+	webhook := newWebhook(&fuzzKubeClient{}, &webhookConfig{enforcementMode: enforcementModeEnforce, windowsSchedulingMode: windowsSchedulingNone, gaGMSAFieldsAvailable: true})
+	contents, _, _ := (&fuzzKubeClient{}).retrieveCredSpecContents("ab")
+	deprecationWarnings := func(request *http.Request) []string {
+		admissionResponse, warnings, httpErr := webhook.httpRequestToAdmissionResponse(request, validate)
+		require.Nil(t, httpErr)
+		require.True(t, admissionResponse.Allowed)
+
+		var deprecations []string
+		for _, warning := range warnings {
+			if strings.Contains(warning, "is deprecated") {
+				deprecations = append(deprecations, warning)
+			}
+		}
+		return deprecations
+	}
+
+	// annotations populated alongside their GA field don't get warned about
+	podBytes, err := json.Marshal(newTestPod(map[string]string{gMSAPodSpecNameAnnotationKey: "ab", gMSAPodSpecContentsAnnotationKey: contents}))
+	require.Nil(t, err)
+	var pod map[string]interface{}
+	require.Nil(t, json.Unmarshal(podBytes, &pod))
+	pod["spec"].(map[string]interface{})["securityContext"] = map[string]interface{}{"windowsOptions": map[string]interface{}{"gmsaCredentialSpecName": "ab", "gmsaCredentialSpec": contents}}
+	podKind := metav1.GroupVersionKind{Version: "v1", Kind: "Pod"}
+	assert.Empty(t, deprecationWarnings(newObjectAdmissionHTTPRequest(t, admissionv1beta1.Create, podKind, pod, nil)))
+
+	// but annotations set on their own do
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "deployment"}}
+	deployment.Spec.Template = corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{gMSAPodSpecNameAnnotationKey: "ab"}},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "container"}}},
+	}
+	deploymentKind := metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}
+	assert.Equal(t, []string{fmt.Sprintf("annotation %s is deprecated, use the securityContext.windowsOptions.gmsaCredentialSpecName field instead", gMSAPodSpecNameAnnotationKey)},
+		deprecationWarnings(newObjectAdmissionHTTPRequest(t, admissionv1beta1.Create, deploymentKind, deployment, nil)))
+}
+
+func TestAuditAnnotations(t *testing.T) {
+	webhook := newWebhook(&fuzzKubeClient{}, &webhookConfig{enforcementMode: enforcementModeEnforce, windowsSchedulingMode: windowsSchedulingNone})
+	pod := newTestPod(map[string]string{gMSAPodSpecNameAnnotationKey: "ab", "container" + gMSAContainerSpecNameAnnotationKeySuffix: "cd"})
+
+	// pods that don't specify a service account get authorized as the default one
+	admissionResponse, _ := admitPod(t, webhook, validate, pod)
+	require.True(t, admissionResponse.Allowed)
+	assert.Equal(t, map[string]string{
+		serviceAccountAuditAnnotationKey:       defaultServiceAccountName,
+		credSpecsAuditAnnotationKey:            `{"pod":"ab","containers":{"container":"cd"}}`,
+		authorizationReasonsAuditAnnotationKey: `{"ab":"fuzzed","cd":"fuzzed"}`,
+	}, admissionResponse.AuditAnnotations)
+
+	pod.Spec.ServiceAccountName = "sa"
+	admissionResponse, _ = admitPod(t, webhook, validate, pod)
+	require.True(t, admissionResponse.Allowed)
+	assert.Equal(t, "sa", admissionResponse.AuditAnnotations[serviceAccountAuditAnnotationKey])
+
+	// pods that don't use GMSAs don't get any
+	admissionResponse, _ = admitPod(t, webhook, validate, newTestPod(nil))
+	require.True(t, admissionResponse.Allowed)
+	assert.Empty(t, admissionResponse.AuditAnnotations)
+}
+
+func TestServiceAccountBoundCredSpec(t *testing.T) {
+	webhook := newWebhook(&fuzzKubeClient{}, &webhookConfig{enforcementMode: enforcementModeEnforce, windowsSchedulingMode: windowsSchedulingNone})
+	newPod := func(serviceAccountName string, annotations map[string]string) *corev1.Pod {
+		pod := newTestPod(annotations)
+		pod.Spec.ServiceAccountName = serviceAccountName
+		return pod
+	}
+	nameAnnotationPath := "/metadata/annotations/" + jsonPatchEscaper.Replace(gMSAPodSpecNameAnnotationKey)
+
+	// pods that don't request any GMSA get their service account's
+	admissionResponse, patchedValues := admitPod(t, webhook, mutate, newPod("gmsa-ab", nil))
+	require.True(t, admissionResponse.Allowed)
+	assert.Equal(t, "ab", patchedValues[nameAnnotationPath])
+	assert.Contains(t, patchedValues, "/metadata/annotations/"+jsonPatchEscaper.Replace(gMSAPodSpecContentsAnnotationKey))
+
+	// as long as the service account is authorized to use it
+	admissionResponse, _ = admitPod(t, webhook, mutate, newPod("gmsa-abc", nil))
+	if assert.False(t, admissionResponse.Allowed) {
+		assert.Contains(t, admissionResponse.Result.Message, "service account gmsa-abc does not have `use` access to the abc gMSA cred spec (default from service account gmsa-abc's windows.k8s.io/gmsa-credential-spec-name annotation)")
+	}
+
+	// pods that do request GMSAs keep theirs
+	admissionResponse, _ = admitPod(t, webhook, mutate, newPod("gmsa-ab", map[string]string{"container" + gMSAContainerSpecNameAnnotationKeySuffix: "cd"}))
+	require.True(t, admissionResponse.Allowed)
+	assert.NotContains(t, string(admissionResponse.Patch), jsonPatchEscaper.Replace(gMSAPodSpecNameAnnotationKey))
+
+	// and service accounts without the annotation don't change anything
+	admissionResponse, _ = admitPod(t, webhook, mutate, newPod("other", nil))
+	require.True(t, admissionResponse.Allowed)
+	assert.Nil(t, admissionResponse.Patch)
+
+	// pods that don't specify a service account run as the default one
+	webhook = newWebhook(&defaultServiceAccountKubeClient{credSpecName: "abc"}, &webhookConfig{enforcementMode: enforcementModeEnforce, windowsSchedulingMode: windowsSchedulingNone})
+	admissionResponse, _ = admitPod(t, webhook, mutate, newPod("", nil))
+	if assert.False(t, admissionResponse.Allowed) {
+		assert.Contains(t, admissionResponse.Result.Message, "service account default does not have `use` access to the abc gMSA cred spec (default from service account default's windows.k8s.io/gmsa-credential-spec-name annotation)")
+	}
+}
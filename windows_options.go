@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// As of k8s 1.18, pods can request GMSAs through GA fields of their pod- and container-level
+// security contexts' windowsOptions, rather than through the alpha annotations. The version of
+// k8s.io/api we use predates these fields, so we decode them separately from pods' raw JSON, and
+// patch them through their JSON paths.
+// Pods can carry both the annotations and the fields; since kubelets and the webhook could then
+// disagree about which identity pods use if they had different values, "/mutate" populates each
+// from the other, and "/validate" requires them to agree.
+
+const (
+	gmsaCredentialSpecNameField = "gmsaCredentialSpecName"
+	gmsaCredentialSpecField     = "gmsaCredentialSpec"
+)
+
+// windowsOptions holds the GMSA fields of a WindowsSecurityContextOptions.
+type windowsOptions struct {
+	GMSACredentialSpecName *string `json:"gmsaCredentialSpecName,omitempty"`
+	GMSACredentialSpec     *string `json:"gmsaCredentialSpec,omitempty"`
+}
+
+type securityContextWithWindowsOptions struct {
+	WindowsOptions *windowsOptions `json:"windowsOptions,omitempty"`
+}
+
+// podWindowsOptions holds the GMSA fields of a pod, at pod and container levels.
+type podWindowsOptions struct {
+	Spec struct {
+		SecurityContext *securityContextWithWindowsOptions `json:"securityContext,omitempty"`
+		Containers      []struct {
+			SecurityContext *securityContextWithWindowsOptions `json:"securityContext,omitempty"`
+		} `json:"containers,omitempty"`
+	} `json:"spec"`
+}
+
+// unmarshallPodWindowsOptions unmarshalls the GMSA fields of a pod, or of a pod template, from
+// its raw JSON representation.
+func unmarshallPodWindowsOptions(raw []byte) (*podWindowsOptions, *podAdmissionError) {
+	options := &podWindowsOptions{}
+	if err := json.Unmarshal(raw, options); err != nil {
+		return nil, &podAdmissionError{error: fmt.Errorf("unable to unmarshall pod JSON object's windows options: %v", err), code: http.StatusBadRequest}
+	}
+
+	return options, nil
+}
+
+// gmsaFields describes where a pair of GMSA annotations' GA fields live.
+type gmsaFields struct {
+	nameKey, contentsKey string
+
+	// securityContextPresent is true iff the security context holding the fields is set
+	securityContextPresent bool
+	// options is nil if the security context has no windowsOptions
+	options *windowsOptions
+
+	// securityContextPatchPath is the JSON patch path to the security context holding the fields
+	securityContextPatchPath string
+	// securityContextField is the path to that same security context, as used in metav1.StatusCause
+	securityContextField string
+}
+
+// iterateOverGMSAFields calls `f` on the GA fields matching each pair of GMSA annotations,
+// in the same order as iterateOverGMSAAnnotationPairs.
+func iterateOverGMSAFields(pod *corev1.Pod, podOptions *podWindowsOptions, f func(fields *gmsaFields)) {
+	if podOptions == nil {
+		podOptions = &podWindowsOptions{}
+	}
+
+	fields := &gmsaFields{
+		nameKey:                  gMSAPodSpecNameAnnotationKey,
+		contentsKey:              gMSAPodSpecContentsAnnotationKey,
+		securityContextPresent:   podOptions.Spec.SecurityContext != nil,
+		securityContextPatchPath: "/spec/securityContext",
+		securityContextField:     "spec.securityContext",
+	}
+	if podOptions.Spec.SecurityContext != nil {
+		fields.options = podOptions.Spec.SecurityContext.WindowsOptions
+	}
+	f(fields)
+
+	for i, container := range pod.Spec.Containers {
+		fields := &gmsaFields{
+			nameKey:                  container.Name + gMSAContainerSpecNameAnnotationKeySuffix,
+			contentsKey:              container.Name + gMSAContainerSpecContentsAnnotationKeySuffix,
+			securityContextPatchPath: fmt.Sprintf("/spec/containers/%d/securityContext", i),
+			securityContextField:     fmt.Sprintf("spec.containers[%d].securityContext", i),
+		}
+		// both were unmarshalled from the same JSON array
+		if i < len(podOptions.Spec.Containers) && podOptions.Spec.Containers[i].SecurityContext != nil {
+			fields.securityContextPresent = true
+			fields.options = podOptions.Spec.Containers[i].SecurityContext.WindowsOptions
+		}
+		f(fields)
+	}
+}
+
+// credSpecName returns the value of the gmsaCredentialSpecName field, or an empty string if unset.
+func (fields *gmsaFields) credSpecName() string {
+	if fields.options == nil || fields.options.GMSACredentialSpecName == nil {
+		return ""
+	}
+	return *fields.options.GMSACredentialSpecName
+}
+
+// credSpecContents returns the value of the gmsaCredentialSpec field, if set.
+func (fields *gmsaFields) credSpecContents() (string, bool) {
+	if fields.options == nil || fields.options.GMSACredentialSpec == nil {
+		return "", false
+	}
+	return *fields.options.GMSACredentialSpec, true
+}
+
+// field returns the path to the given field of the windowsOptions, as used in metav1.StatusCause.
+func (fields *gmsaFields) field(name string) string {
+	return fmt.Sprintf("%s.windowsOptions.%s", fields.securityContextField, name)
+}
+
+// validateGMSAFieldsConsistency records a violation for each pair of GMSA annotations whose
+// values disagree with the matching GA fields.
+// On API servers that support the GA fields, an annotation set without its field (or vice versa)
+// is a disagreement, since "/mutate" populates both; except for workloads' pod templates, which
+// don't go through "/mutate", and for which only values set on both sides need to agree.
+func (webhook *webhook) validateGMSAFieldsConsistency(violations *podViolations, admissionCtx *admissionContext, pod *corev1.Pod) {
+	podTemplate := admissionCtx.workload != nil
+
+	iterateOverGMSAFields(pod, admissionCtx.windowsOptions, func(fields *gmsaFields) {
+		if fields.options == nil && (podTemplate || !webhook.config.gaGMSAFieldsAvailable) {
+			return
+		}
+
+		credSpecName := pod.Annotations[fields.nameKey]
+		if fieldCredSpecName := fields.credSpecName(); credSpecName != fieldCredSpecName && !(podTemplate && (credSpecName == "" || fieldCredSpecName == "")) {
+			violations.add(&podAdmissionError{error: fmt.Errorf("annotation %s (%q) and field %s (%q) must have the same value", fields.nameKey, credSpecName, fields.field(gmsaCredentialSpecNameField), fieldCredSpecName), pod: pod, code: http.StatusForbidden, field: fields.field(gmsaCredentialSpecNameField)})
+		}
+
+		contents, contentsPresent := pod.Annotations[fields.contentsKey]
+		fieldContents, fieldContentsPresent := fields.credSpecContents()
+		switch {
+		case contentsPresent && fieldContentsPresent:
+			if equal, _ := credSpecContentsEqual(fieldContents, contents); !equal {
+				violations.add(&podAdmissionError{error: fmt.Errorf("annotation %s and field %s must contain the same cred spec", fields.contentsKey, fields.field(gmsaCredentialSpecField)), pod: pod, code: http.StatusForbidden, field: fields.field(gmsaCredentialSpecField)})
+			}
+		case (contentsPresent || fieldContentsPresent) && !podTemplate:
+			violations.add(&podAdmissionError{error: fmt.Errorf("annotation %s and field %s must either both be set, or both be unset", fields.contentsKey, fields.field(gmsaCredentialSpecField)), pod: pod, code: http.StatusForbidden, field: fields.field(gmsaCredentialSpecField)})
+		}
+	})
+}
+
+// annotationsFromGMSAFields returns the JSON patches setting the GMSA name annotations requested
+// through the GA fields only, and records a violation for each pair of annotation and field that
+// request different cred specs. It also updates the pod's annotations accordingly.
+func (webhook *webhook) annotationsFromGMSAFields(violations *podViolations, admissionCtx *admissionContext, pod *corev1.Pod) []map[string]interface{} {
+	var patches []map[string]interface{}
+
+	iterateOverGMSAFields(pod, admissionCtx.windowsOptions, func(fields *gmsaFields) {
+		fieldCredSpecName := fields.credSpecName()
+		if fieldCredSpecName == "" {
+			return
+		}
+
+		switch credSpecName := pod.Annotations[fields.nameKey]; credSpecName {
+		case "":
+			patches = append(patches, annotationPatches(pod, fields.nameKey, fieldCredSpecName)...)
+		case fieldCredSpecName:
+		default:
+			violations.add(&podAdmissionError{error: fmt.Errorf("annotation %s (%q) and field %s (%q) request different gMSA cred specs", fields.nameKey, credSpecName, fields.field(gmsaCredentialSpecNameField), fieldCredSpecName), pod: pod, code: http.StatusForbidden, field: fields.field(gmsaCredentialSpecNameField)})
+		}
+	})
+
+	return patches
+}
+
+// gmsaFieldsPatches returns the JSON patches setting the GA fields to the same values as the
+// GMSA annotations, given the cred spec contents about to be injected into the latter.
+// It's a no-op on API servers that don't support the GA fields.
+func (webhook *webhook) gmsaFieldsPatches(admissionCtx *admissionContext, pod *corev1.Pod, contents map[string]string) []map[string]interface{} {
+	if !webhook.config.gaGMSAFieldsAvailable {
+		return nil
+	}
+
+	var patches []map[string]interface{}
+	iterateOverGMSAFields(pod, admissionCtx.windowsOptions, func(fields *gmsaFields) {
+		credSpecName := pod.Annotations[fields.nameKey]
+		credSpecContents, contentsPresent := contents[fields.contentsKey]
+		if credSpecName == "" || !contentsPresent {
+			return
+		}
+
+		updateName := fields.credSpecName() != credSpecName
+		updateContents := true
+		if fieldContents, present := fields.credSpecContents(); present {
+			updateContents, _ = credSpecContentsEqual(fieldContents, credSpecContents)
+			updateContents = !updateContents
+		}
+
+		switch {
+		case !updateName && !updateContents:
+		case !fields.securityContextPresent:
+			patches = append(patches, map[string]interface{}{
+				"op":    "add",
+				"path":  fields.securityContextPatchPath,
+				"value": map[string]interface{}{"windowsOptions": newWindowsOptions(credSpecName, credSpecContents)},
+			})
+		case fields.options == nil:
+			patches = append(patches, map[string]interface{}{
+				"op":    "add",
+				"path":  fields.securityContextPatchPath + "/windowsOptions",
+				"value": newWindowsOptions(credSpecName, credSpecContents),
+			})
+		default:
+			// "add" operations replace existing values, if any
+			if updateName {
+				patches = append(patches, map[string]interface{}{
+					"op":    "add",
+					"path":  fields.securityContextPatchPath + "/windowsOptions/" + gmsaCredentialSpecNameField,
+					"value": credSpecName,
+				})
+			}
+			if updateContents {
+				patches = append(patches, map[string]interface{}{
+					"op":    "add",
+					"path":  fields.securityContextPatchPath + "/windowsOptions/" + gmsaCredentialSpecField,
+					"value": credSpecContents,
+				})
+			}
+		}
+	})
+
+	return patches
+}
+
+func newWindowsOptions(credSpecName, credSpecContents string) *windowsOptions {
+	return &windowsOptions{
+		GMSACredentialSpecName: &credSpecName,
+		GMSACredentialSpec:     &credSpecContents,
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// workloadKinds are the kinds of workloads whose pod templates "/validate" checks, so that
+// e.g. applying a deployment whose pods could never be admitted fails right away, rather than
+// its replica sets failing to create pods.
+var workloadKinds = map[string]bool{
+	"Deployment":  true,
+	"StatefulSet": true,
+	"DaemonSet":   true,
+	"Job":         true,
+	"CronJob":     true,
+}
+
+// workload only contains the fields we need from workload objects; this allows handling all
+// the workload kinds, in all their API versions (e.g. apps/v1beta1 vs apps/v1 deployments),
+// the same way.
+type workload struct {
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	// pod templates are kept raw, so that their GA GMSA fields can be unmarshalled too, see
+	// unmarshallPodWindowsOptions
+	Spec struct {
+		// Template is set for all workload kinds but cron jobs...
+		Template json.RawMessage `json:"template,omitempty"`
+		// ... whose pod template is nested in their job template.
+		JobTemplate *struct {
+			Spec struct {
+				Template json.RawMessage `json:"template,omitempty"`
+			} `json:"spec"`
+		} `json:"jobTemplate,omitempty"`
+	} `json:"spec"`
+}
+
+// unmarshallWorkload unmarshalls a workload object from its raw JSON representation.
+func unmarshallWorkload(object runtime.RawExtension) (*workload, *podAdmissionError) {
+	workload := &workload{}
+	if err := json.Unmarshal(object.Raw, workload); err != nil {
+		return nil, &podAdmissionError{error: fmt.Errorf("unable to unmarshall workload JSON object: %v", err), code: http.StatusBadRequest}
+	}
+
+	return workload, nil
+}
+
+// podTemplate returns the workload's raw pod template, if any, along with its path in the workload.
+func (workload *workload) podTemplate() (json.RawMessage, string) {
+	if workload.Spec.JobTemplate != nil {
+		return workload.Spec.JobTemplate.Spec.Template, "spec.jobTemplate.spec.template"
+	}
+	return workload.Spec.Template, "spec.template"
+}
+
+// podTemplatesEqual returns true iff both raw pod templates are semantically equal.
+func podTemplatesEqual(a, b json.RawMessage) bool {
+	aValue, aErr := decodeJSON(string(a))
+	bValue, bErr := decodeJSON(string(b))
+	return aErr == nil && bErr == nil && reflect.DeepEqual(aValue, bValue)
+}
+
+// templatePod returns a pod as the workload's controller would create it from the given template,
+// as far as GMSA checks are concerned.
+func templatePod(template *corev1.PodTemplateSpec, namespace string) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: *template.ObjectMeta.DeepCopy(),
+		Spec:       *template.Spec.DeepCopy(),
+	}
+	pod.Namespace = namespace
+
+	// that's what the service account admission plugin does when creating the actual pods
+	if pod.Spec.ServiceAccountName == "" {
+		pod.Spec.ServiceAccountName = pod.Spec.DeprecatedServiceAccount
+	}
+	if pod.Spec.ServiceAccountName == "" {
+		pod.Spec.ServiceAccountName = "default"
+	}
+
+	return pod
+}
+
+// validateWorkloadRequest runs the same checks on workloads' pod templates as on pod creations.
+// Updates that don't change the pod template, e.g. scaling, are always allowed.
+func (webhook *webhook) validateWorkloadRequest(admissionCtx *admissionContext, request *admissionv1beta1.AdmissionRequest) (*admissionv1beta1.AdmissionResponse, *podAdmissionError) {
+	if request.Operation != admissionv1beta1.Create && request.Operation != admissionv1beta1.Update {
+		return nil, &podAdmissionError{error: fmt.Errorf("unpexpected operation %s", request.Operation), code: http.StatusBadRequest}
+	}
+
+	workload, err := unmarshallWorkload(request.Object)
+	if err != nil {
+		return nil, err
+	}
+	admissionCtx.workload = &corev1.ObjectReference{
+		APIVersion: metav1.GroupVersion{Group: request.Kind.Group, Version: request.Kind.Version}.String(),
+		Kind:       request.Kind.Kind,
+		Name:       workload.Name,
+		Namespace:  admissionCtx.namespace,
+		UID:        workload.UID,
+	}
+	admissionCtx.logger.withWorkload(admissionCtx.workload)
+
+	rawTemplate, templatePath := workload.podTemplate()
+	if len(rawTemplate) == 0 {
+		return nil, &podAdmissionError{error: fmt.Errorf("%s %s has no pod template", request.Kind.Kind, workload.Name), code: http.StatusBadRequest}
+	}
+
+	if request.Operation == admissionv1beta1.Update {
+		oldWorkload, err := unmarshallWorkload(request.OldObject)
+		if err != nil {
+			return nil, err
+		}
+		if oldRawTemplate, _ := oldWorkload.podTemplate(); podTemplatesEqual(rawTemplate, oldRawTemplate) {
+			return &admissionv1beta1.AdmissionResponse{Allowed: true}, nil
+		}
+	}
+
+	template := &corev1.PodTemplateSpec{}
+	if err := json.Unmarshal(rawTemplate, template); err != nil {
+		return nil, &podAdmissionError{error: fmt.Errorf("unable to unmarshall %s %s's pod template: %v", request.Kind.Kind, workload.Name, err), code: http.StatusBadRequest}
+	}
+	windowsOptions, err := unmarshallPodWindowsOptions(rawTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	pod := templatePod(template, admissionCtx.namespace)
+	admissionCtx.pod = pod
+	admissionCtx.windowsOptions = windowsOptions
+
+	admissionResponse, admissionErr := webhook.validateCreateRequest(admissionCtx, pod)
+	if admissionErr != nil {
+		admissionErr.prefixFields(templatePath)
+	}
+	return admissionResponse, admissionErr
+}
+
+// prefixFields makes the fields of a violation found in a workload's pod template relative
+// to the workload itself.
+func (err *podAdmissionError) prefixFields(prefix string) {
+	if err.field != "" {
+		err.field = prefix + "." + err.field
+	}
+	for i := range err.causes {
+		if err.causes[i].Field != "" {
+			err.causes[i].Field = prefix + "." + err.causes[i].Field
+		}
+	}
+}